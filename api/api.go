@@ -33,7 +33,7 @@ func Register(ctx context.Context, endpointHost string, validateToken string, in
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "BitterJohn")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := DefaultClient().HTTP.Do(req)
 	if err != nil {
 		return cdnNames, nil, err
 	}
@@ -61,3 +61,51 @@ func Register(ctx context.Context, endpointHost string, validateToken string, in
 	}
 	return cdnNames, users, nil
 }
+
+// Heartbeat reports the status to SweetLisa and returns the passages to sync. It returns
+// server.ErrHeartbeatUnsupported if SweetLisa does not accept heartbeats.
+func Heartbeat(ctx context.Context, endpointHost string, ticket string, heartbeat server.HeartbeatReq) (*server.HeartbeatResp, error) {
+	b, err := jsoniter.Marshal(heartbeat)
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{
+		Scheme: "https",
+		Host:   endpointHost,
+		Path:   path.Join("api", "ticket", ticket, "heartbeat"),
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "BitterJohn")
+	resp, err := DefaultClient().HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, server.ErrHeartbeatUnsupported
+	default:
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("SweetLisa responsed with %v: %v", strconv.Quote(resp.Status), string(b))
+	}
+	var respBody struct {
+		Code    string
+		Data    *server.HeartbeatResp
+		Message string
+	}
+	if err := jsoniter.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return nil, err
+	}
+	if respBody.Code != "SUCCESS" {
+		return nil, fmt.Errorf(respBody.Message)
+	}
+	if respBody.Data == nil {
+		return &server.HeartbeatResp{}, nil
+	}
+	return respBody.Data, nil
+}
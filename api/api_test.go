@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var received server.HeartbeatReq
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/ticket/ticket/heartbeat":
+			if err := jsoniter.NewDecoder(r.Body).Decode(&received); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_ = jsoniter.NewEncoder(w).Encode(map[string]interface{}{
+				"Code": "SUCCESS",
+				"Data": server.HeartbeatResp{Passages: []model.Passage{{In: model.In{Argument: model.Argument{Protocol: "shadowsocks", Password: "user"}}}}},
+			})
+		case "/api/ticket/unchanged/heartbeat":
+			_ = jsoniter.NewEncoder(w).Encode(map[string]interface{}{"Code": "SUCCESS"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	h := sha256.Sum256(s.Certificate().RawSubjectPublicKeyInfo)
+	if err := useClient(t, config.LisaClient{PinSHA256: []string{base64.StdEncoding.EncodeToString(h[:])}}); err != nil {
+		t.Fatal(err)
+	}
+	host := s.Listener.Addr().String()
+
+	resp, err := Heartbeat(context.Background(), host, "ticket", server.HeartbeatReq{Sessions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Sessions != 3 {
+		t.Errorf("unexpected heartbeat received: %+v", received)
+	}
+	if len(resp.Passages) != 1 || resp.Passages[0].In.Password != "user" {
+		t.Errorf("unexpected passages: %v", resp.Passages)
+	}
+
+	if resp, err = Heartbeat(context.Background(), host, "unchanged", server.HeartbeatReq{}); err != nil || resp.Passages != nil {
+		t.Errorf("unexpected response without passages: %+v, %v", resp, err)
+	}
+
+	if _, err = Heartbeat(context.Background(), host, "old", server.HeartbeatReq{}); err != server.ErrHeartbeatUnsupported {
+		t.Errorf("unexpected error from SweetLisa without heartbeats: %v", err)
+	}
+}
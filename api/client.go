@@ -0,0 +1,209 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator"
+	"golang.org/x/net/proxy"
+)
+
+// Client is used for the requests to SweetLisa.
+type Client struct {
+	HTTP     *http.Client
+	Resolver *net.Resolver
+}
+
+var client atomic.Pointer[Client]
+
+func init() {
+	client.Store(&Client{HTTP: http.DefaultClient, Resolver: net.DefaultResolver})
+}
+
+// DefaultClient returns the client set by InitClient, which uses http.DefaultClient and the system resolver by default.
+func DefaultClient() *Client {
+	return client.Load()
+}
+
+// InitClient sets the client for the requests to SweetLisa. The resolver is also used to validate the CDN.
+func InitClient(conf config.LisaClient) error {
+	c, err := NewClient(conf)
+	if err != nil {
+		return err
+	}
+	client.Store(c)
+	cdn_validator.Resolver = c.Resolver
+	return nil
+}
+
+func NewClient(conf config.LisaClient) (*Client, error) {
+	resolver, err := newResolver(conf.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	var network string
+	switch conf.IPFamily {
+	case "":
+		network = "tcp"
+	case "4", "6":
+		network = "tcp" + conf.IPFamily
+	default:
+		return nil, fmt.Errorf("invalid IP family: %v", conf.IPFamily)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Resolver: resolver}
+	if conf.BindAddress != "" {
+		ip := net.ParseIP(conf.BindAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address: %v", conf.BindAddress)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	var d proxy.ContextDialer = dialerFunc(func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	})
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if conf.Proxy != "" {
+		u, err := url.Parse(conf.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https":
+			transport.Proxy = http.ProxyURL(u)
+		case "socks5", "socks5h":
+			pd, err := proxy.FromURL(u, d.(proxy.Dialer))
+			if err != nil {
+				return nil, err
+			}
+			d = pd.(proxy.ContextDialer)
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme: %v", u.Scheme)
+		}
+	}
+	transport.DialContext = d.DialContext
+	if transport.TLSClientConfig, err = newTLSConfig(conf); err != nil {
+		return nil, err
+	}
+	timeout := 30 * time.Second
+	if conf.TimeoutSec > 0 {
+		timeout = time.Duration(conf.TimeoutSec) * time.Second
+	}
+	return &Client{
+		HTTP:     &http.Client{Transport: transport, Timeout: timeout},
+		Resolver: resolver,
+	}, nil
+}
+
+// LookupValidateToken returns the token in the cdn-validate TXT record of SweetLisa, or empty string if not found.
+func (c *Client) LookupValidateToken(ctx context.Context, host string) string {
+	t, _ := c.Resolver.LookupTXT(ctx, "cdn-validate."+host)
+	if len(t) > 0 {
+		return t[0]
+	}
+	return ""
+}
+
+// newResolver returns the resolver using the DNS server, such as udp://1.1.1.1:53 or tcp://8.8.8.8.
+func newResolver(server string) (*net.Resolver, error) {
+	if server == "" {
+		return net.DefaultResolver, nil
+	}
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver: %w", err)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("invalid resolver: unsupported scheme: %v", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(strings.Trim(u.Host, "[]"), "53")
+	}
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid resolver: %w", err)
+	}
+	var dialer net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, u.Scheme, addr)
+		},
+	}, nil
+}
+
+func newTLSConfig(conf config.LisaClient) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(conf.RootCAs) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range conf.RootCAs {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("%v: no certificate found", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(conf.PinSHA256) > 0 {
+		var pins [][]byte
+		for _, pin := range conf.PinSHA256 {
+			b, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid pinSHA256: %v", pin)
+			}
+			pins = append(pins, b)
+		}
+		// The pin replaces the verification by CAs so that self-signed certificates can be used.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no certificate from SweetLisa")
+			}
+			h := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(h[:], pin) {
+					return nil
+				}
+			}
+			return fmt.Errorf("the certificate of SweetLisa is not pinned: %v", base64.StdEncoding.EncodeToString(h[:]))
+		}
+	}
+	return tlsConfig, nil
+}
+
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
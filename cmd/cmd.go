@@ -29,4 +29,6 @@ func init() {
 	rootCmd.AddCommand(installCmd)
 	rootCmd.AddCommand(updateCmd)
 	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(ctlCmd)
+	rootCmd.AddCommand(doctorCmd)
 }
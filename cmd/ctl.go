@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ctlSocket string
+	ctlAddr   string
+	ctlToken  string
+
+	ctlCmd = &cobra.Command{
+		Use:   "ctl",
+		Short: "Control the running BitterJohn through the admin API",
+	}
+	ctlStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the registration status and traffic",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var status server.AdminStatus
+			ctlRequest(http.MethodGet, "/status", nil, &status)
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "Protocol:\t%v\n", status.Protocol)
+			for _, s := range status.Servers {
+				lastAlive := "never"
+				if !s.LastAlive.IsZero() {
+					lastAlive = time.Since(s.LastAlive).Truncate(time.Second).String() + " ago"
+				}
+				fmt.Fprintf(w, "Registered:\t%v (last alive %v)\n", s.Registered, lastAlive)
+				fmt.Fprintf(w, "Passages:\t%v\n", s.Passages)
+			}
+			fmt.Fprintf(w, "Connections:\t%v\n", status.Sessions)
+			fmt.Fprintf(w, "Relayed:\t%v up, %v down\n", formatBytes(status.RelayedUp), formatBytes(status.RelayedDown))
+			fmt.Fprintf(w, "Quota exhausted:\t%v\n", status.QuotaExhausted)
+			fmt.Fprintf(w, "Withdrawn:\t%v\n", status.Withdrawn)
+			if len(status.WithdrawnGroups) > 0 {
+				fmt.Fprintf(w, "Withdrawn groups:\t%v\n", strings.Join(status.WithdrawnGroups, ", "))
+			}
+			if v := status.CDNValidation; v != nil {
+				verdict := "passed"
+				if !v.Passed {
+					verdict = "failed: " + v.Reason
+				}
+				fmt.Fprintf(w, "CDN validation:\t%v (%v, %v ago)\n", verdict, v.CDN, time.Since(v.Time).Truncate(time.Second))
+			}
+			_ = w.Flush()
+		},
+	}
+	ctlPassagesCmd = &cobra.Command{
+		Use:   "passages",
+		Short: "List the passages without credentials",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var passages []server.AdminPassage
+			ctlRequest(http.MethodGet, "/passages", nil, &passages)
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "KEY\tUSE\tPROTOCOL\tMETHOD\tFROM\tTO")
+			for _, p := range passages {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", p.Key, p.Use, p.Protocol, p.Method, p.From, p.To)
+			}
+			_ = w.Flush()
+		},
+	}
+	ctlConnsCmd = &cobra.Command{
+		Use:   "conns",
+		Short: "List the active connections",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var conns []server.AdminConn
+			ctlRequest(http.MethodGet, "/conns", nil, &conns)
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tPROTOCOL\tNETWORK\tPASSAGE\tSOURCE\tTARGET\tUP\tDOWN\tAGE")
+			for _, c := range conns {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", c.ID, c.Protocol, c.Network, c.Passage, c.Source, c.Target,
+					formatBytes(c.Up), formatBytes(c.Down), time.Since(c.Start).Truncate(time.Second))
+			}
+			_ = w.Flush()
+		},
+	}
+	ctlKillCmd = &cobra.Command{
+		Use:   "kill <id>...",
+		Short: "Kill active connections by ID",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			for _, id := range args {
+				if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+					log.Fatal("bad id: %v", strconv.Quote(id))
+				}
+				ctlRequest(http.MethodPost, "/conns/kill", url.Values{"id": {id}}, nil)
+				fmt.Printf("Killed %v\n", id)
+			}
+		},
+	}
+	ctlReregisterCmd = &cobra.Command{
+		Use:   "reregister",
+		Short: "Register at SweetLisa again",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctlRequest(http.MethodPost, "/reregister", nil, nil)
+			fmt.Println("OK")
+		},
+	}
+	ctlSyncCmd = &cobra.Command{
+		Use:   "sync",
+		Short: "Sync passages again from those SweetLisa sent last time",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctlRequest(http.MethodPost, "/sync", nil, nil)
+			fmt.Println("OK")
+		},
+	}
+)
+
+func init() {
+	ctlCmd.PersistentFlags().StringVar(&ctlSocket, "socket", "", "unix socket of the admin API (default is admin.sock in the data directory)")
+	ctlCmd.PersistentFlags().StringVar(&ctlAddr, "addr", "", "TCP address of the admin API, which is used instead of the unix socket")
+	ctlCmd.PersistentFlags().StringVar(&ctlToken, "token", "", "token of the admin API through TCP")
+	ctlCmd.AddCommand(ctlStatusCmd)
+	ctlCmd.AddCommand(ctlPassagesCmd)
+	ctlCmd.AddCommand(ctlConnsCmd)
+	ctlCmd.AddCommand(ctlKillCmd)
+	ctlCmd.AddCommand(ctlReregisterCmd)
+	ctlCmd.AddCommand(ctlSyncCmd)
+}
+
+// ctlRequest requests the admin API and decodes the response into v if v is not nil.
+func ctlRequest(method string, path string, query url.Values, v interface{}) {
+	client := http.DefaultClient
+	host := ctlAddr
+	if host == "" {
+		socket, err := server.AdminSocket(config.Admin{Socket: ctlSocket})
+		if err != nil {
+			log.Fatal("%v", err)
+		}
+		client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}}
+		host = "unix"
+	}
+	u := url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	if ctlToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ctlToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatal("Failed to connect to the admin API. Is BitterJohn running? %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		b, _ := io.ReadAll(resp.Body)
+		if jsoniter.Unmarshal(b, &e) != nil || e.Error == "" {
+			e.Error = string(b)
+		}
+		log.Fatal("%v: %v", resp.Status, e.Error)
+	}
+	if v != nil {
+		if err = jsoniter.NewDecoder(resp.Body).Decode(v); err != nil {
+			log.Fatal("%v", err)
+		}
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%vB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
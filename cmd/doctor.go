@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/api"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/resolver"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// MaxVmessClockSkew is the max clock skew vmess tolerates before authentication fails
+	MaxVmessClockSkew = 90 * time.Second
+	MaxClockSkew      = 10 * time.Second
+)
+
+var (
+	doctorCmd = &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose the configuration and the environment before running",
+		Run: func(cmd *cobra.Command, args []string) {
+			if !Doctor() {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	doctorCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default is BitterJohn.json)")
+}
+
+type checkStatus int
+
+const (
+	checkPass checkStatus = iota
+	checkWarn
+	checkFail
+)
+
+func (s checkStatus) String() string {
+	switch s {
+	case checkPass:
+		return "PASS"
+	case checkWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+type checkResult struct {
+	Name    string
+	Status  checkStatus
+	Message string
+	Remedy  string
+}
+
+// Doctor runs the checks and prints the report. It returns false if any blocking check failed.
+func Doctor() (ok bool) {
+	initConfig()
+	conf := &config.ParamsObj
+
+	var results []checkResult
+	proto := protocol.Protocol(conf.John.Protocol)
+	if !proto.Valid() {
+		results = append(results, checkResult{
+			Name:    "Protocol",
+			Status:  checkFail,
+			Message: fmt.Sprintf("protocol %v is invalid", strconv.Quote(conf.John.Protocol)),
+			Remedy:  "Set john.protocol to one of shadowsocks, vmess, vmess+tls+grpc and juicity.",
+		})
+	} else {
+		results = append(results, checkResult{Name: "Protocol", Status: checkPass, Message: conf.John.Protocol})
+		results = append(results, checkListen(proto, conf.John.Listen))
+		if proto == protocol.ProtocolVMessTlsGrpc {
+			results = append(results, checkACMEPort())
+		}
+		if proto == protocol.ProtocolJuicity {
+			results = append(results, checkJuicityCert())
+		}
+	}
+	var sni string
+	if common.StringsHas(strings.Split(conf.John.Protocol, "+"), "tls") {
+		var result checkResult
+		sni, result = checkSNI(conf.John.Hostname, conf.Lisa.Host)
+		results = append(results, result)
+	}
+	results = append(results, checkDNS(conf.John.Hostname, sni)...)
+	if err := api.InitClient(conf.Lisa.Client); err != nil {
+		results = append(results, checkResult{
+			Name:    "SweetLisa client",
+			Status:  checkFail,
+			Message: err.Error(),
+			Remedy:  "Fix lisa.client in the config file.",
+		})
+	}
+	results = append(results, checkClock(proto, conf.Lisa.Host))
+	results = append(results, checkBBR())
+
+	ok = true
+	for _, r := range results {
+		fmt.Printf("[%v] %v: %v\n", r.Status, r.Name, r.Message)
+		if r.Status != checkPass && r.Remedy != "" {
+			fmt.Printf("       Remedy: %v\n", r.Remedy)
+		}
+		if r.Status == checkFail {
+			ok = false
+		}
+	}
+	return ok
+}
+
+func checkListen(proto protocol.Protocol, addr string) checkResult {
+	result := checkResult{Name: "Listen " + addr}
+	lt, err := net.Listen("tcp", addr)
+	if err == nil {
+		_ = lt.Close()
+	}
+	if err == nil && (proto == protocol.ProtocolShadowsocks || proto == protocol.ProtocolJuicity) {
+		var lu net.PacketConn
+		if lu, err = net.ListenPacket("udp", addr); err == nil {
+			_ = lu.Close()
+		}
+	}
+	if err != nil {
+		result.Status = checkFail
+		result.Message = err.Error()
+		result.Remedy = "Stop the process occupying the port (is BitterJohn already running?) or change john.listen."
+		return result
+	}
+	result.Message = "available"
+	return result
+}
+
+func checkACMEPort() checkResult {
+	result := checkResult{Name: "Port 80 for ACME challenges"}
+	lt, err := net.Listen("tcp", ":80")
+	if err != nil {
+		result.Status = checkFail
+		result.Message = err.Error()
+		result.Remedy = "Free port 80 (e.g. stop nginx or apache) so that the certificate can be issued, or run as root."
+		return result
+	}
+	_ = lt.Close()
+	result.Message = "available"
+	return result
+}
+
+func checkJuicityCert() checkResult {
+	result := checkResult{Name: "Juicity certificate"}
+	crtPath, err := config.DataFile(server.JuicityDomain + "_443.crt")
+	if err != nil {
+		result.Status = checkFail
+		result.Message = err.Error()
+		return result
+	}
+	keyPath, err := config.DataFile(server.JuicityDomain + "_443.key")
+	if err != nil {
+		result.Status = checkFail
+		result.Message = err.Error()
+		return result
+	}
+	crt, errCrt := os.ReadFile(crtPath)
+	key, errKey := os.ReadFile(keyPath)
+	if err = errors.Join(errCrt, errKey); err != nil {
+		result.Status = checkWarn
+		result.Message = fmt.Sprintf("not found at %v", crtPath)
+		result.Remedy = fmt.Sprintf("BitterJohn copies it from %v:443 at the first run. Make sure the box can reach it.", server.JuicityDomain)
+		return result
+	}
+	pair, err := tls.X509KeyPair(crt, key)
+	if err == nil {
+		pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	}
+	if err != nil {
+		result.Status = checkFail
+		result.Message = fmt.Sprintf("%v: %v", crtPath, err)
+		result.Remedy = fmt.Sprintf("Remove %v and %v to copy them again at the next run.", crtPath, keyPath)
+		return result
+	}
+	result.Message = fmt.Sprintf("%v (expires at %v)", crtPath, pair.Leaf.NotAfter.Format(time.DateOnly))
+	return result
+}
+
+func checkSNI(hostnames string, rootDomain string) (sni string, result checkResult) {
+	result = checkResult{Name: "TLS SNI"}
+	sni, err := common.HostsToSNI(hostnames, rootDomain)
+	if err != nil {
+		result.Status = checkFail
+		result.Message = err.Error()
+		result.Remedy = "Put a domain or an IPv4 address first in john.hostname."
+		return "", result
+	}
+	result.Message = sni
+	return sni, result
+}
+
+// checkDNS checks whether the domains in hostnames and the sni point at this box.
+func checkDNS(hostnames string, sni string) (results []checkResult) {
+	var domains []string
+	for _, h := range strings.Split(hostnames, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(h); err != nil {
+			domains = append(domains, h)
+		}
+	}
+	if sni != "" && !common.StringsHas(domains, sni) {
+		domains = append(domains, sni)
+	}
+	localIPs, public := localAddrs()
+	for _, domain := range domains {
+		result := checkResult{Name: "DNS record of " + domain}
+		ips, err := resolver.LookupHost(domain)
+		if err != nil || len(ips) == 0 {
+			result.Status = checkFail
+			result.Message = "no record found"
+			if err != nil {
+				result.Message = err.Error()
+			}
+			result.Remedy = "Add an A or AAAA record pointing at this box."
+			results = append(results, result)
+			continue
+		}
+		result.Message = strings.Join(ips, ", ")
+		var matched bool
+		for _, ip := range ips {
+			if addr, err := netip.ParseAddr(ip); err == nil && localIPs[addr.Unmap()] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			result.Status = checkWarn
+			if public {
+				result.Message += " (none of them belongs to this box)"
+				result.Remedy = "Point the record at this box."
+			} else {
+				result.Message += " (cannot verify behind NAT)"
+				result.Remedy = "Make sure the record points at the public address of this box."
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// localAddrs returns the addresses of interfaces and whether any of them is public.
+func localAddrs() (addrs map[netip.Addr]bool, public bool) {
+	addrs = make(map[netip.Addr]bool)
+	ifAddrs, _ := net.InterfaceAddrs()
+	for _, a := range ifAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		addrs[addr] = true
+		if addr.IsGlobalUnicast() && !addr.IsPrivate() {
+			public = true
+		}
+	}
+	return addrs, public
+}
+
+func checkClock(proto protocol.Protocol, lisaHost string) checkResult {
+	result := checkResult{Name: "Clock"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+lisaHost, nil)
+	if err != nil {
+		result.Status = checkWarn
+		result.Message = err.Error()
+		return result
+	}
+	resp, err := api.DefaultClient().HTTP.Do(req)
+	if err != nil {
+		result.Status = checkWarn
+		result.Message = fmt.Sprintf("cannot get the time from %v: %v", lisaHost, err)
+		return result
+	}
+	_ = resp.Body.Close()
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		result.Status = checkWarn
+		result.Message = fmt.Sprintf("cannot get the time from %v: %v", lisaHost, err)
+		return result
+	}
+	skew := time.Since(remote).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	result.Message = fmt.Sprintf("%v off from %v", skew, lisaHost)
+	isVmess := proto == protocol.ProtocolVMessTCP || proto == protocol.ProtocolVMessTlsGrpc
+	switch {
+	case isVmess && skew > MaxVmessClockSkew:
+		result.Status = checkFail
+		result.Remedy = "VMess rejects users beyond 90 seconds of clock skew. Enable NTP, e.g. timedatectl set-ntp true."
+	case skew > MaxClockSkew:
+		result.Status = checkWarn
+		result.Remedy = "Enable NTP, e.g. timedatectl set-ntp true."
+	}
+	return result
+}
+
+func checkBBR() checkResult {
+	result := checkResult{Name: "TCP congestion control"}
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_congestion_control")
+	if err != nil {
+		result.Status = checkWarn
+		result.Message = err.Error()
+		return result
+	}
+	cc := strings.TrimSpace(string(b))
+	result.Message = cc
+	if cc != "bbr" {
+		result.Status = checkWarn
+		result.Remedy = "Enable BBR: echo -e 'net.core.default_qdisc=fq\\nnet.ipv4.tcp_congestion_control=bbr' >> /etc/sysctl.conf && sysctl -p"
+	}
+	return result
+}
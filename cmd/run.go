@@ -4,12 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/daeuniverse/softwind/netproxy"
@@ -24,6 +25,7 @@ import (
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/copy_cert"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/disk_bloom"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/metrics"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/resolver"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/viper_tool"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
@@ -45,6 +47,10 @@ var (
 			v.BindPFlag("john.log.maxDays", cmd.PersistentFlags().Lookup("log-max-days"))
 			v.BindPFlag("john.log.disableTimestamp", cmd.PersistentFlags().Lookup("log-disable-timestamp"))
 			v.BindPFlag("john.log.disableColor", cmd.PersistentFlags().Lookup("log-disable-color"))
+			v.BindPFlag("john.log.format", cmd.PersistentFlags().Lookup("log-format"))
+			v.BindPFlag("john.log.redact", cmd.PersistentFlags().Lookup("log-redact"))
+			v.BindPFlag("john.log.output", cmd.PersistentFlags().Lookup("log-output"))
+			v.BindPFlag("john.log.maxSizeMiB", cmd.PersistentFlags().Lookup("log-max-size"))
 			v.BindPFlag("john.doNotValidateCDN", cmd.PersistentFlags().Lookup("do-not-validate-cdn"))
 
 			if err := Run(); err != nil {
@@ -62,6 +68,10 @@ func init() {
 	runCmd.PersistentFlags().Int64("log-max-days", 0, "maximum number of days to keep log files (default is 3)")
 	runCmd.PersistentFlags().Bool("log-disable-timestamp", false, "disable the output of timestamp")
 	runCmd.PersistentFlags().Bool("log-disable-color", false, "disable the color of log")
+	runCmd.PersistentFlags().String("log-format", "", "optional values: text or json (default is text)")
+	runCmd.PersistentFlags().String("log-redact", "", "optional values: full, hash, truncate or omit (default is hash)")
+	runCmd.PersistentFlags().String("log-output", "", "optional values: console, file, journald or syslog")
+	runCmd.PersistentFlags().Int64("log-max-size", 0, "maximum size in MiB of the log file before it is rotated")
 	runCmd.PersistentFlags().Bool("do-not-validate-cdn", false, "do not validate the CDN configuration of the peer SweetLisa")
 }
 
@@ -69,6 +79,16 @@ func Run() (err error) {
 	initConfig()
 
 	server.InitLimitedDialer()
+	if err = api.InitClient(config.ParamsObj.Lisa.Client); err != nil {
+		return err
+	}
+	if err = server.InitHooks(config.ParamsObj.John.Hooks); err != nil {
+		return err
+	}
+	defer server.WaitHooks(server.DefaultHookTimeout)
+	if err = server.InitRateLimiter(); err != nil {
+		return err
+	}
 
 	shadowsocks.DefaultIodizedSource = "https://autumn-cell-a7f2.tuta.cc/explore"
 
@@ -126,6 +146,21 @@ func Run() (err error) {
 		dialer = server.FullconePrivateLimitedDialer
 	}
 
+	groups, err := server.ConfigGroups(conf)
+	if err != nil {
+		return err
+	}
+	if err = server.InitMsgAuth(conf); err != nil {
+		return err
+	}
+	if err = server.ValidateAdmin(conf.John.Admin); err != nil {
+		return fmt.Errorf("admin: %w", err)
+	}
+	if err = server.InitManagerSources(done, conf.John.ManagerSources, api.DefaultClient().Resolver); err != nil {
+		return err
+	}
+	allGroups := server.Groups(conf.Lisa, server.Argument{Ticket: conf.John.Ticket, Groups: groups})
+
 	// listen
 	s, err := server.NewServer(ctx, dialer,
 		conf.John.Protocol, conf.Lisa, server.Argument{
@@ -134,6 +169,7 @@ func Run() (err error) {
 			Hostnames:  conf.John.Hostname,
 			Port:       conf.John.Port,
 			NoRelay:    conf.John.NoRelay,
+			Groups:     groups,
 		})
 	if err != nil {
 		return fmt.Errorf("%v", err)
@@ -161,53 +197,83 @@ func Run() (err error) {
 		}
 		log.Alert("Found DNS record")
 	}
+	go reloadLogLevels()
+	if err = server.InitAccessLog(conf.John.AccessLog); err != nil {
+		return err
+	}
 	go func() {
 		err = s.Listen(conf.John.Listen)
 		close(done)
 	}()
 
-	if !config.ParamsObj.John.DoNotValidateCDN {
+	go func() {
+		if err := server.ListenAdmin(conf.John.Admin); err != nil {
+			log.Warn("admin: %v", err)
+		}
+	}()
+
+	if conf.John.Metrics.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
 		go func() {
-			// check secrecy of lisa at intervals
-			var consecutiveFailure uint32
-			for {
-				select {
-				case <-done:
-					break
-				default:
-				}
-				var cdn string
-				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-				t, _ := net.LookupTXT("cdn-validate." + config.ParamsObj.Lisa.Host)
-				var validateToken string
-				if len(t) > 0 {
-					validateToken = t[0]
-				}
-				cdn, err = api.TrustedHost(ctx, config.ParamsObj.Lisa.Host, validateToken)
-				if err != nil {
-					switch {
-					case strings.Contains(err.Error(), "context deadline exceeded"):
-						// pass
-						log.Warn("%v: %v", cdn, err)
-					case errors.Is(err, cdn_validator.ErrCanStealIP):
-						close(done)
-						log.Error("%v: %v", cdn, err)
-					case errors.Is(err, cdn_validator.ErrFailedValidate):
-						atomic.AddUint32(&consecutiveFailure, 1)
-						if consecutiveFailure >= 3 {
-							log.Error("%v: %v", cdn, err)
-							// TODO: unregister and wait for recover
-						}
-					}
-				} else {
-					consecutiveFailure = 0
-				}
-				cancel()
-				time.Sleep(30*time.Second + time.Duration(fastrand.Intn(151))*time.Second)
+			log.Info("Serving metrics at http://%v/metrics", conf.John.Metrics.Listen)
+			if err := http.ListenAndServe(conf.John.Metrics.Listen, mux); err != nil {
+				log.Warn("metrics: %v", err)
 			}
 		}()
 	}
 
+	if limit := conf.John.BandwidthLimit; limit.Enable && limit.Enforce {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go server.GuardQuota(ctx)
+	}
+
+	var tickets []string
+	for _, g := range allGroups {
+		g := g
+		tickets = append(tickets, g.Ticket)
+		if err = server.RunHeartbeat(done, s, g.Ticket, conf.John.Heartbeat, func(ctx context.Context, req server.HeartbeatReq) (*server.HeartbeatResp, error) {
+			return api.Heartbeat(ctx, g.Lisa.Host, g.Ticket, req)
+		}); err != nil {
+			return err
+		}
+	}
+	server.RunManagerRotation(done, s, tickets, conf.John.ManagerRotation)
+
+	if !config.ParamsObj.John.DoNotValidateCDN {
+		cdn_validator.CacheTTL = time.Duration(conf.John.CDNCacheTTLSec) * time.Second
+		if conf.John.CDNCIDRsFile != "" {
+			file, err := common.HomeExpand(conf.John.CDNCIDRsFile)
+			if err != nil {
+				return err
+			}
+			if err = cdn_validator.LoadCIDRs(file); err != nil {
+				return err
+			}
+		}
+		for _, g := range allGroups {
+			g := g
+			go func() {
+				// check secrecy of lisa at intervals, and withdraw from its group until it passes again if not
+				withdrawal := server.NewWithdrawal([]server.Server{s}, g.Ticket)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+					validateToken := api.DefaultClient().LookupValidateToken(ctx, g.Lisa.Host)
+					cdn, err := api.TrustedHost(ctx, g.Lisa.Host, validateToken)
+					cancel()
+					withdrawal.Report(cdn, err)
+					time.Sleep(30*time.Second + time.Duration(fastrand.Intn(151))*time.Second)
+				}
+			}()
+		}
+	}
+
 	<-done
 	if err != nil {
 		return fmt.Errorf("%v", err)
@@ -256,13 +322,54 @@ func initConfig() {
 }
 
 func initLog() {
-	logWay := "console"
-	if config.ParamsObj.John.Log.File != "" {
-		logWay = "file"
-	}
-	file, err := common.HomeExpand(config.ParamsObj.John.Log.File)
+	conf := config.ParamsObj.John.Log
+	file, err := common.HomeExpand(conf.File)
 	if err != nil {
 		log.Fatal("%v", err)
 	}
-	log.InitLog(logWay, file, config.ParamsObj.John.Log.Level, config.ParamsObj.John.Log.MaxDays, config.ParamsObj.John.Log.DisableColor, config.ParamsObj.John.Log.DisableTimestamp)
+	if err = log.SetRedactMode(conf.Redact); err != nil {
+		log.Fatal("%v", err)
+	}
+	if err = log.InitLog(log.Options{
+		Output:           conf.Output,
+		File:             file,
+		Level:            conf.Level,
+		MaxDays:          conf.MaxDays,
+		MaxSize:          conf.MaxSizeMiB << 20,
+		MaxBackups:       conf.MaxBackups,
+		Compress:         conf.Compress,
+		DisableColor:     conf.DisableColor,
+		DisableTimestamp: conf.DisableTimestamp,
+		Format:           conf.Format,
+		Syslog:           conf.Syslog,
+		Modules:          conf.Modules,
+		RingSize:         conf.RingSize,
+	}); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// reloadLogLevels re-reads the config file and applies the log levels on SIGHUP.
+func reloadLogLevels() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := v.ReadInConfig(); err != nil {
+			log.Warn("Failed to reload log levels: %v", err)
+			continue
+		}
+		var conf config.Log
+		if err := v.UnmarshalKey("john.log", &conf); err != nil {
+			log.Warn("Failed to reload log levels: %v", err)
+			continue
+		}
+		if err := log.SetModuleLevels(conf.Modules); err != nil {
+			log.Warn("Failed to reload log levels: %v", err)
+			continue
+		}
+		log.SetLogLevel(conf.Level)
+		config.ParamsObj.John.Log.Level = conf.Level
+		config.ParamsObj.John.Log.Modules = conf.Modules
+		log.Alert("Reloaded log levels: %v, modules: %v", conf.Level, conf.Modules)
+	}
 }
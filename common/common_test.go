@@ -58,3 +58,21 @@ func TestStarMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestRegistrableDomain(t *testing.T) {
+	tt := [][2]string{
+		{"lisa.example.com", "example.com"},
+		{"lisa.example.co.uk", "example.co.uk"},
+		{"a.b.example.com.au.", "example.com.au"},
+		{"Example.CO.JP", "example.co.jp"},
+		{"lisa.example.unknowntld", "example.unknowntld"},
+		{"co.uk", ""},
+		{"com", ""},
+	}
+	for _, test := range tt {
+		got, err := RegistrableDomain(test[0])
+		if got != test[1] || (test[1] == "") != (err != nil) {
+			t.Errorf("%v: got %v, err %v, want %v", test[0], got, err, test[1])
+		}
+	}
+}
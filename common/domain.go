@@ -1,6 +1,10 @@
 package common
 
-import "path"
+import (
+	"fmt"
+	"path"
+	"strings"
+)
 
 // mTopDomains is from https://publicsuffix.org/list/public_suffix_list.dat
 var mTopDomains = map[string]struct{}{
@@ -1501,7 +1505,232 @@ var mTopDomains = map[string]struct{}{
 	".zuerich":            {},
 }
 
+// mMultiLabelSuffixes are the common public suffixes with more than one label from the same list.
+var mMultiLabelSuffixes = map[string]struct{}{
+	".ac.uk":     {},
+	".co.uk":     {},
+	".gov.uk":    {},
+	".ltd.uk":    {},
+	".me.uk":     {},
+	".net.uk":    {},
+	".nhs.uk":    {},
+	".org.uk":    {},
+	".plc.uk":    {},
+	".police.uk": {},
+	".sch.uk":    {},
+	".asn.au":    {},
+	".com.au":    {},
+	".edu.au":    {},
+	".gov.au":    {},
+	".id.au":     {},
+	".net.au":    {},
+	".org.au":    {},
+	".ac.jp":     {},
+	".ad.jp":     {},
+	".co.jp":     {},
+	".ed.jp":     {},
+	".go.jp":     {},
+	".gr.jp":     {},
+	".lg.jp":     {},
+	".ne.jp":     {},
+	".or.jp":     {},
+	".ac.nz":     {},
+	".co.nz":     {},
+	".geek.nz":   {},
+	".gen.nz":    {},
+	".govt.nz":   {},
+	".kiwi.nz":   {},
+	".maori.nz":  {},
+	".net.nz":    {},
+	".org.nz":    {},
+	".school.nz": {},
+	".ac.cn":     {},
+	".com.cn":    {},
+	".edu.cn":    {},
+	".gov.cn":    {},
+	".net.cn":    {},
+	".org.cn":    {},
+	".com.hk":    {},
+	".edu.hk":    {},
+	".gov.hk":    {},
+	".idv.hk":    {},
+	".net.hk":    {},
+	".org.hk":    {},
+	".com.tw":    {},
+	".edu.tw":    {},
+	".gov.tw":    {},
+	".idv.tw":    {},
+	".net.tw":    {},
+	".org.tw":    {},
+	".com.mo":    {},
+	".edu.mo":    {},
+	".gov.mo":    {},
+	".net.mo":    {},
+	".org.mo":    {},
+	".ac.kr":     {},
+	".co.kr":     {},
+	".go.kr":     {},
+	".ne.kr":     {},
+	".or.kr":     {},
+	".re.kr":     {},
+	".com.sg":    {},
+	".edu.sg":    {},
+	".gov.sg":    {},
+	".net.sg":    {},
+	".org.sg":    {},
+	".com.my":    {},
+	".edu.my":    {},
+	".gov.my":    {},
+	".net.my":    {},
+	".org.my":    {},
+	".ac.id":     {},
+	".co.id":     {},
+	".go.id":     {},
+	".my.id":     {},
+	".net.id":    {},
+	".or.id":     {},
+	".web.id":    {},
+	".com.ph":    {},
+	".edu.ph":    {},
+	".gov.ph":    {},
+	".net.ph":    {},
+	".org.ph":    {},
+	".com.vn":    {},
+	".edu.vn":    {},
+	".gov.vn":    {},
+	".net.vn":    {},
+	".org.vn":    {},
+	".ac.th":     {},
+	".co.th":     {},
+	".go.th":     {},
+	".in.th":     {},
+	".net.th":    {},
+	".or.th":     {},
+	".ac.in":     {},
+	".co.in":     {},
+	".edu.in":    {},
+	".firm.in":   {},
+	".gen.in":    {},
+	".gov.in":    {},
+	".ind.in":    {},
+	".net.in":    {},
+	".org.in":    {},
+	".com.pk":    {},
+	".edu.pk":    {},
+	".gov.pk":    {},
+	".net.pk":    {},
+	".org.pk":    {},
+	".ac.il":     {},
+	".co.il":     {},
+	".gov.il":    {},
+	".net.il":    {},
+	".org.il":    {},
+	".com.tr":    {},
+	".edu.tr":    {},
+	".gen.tr":    {},
+	".gov.tr":    {},
+	".net.tr":    {},
+	".org.tr":    {},
+	".com.sa":    {},
+	".edu.sa":    {},
+	".gov.sa":    {},
+	".net.sa":    {},
+	".org.sa":    {},
+	".com.eg":    {},
+	".edu.eg":    {},
+	".gov.eg":    {},
+	".net.eg":    {},
+	".org.eg":    {},
+	".ac.za":     {},
+	".co.za":     {},
+	".gov.za":    {},
+	".net.za":    {},
+	".org.za":    {},
+	".web.za":    {},
+	".co.ke":     {},
+	".or.ke":     {},
+	".go.ke":     {},
+	".ne.ke":     {},
+	".com.ng":    {},
+	".edu.ng":    {},
+	".gov.ng":    {},
+	".net.ng":    {},
+	".org.ng":    {},
+	".com.br":    {},
+	".edu.br":    {},
+	".gov.br":    {},
+	".net.br":    {},
+	".org.br":    {},
+	".com.ar":    {},
+	".edu.ar":    {},
+	".gob.ar":    {},
+	".net.ar":    {},
+	".org.ar":    {},
+	".com.mx":    {},
+	".edu.mx":    {},
+	".gob.mx":    {},
+	".net.mx":    {},
+	".org.mx":    {},
+	".com.co":    {},
+	".edu.co":    {},
+	".gov.co":    {},
+	".net.co":    {},
+	".org.co":    {},
+	".com.ua":    {},
+	".edu.ua":    {},
+	".gov.ua":    {},
+	".net.ua":    {},
+	".org.ua":    {},
+	".com.ru":    {},
+	".net.ru":    {},
+	".org.ru":    {},
+	".ac.at":     {},
+	".co.at":     {},
+	".gv.at":     {},
+	".or.at":     {},
+	".com.es":    {},
+	".edu.es":    {},
+	".gob.es":    {},
+	".nom.es":    {},
+	".org.es":    {},
+	".com.pl":    {},
+	".net.pl":    {},
+	".org.pl":    {},
+	".com.pt":    {},
+	".edu.pt":    {},
+	".gov.pt":    {},
+	".org.pt":    {},
+}
+
 func HasTopDomain(domain string) bool {
 	_, ok := mTopDomains[path.Ext(domain)]
 	return ok
 }
+
+// PublicSuffix returns the longest known public suffix of the domain. The last label is taken if none is known.
+func PublicSuffix(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	labels := strings.Split(domain, ".")
+	for i := range labels {
+		suffix := "." + strings.Join(labels[i:], ".")
+		if _, ok := mMultiLabelSuffixes[suffix]; ok {
+			return suffix[1:]
+		}
+		if _, ok := mTopDomains[suffix]; ok {
+			return suffix[1:]
+		}
+	}
+	return labels[len(labels)-1]
+}
+
+// RegistrableDomain returns the public suffix of the domain plus one more label, such as "example.co.uk" for
+// "lisa.example.co.uk".
+func RegistrableDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	suffix := PublicSuffix(domain)
+	if domain == suffix || !strings.HasSuffix(domain, "."+suffix) {
+		return "", fmt.Errorf("%v is a public suffix", domain)
+	}
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	return rest[strings.LastIndex(rest, ".")+1:] + "." + suffix, nil
+}
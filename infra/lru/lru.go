@@ -63,6 +63,12 @@ func (l *LRU) GetKeys() (keys []interface{}) {
 	return keys
 }
 
+func (l *LRU) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.index)
+}
+
 func (l *LRU) get(key interface{}) (value interface{}) {
 	v, ok := l.index[key]
 	if !ok {
@@ -2,10 +2,16 @@ package cdn_validator
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
 	"net"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -26,9 +32,17 @@ type cdnNet struct {
 
 var validatorMapping = make(map[string]Creator)
 
-var cdnNets []cdnNet
+var (
+	cdnNets   []cdnNet
+	muCDNNets sync.RWMutex
+
+	// Resolver resolves the domains to validate.
+	Resolver = net.DefaultResolver
+)
 
 func CreatorByIP(ip net.IP) (string, Creator) {
+	muCDNNets.RLock()
+	defer muCDNNets.RUnlock()
 	for _, n := range cdnNets {
 		for _, c := range n.cidrs {
 			if c.Contains(ip) {
@@ -41,20 +55,163 @@ func CreatorByIP(ip net.IP) (string, Creator) {
 
 func Register(name string, creator Creator, cidrs []*net.IPNet) {
 	validatorMapping[name] = creator
+	muCDNNets.Lock()
 	cdnNets = append(cdnNets, cdnNet{
 		name:  name,
 		cidrs: cidrs,
 	})
+	muCDNNets.Unlock()
+}
+
+// ParseCIDRs parses CIDRs one per line. Empty lines and comments starting with "#" are ignored.
+func ParseCIDRs(text string) ([]*net.IPNet, error) {
+	var cidrs []string
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	return common.ToIPNets(cidrs)
+}
+
+// SetCIDRs replaces the CIDRs of the registered CDN.
+func SetCIDRs(name string, cidrs []*net.IPNet) error {
+	muCDNNets.Lock()
+	defer muCDNNets.Unlock()
+	for i := range cdnNets {
+		if cdnNets[i].name == name {
+			cdnNets[i].cidrs = cidrs
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown CDN: %v", name)
+}
+
+// LoadCIDRs replaces the CIDRs of the registered CDNs with the file, which is a JSON object from CDN names to CIDR
+// lists. CDNs absent in the file keep the embedded CIDRs.
+func LoadCIDRs(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var m map[string][]string
+	if err = json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%v: %w", file, err)
+	}
+	for name, cidrs := range m {
+		nets, err := common.ToIPNets(cidrs)
+		if err != nil {
+			return fmt.Errorf("%v: %v: %w", file, name, err)
+		}
+		if err = SetCIDRs(name, nets); err != nil {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// Result is the verdict of the last validation.
+type Result struct {
+	Domain string
+	CDN    string
+	Passed bool
+	// Reason is why the validation failed
+	Reason string `json:",omitempty"`
+	Time   time.Time
+	Cached bool
+}
+
+type cacheKey struct {
+	domain string
+	token  string
+}
+
+type verdict struct {
+	cdnName string
+	err     error
+	time    time.Time
+	expires time.Time
+}
+
+var (
+	// CacheTTL is the time to cache a passed validation. Failed ones are cached for at most FailureCacheTTL, and
+	// timeouts are not cached. Zero disables the cache.
+	CacheTTL        = 10 * time.Minute
+	FailureCacheTTL = time.Minute
+
+	cache      = make(map[cacheKey]verdict)
+	muCache    sync.Mutex
+	lastResult atomic.Pointer[Result]
+)
+
+// LastResult returns the verdict of the last validation. It is nil if no validation has run.
+func LastResult() *Result {
+	return lastResult.Load()
 }
 
+// ResetCache drops the cached verdicts.
+func ResetCache() {
+	muCache.Lock()
+	cache = make(map[cacheKey]verdict)
+	muCache.Unlock()
+}
+
+// Validate validates the CDN configuration of the domain, and returns the CDN names. Verdicts are cached for CacheTTL.
 func Validate(ctx context.Context, domain string, token string) (cdnName string, err error) {
+	key := cacheKey{domain: domain, token: token}
+	now := time.Now()
+	muCache.Lock()
+	v, ok := cache[key]
+	muCache.Unlock()
+	cached := ok && now.Before(v.expires)
+	if cached {
+		cdnName, err = v.cdnName, v.err
+	} else {
+		cdnName, err = validate(ctx, domain, token)
+		v = verdict{cdnName: cdnName, err: err, time: now}
+		switch {
+		case err == nil:
+			v.expires = now.Add(CacheTTL)
+		case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		default:
+			ttl := FailureCacheTTL
+			if ttl > CacheTTL {
+				ttl = CacheTTL
+			}
+			v.expires = now.Add(ttl)
+		}
+		muCache.Lock()
+		if v.expires.After(now) {
+			cache[key] = v
+		} else {
+			delete(cache, key)
+		}
+		muCache.Unlock()
+	}
+	result := &Result{Domain: domain, CDN: cdnName, Passed: err == nil, Time: v.time, Cached: cached}
+	if err != nil {
+		result.Reason = err.Error()
+	}
+	lastResult.Store(result)
+	return cdnName, err
+}
+
+func validate(ctx context.Context, domain string, token string) (cdnName string, err error) {
 	defer func() {
-		if err != nil {
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrCanStealIP), errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
 			err = fmt.Errorf("failed to validate cdn: %w", err)
+		default:
+			// the CDN configuration cannot be trusted
+			err = fmt.Errorf("%w cdn: %w", ErrFailedValidate, err)
 		}
 	}()
 
-	ips, err := net.LookupIP(domain)
+	ips, err := Resolver.LookupIP(ctx, "ip", domain)
 	if err != nil {
 		return "", err
 	}
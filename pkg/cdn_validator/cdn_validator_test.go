@@ -0,0 +1,120 @@
+package cdn_validator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs(`
+# comment
+192.0.2.0/24
+2001:db8::/32 # documentation
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 2 {
+		t.Fatalf("unexpected nets: %v", nets)
+	}
+	if _, err = ParseCIDRs("192.0.2.0/33"); err == nil {
+		t.Error("invalid CIDR is accepted")
+	}
+
+	defer func(nets []cdnNet) { cdnNets = nets }(cdnNets)
+	cdnNets = nil
+	Register("test", nil, nets)
+	if name, _ := CreatorByIP(net.ParseIP("192.0.2.1")); name != "test" {
+		t.Errorf("unexpected CDN of the embedded CIDRs: %v", name)
+	}
+
+	file := filepath.Join(t.TempDir(), "cidrs.json")
+	if err = os.WriteFile(file, []byte(`{"test": ["198.51.100.0/24"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = LoadCIDRs(file); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := CreatorByIP(net.ParseIP("192.0.2.1")); name != "" {
+		t.Errorf("the embedded CIDRs are not replaced: %v", name)
+	}
+	if name, _ := CreatorByIP(net.ParseIP("198.51.100.1")); name != "test" {
+		t.Errorf("unexpected CDN of the loaded CIDRs: %v", name)
+	}
+
+	if err = os.WriteFile(file, []byte(`{"unknown": ["198.51.100.0/24"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = LoadCIDRs(file); err == nil {
+		t.Error("unknown CDN is accepted")
+	}
+}
+
+// countingValidator counts the validations and returns err.
+type countingValidator struct {
+	n   int
+	ok  bool
+	err error
+}
+
+func (v *countingValidator) Validate(ctx context.Context, domain string) (bool, error) {
+	v.n++
+	return v.ok, v.err
+}
+
+func TestValidateCache(t *testing.T) {
+	defer func(nets []cdnNet) { cdnNets = nets }(cdnNets)
+	defer func(ttl time.Duration) { CacheTTL = ttl }(CacheTTL)
+	defer ResetCache()
+	v := &countingValidator{ok: true}
+	nets, _ := ParseCIDRs("192.0.2.0/24")
+	cdnNets = nil
+	Register("counting", func(token string) (CDNValidator, error) { return v, nil }, nets)
+
+	for i := 0; i < 3; i++ {
+		if _, err := Validate(context.Background(), "192.0.2.1", "token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v.n != 1 {
+		t.Errorf("the passed verdict is not cached: %v validations", v.n)
+	}
+	if r := LastResult(); r == nil || !r.Passed || !r.Cached || r.CDN != "counting" {
+		t.Errorf("unexpected result: %+v", r)
+	}
+
+	// a different token is validated again
+	v.ok = false
+	if _, err := Validate(context.Background(), "192.0.2.1", "another"); !errors.Is(err, ErrCanStealIP) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r := LastResult(); r.Passed || r.Cached || r.Reason == "" {
+		t.Errorf("unexpected result: %+v", r)
+	}
+
+	// timeouts are not cached
+	ResetCache()
+	v.n, v.err = 0, context.DeadlineExceeded
+	for i := 0; i < 2; i++ {
+		if _, err := Validate(context.Background(), "192.0.2.1", "token"); !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrFailedValidate) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if v.n != 2 {
+		t.Errorf("the timeout is cached: %v validations", v.n)
+	}
+
+	CacheTTL = 0
+	v.n, v.err, v.ok = 0, nil, true
+	for i := 0; i < 2; i++ {
+		_, _ = Validate(context.Background(), "192.0.2.1", "token")
+	}
+	if v.n != 2 {
+		t.Errorf("the cache is not disabled: %v validations", v.n)
+	}
+}
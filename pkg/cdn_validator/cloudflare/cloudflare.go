@@ -2,48 +2,55 @@ package cloudflare
 
 import (
 	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"net/http"
 	path2 "path"
+	"strconv"
 	"strings"
 	"time"
 )
 
-var CIDRs = []string{
-	"173.245.48.0/20",
-	"103.21.244.0/22",
-	"103.22.200.0/22",
-	"103.31.4.0/22",
-	"141.101.64.0/18",
-	"108.162.192.0/18",
-	"190.93.240.0/20",
-	"188.114.96.0/20",
-	"197.234.240.0/22",
-	"198.41.128.0/17",
-	"162.158.0.0/15",
-	"104.16.0.0/13",
-	"104.24.0.0/14",
-	"172.64.0.0/13",
-	"131.0.72.0/22",
-	"2400:cb00::/32",
-	"2606:4700::/32",
-	"2803:f800::/32",
-	"2405:b500::/32",
-	"2405:8100::/32",
-	"2a06:98c0::/29",
-	"2c0f:f248::/32",
-}
+// CIDRs are the IP ranges of Cloudflare, which can be replaced by cdn_validator.LoadCIDRs.
+//
+//go:embed cidrs.txt
+var CIDRs string
 
 func init() {
-	nets, _ := common.ToIPNets(CIDRs)
+	nets, err := cdn_validator.ParseCIDRs(CIDRs)
+	if err != nil {
+		panic(err)
+	}
 	cdn_validator.Register("cloudflare", New, nets)
 }
 
+const (
+	// PhaseDynamicRedirect is the phase of Single Redirect rules, which replace the forwarding URL of Page Rules.
+	PhaseDynamicRedirect = "http_request_dynamic_redirect"
+
+	// BlockPagePrefix is the prefix of the URLs visitors blocked are redirected to.
+	BlockPagePrefix = "https://e14914c0-6759-480d-be89-66b7b7676451.github.io/"
+)
+
+// LeakyPhases are the phases whose rules can leave records of visitors, such as security events with their IPs.
+var LeakyPhases = []string{
+	string(cloudflare.RulesetPhaseHTTPRequestFirewallCustom),
+	string(cloudflare.RulesetPhaseHTTPRequestFirewallManaged),
+	string(cloudflare.RulesetPhaseRateLimit),
+}
+
 func New(token string) (cdn_validator.CDNValidator, error) {
-	api, err := cloudflare.NewWithAPIToken(token)
+	return newWithOptions(token)
+}
+
+func newWithOptions(token string, opts ...cloudflare.Option) (cdn_validator.CDNValidator, error) {
+	api, err := cloudflare.NewWithAPIToken(token, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -82,7 +89,7 @@ func ValidPageRule(pageRule cloudflare.PageRule, hostname string, path string) b
 			return false
 		}
 		u = strings.ReplaceAll(u, `\/`, "/")
-		return strings.HasPrefix(u, "https://e14914c0-6759-480d-be89-66b7b7676451.github.io/")
+		return strings.HasPrefix(u, BlockPagePrefix)
 	}
 	return false
 }
@@ -90,8 +97,10 @@ func ValidPageRule(pageRule cloudflare.PageRule, hostname string, path string) b
 func validApiRule(r cloudflare.RulesetRule, hostname string) bool {
 	if r.Enabled == true &&
 		r.Action == "rewrite" &&
+		r.ActionParameters != nil && r.ActionParameters.URI != nil &&
+		r.ActionParameters.URI.Path != nil &&
 		r.ActionParameters.URI.Path.Value == "/block-cn" &&
-		r.ActionParameters.URI.Query.Value == "" &&
+		(r.ActionParameters.URI.Query == nil || r.ActionParameters.URI.Query.Value == "") &&
 		r.Expression == fmt.Sprintf("(ip.geoip.country eq \"CN\" and http.user_agent ne \"BitterJohn\" and http.host eq \"%v\")", hostname) {
 		return true
 	}
@@ -101,8 +110,10 @@ func validApiRule(r cloudflare.RulesetRule, hostname string) bool {
 func validHtmlRule(r cloudflare.RulesetRule, hostname string) bool {
 	if r.Enabled == true &&
 		r.Action == "rewrite" &&
+		r.ActionParameters != nil && r.ActionParameters.URI != nil &&
+		r.ActionParameters.URI.Path != nil &&
 		r.ActionParameters.URI.Path.Value == "/block-cn-html" &&
-		r.ActionParameters.URI.Query.Value == "" &&
+		(r.ActionParameters.URI.Query == nil || r.ActionParameters.URI.Query.Value == "") &&
 		r.Expression == fmt.Sprintf("(ip.geoip.country eq \"CN\" and http.user_agent ne \"BitterJohn\" and http.host eq \"%v\" and not http.request.uri.path contains \"/api/\")", hostname) {
 		return true
 	}
@@ -121,52 +132,165 @@ func ValidTransformRuleset(ruleset cloudflare.Ruleset, hostname string) bool {
 	return false
 }
 
+// RedirectRuleset is a ruleset of the dynamic redirect phase. RulesetRule of cloudflare-go does not have from_value yet.
+type RedirectRuleset struct {
+	Rules []RedirectRule `json:"rules"`
+}
+
+type RedirectRule struct {
+	Action           string `json:"action"`
+	Expression       string `json:"expression"`
+	Enabled          bool   `json:"enabled"`
+	ActionParameters *struct {
+		FromValue *struct {
+			StatusCode int `json:"status_code"`
+			TargetURL  struct {
+				Value      string `json:"value"`
+				Expression string `json:"expression"`
+			} `json:"target_url"`
+		} `json:"from_value"`
+	} `json:"action_parameters"`
+}
+
+// ValidRedirectRule returns if the Single Redirect rule is equivalent to the Page Rule that ValidPageRule accepts.
+func ValidRedirectRule(r RedirectRule, hostname string, path string) bool {
+	if !r.Enabled ||
+		r.Action != "redirect" ||
+		r.ActionParameters == nil || r.ActionParameters.FromValue == nil ||
+		r.ActionParameters.FromValue.TargetURL.Expression != "" {
+		return false
+	}
+	if r.Expression != fmt.Sprintf("(http.host eq \"%v\" and http.request.uri.path eq \"/%v\")", hostname, path) {
+		return false
+	}
+	return strings.HasPrefix(r.ActionParameters.FromValue.TargetURL.Value, BlockPagePrefix)
+}
+
+// unauthorized reports whether the error is for the token lacking permissions.
+func unauthorized(err error) bool {
+	var apiErr *cloudflare.APIRequestError
+	return errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden)
+}
+
+// raw gets the result of the endpoint as JSON like API.Raw, which does not take a context.
+func (c *Cloudflare) raw(ctx context.Context, endpoint string) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.api.BaseURL+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.api.APIToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r cloudflare.RawResponse
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%v: HTTP status %v: %w", endpoint, resp.StatusCode, err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, &cloudflare.APIRequestError{StatusCode: resp.StatusCode, Errors: r.Errors}
+	}
+	return r.Result, nil
+}
+
 func (c *Cloudflare) Validate(ctx context.Context, domain string) (bool, error) {
-	fields := strings.Split(domain, ".")
-	if len(fields) < 2 {
-		return false, fmt.Errorf("invalid domain: %v", domain)
+	zoneName, err := common.RegistrableDomain(domain)
+	if err != nil {
+		return false, err
 	}
-	zoneName := strings.Join(fields[len(fields)-2:], ".")
 	zoneID, err := c.api.ZoneIDByName(zoneName)
 	if err != nil {
-		return false, err
+		return false, fmt.Errorf("zone %v: %w", zoneName, err)
 	}
 	rules, err := c.api.FirewallRules(ctx, zoneID, cloudflare.PaginationOptions{})
 	if len(rules) > 0 {
-		return false, fmt.Errorf("sweetlisa's cloudflare firewall has rules, which can leave records of the visit")
+		return false, fmt.Errorf("%w: sweetlisa's cloudflare firewall has rules, which can leave records of the visit", cdn_validator.ErrCanStealIP)
+	}
+	jobs, err := c.api.LogpushJobs(ctx, zoneID)
+	if err != nil {
+		// listing logpush jobs needs the permission Logs:Read, which validation tokens made before lack
+		if !unauthorized(err) {
+			return false, fmt.Errorf("list logpush jobs: %w", err)
+		}
+		log.Warn("Skip checking logpush jobs of %v: the validation token needs the permission Logs:Read: %v", log.Host(zoneName), err)
+	}
+	for _, job := range jobs {
+		if job.Enabled {
+			return false, fmt.Errorf("%w: sweetlisa's cloudflare has the logpush job %v, which can push records of the visit", cdn_validator.ErrCanStealIP, strconv.Quote(job.Name))
+		}
 	}
 	var ok bool
+	// block-cn and block-cn-html
+	var redirected = [2]bool{false, false}
 	rulesets, err := c.api.ListZoneRulesets(ctx, zoneID)
 	if err != nil {
 		return false, err
 	}
 	for _, ruleset := range rulesets {
-		if ruleset.Phase != "http_request_transform" {
-			continue
-		}
-		ruleset, err := c.api.GetZoneRuleset(ctx, zoneID, ruleset.ID)
-		if err != nil {
-			continue
-		}
-		if ValidTransformRuleset(ruleset, domain) {
-			ok = true
-			break
+		switch {
+		case ruleset.Phase == string(cloudflare.RulesetPhaseHTTPRequestTransform):
+			if ok {
+				continue
+			}
+			ruleset, err := c.api.GetZoneRuleset(ctx, zoneID, ruleset.ID)
+			if err != nil {
+				continue
+			}
+			if ValidTransformRuleset(ruleset, domain) {
+				ok = true
+			}
+		case ruleset.Phase == PhaseDynamicRedirect:
+			raw, err := c.raw(ctx, fmt.Sprintf("/zones/%v/rulesets/%v", zoneID, ruleset.ID))
+			if err != nil {
+				return false, err
+			}
+			var redirectRules RedirectRuleset
+			if err = json.Unmarshal(raw, &redirectRules); err != nil {
+				return false, err
+			}
+			for _, r := range redirectRules.Rules {
+				if ValidRedirectRule(r, domain, "block-cn") {
+					redirected[0] = true
+				} else if ValidRedirectRule(r, domain, "block-cn-html") {
+					redirected[1] = true
+				}
+			}
+		case common.StringsHas(LeakyPhases, ruleset.Phase) && ruleset.Kind == string(cloudflare.RulesetKindZone):
+			// managed rulesets are listed as well but take effect only if deployed by the zone entrypoint
+			ruleset, err := c.api.GetZoneRuleset(ctx, zoneID, ruleset.ID)
+			if err != nil {
+				return false, err
+			}
+			for _, r := range ruleset.Rules {
+				if r.Enabled {
+					return false, fmt.Errorf("%w: sweetlisa's cloudflare has enabled rules in the phase %v, which can leave records of the visit", cdn_validator.ErrCanStealIP, ruleset.Phase)
+				}
+			}
 		}
 	}
 	if !ok {
-		return false, nil
+		return false, fmt.Errorf("%w: no transform rules rewriting visitors from CN to /block-cn and /block-cn-html", cdn_validator.ErrCanStealIP)
+	}
+	if redirected[0] && redirected[1] {
+		return true, nil
 	}
-	var okk = [2]bool{false, false}
+	// fall back to the deprecated Page Rules
 	pageRules, err := c.api.ListPageRules(ctx, zoneID)
 	if err != nil {
 		return false, err
 	}
 	for _, pageRule := range pageRules {
 		if ValidPageRule(pageRule, domain, "block-cn") {
-			okk[0] = true
+			redirected[0] = true
 		} else if ValidPageRule(pageRule, domain, "block-cn-html") {
-			okk[1] = true
+			redirected[1] = true
+		}
+	}
+	for i, path := range []string{"block-cn", "block-cn-html"} {
+		if !redirected[i] {
+			return false, fmt.Errorf("%w: no redirect rules or page rules redirecting %v to %v", cdn_validator.ErrCanStealIP, path2.Join(domain, path), BlockPagePrefix)
 		}
 	}
-	return okk[0] && okk[1], nil
+	return true, nil
 }
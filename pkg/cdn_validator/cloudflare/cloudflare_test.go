@@ -0,0 +1,176 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator"
+)
+
+const (
+	testDomain = "lisa.example.com"
+	testZoneID = "023e105f4ecef8ad9ca31a8372d0c353"
+)
+
+// apiStandIn serves the recorded responses of the Cloudflare API in testdata by the request path. A file named with
+// a status code and an underscore, such as 403_forbidden.json, is served with the status.
+type apiStandIn struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses map[string]string
+	requested map[string]bool
+}
+
+func newAPIStandIn(t *testing.T, overrides map[string]string) *apiStandIn {
+	s := &apiStandIn{
+		responses: map[string]string{
+			"/user/tokens/verify": "verify.json",
+			"/zones":              "zones.json",
+			"/zones/" + testZoneID + "/firewall/rules":                            "empty_list.json",
+			"/zones/" + testZoneID + "/logpush/jobs":                              "empty_list.json",
+			"/zones/" + testZoneID + "/rulesets":                                  "rulesets.json",
+			"/zones/" + testZoneID + "/rulesets/4814384a9e5d4991b9815dcfc25d2f1f": "ruleset_firewall_custom.json",
+			"/zones/" + testZoneID + "/rulesets/67013aa153df4e98ae7d4e6b3b2bbd8a": "ruleset_transform.json",
+			"/zones/" + testZoneID + "/rulesets/9b2d5a8ea1af42e5a7a9f07d5db4b0a5": "ruleset_redirect.json",
+			"/zones/" + testZoneID + "/pagerules":                                 "pagerules.json",
+		},
+		requested: make(map[string]bool),
+	}
+	for path, file := range overrides {
+		s.responses[path] = file
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requested[r.URL.Path] = true
+		file, ok := s.responses[r.URL.Path]
+		s.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"success":false,"errors":[{"code":7003,"message":"Could not route to ` + r.URL.Path + `"}],"messages":[],"result":null}`))
+			return
+		}
+		b, err := os.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if code, err := strconv.Atoi(strings.SplitN(file, "_", 2)[0]); err == nil {
+			w.WriteHeader(code)
+		}
+		_, _ = w.Write(b)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *apiStandIn) wasRequested(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requested[path]
+}
+
+func validate(t *testing.T, s *apiStandIn) (bool, error) {
+	t.Helper()
+	v, err := newWithOptions("token", cloudflare.BaseURL(s.URL), cloudflare.UsingRateLimit(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.Validate(context.Background(), testDomain)
+}
+
+func TestValidateRedirectRules(t *testing.T) {
+	s := newAPIStandIn(t, nil)
+	ok, err := validate(t, s)
+	if err != nil || !ok {
+		t.Fatalf("ok: %v, err: %v", ok, err)
+	}
+	if s.wasRequested("/zones/" + testZoneID + "/pagerules") {
+		t.Error("page rules are requested with valid redirect rules")
+	}
+	// managed rulesets are not deployed by the zone
+	if s.wasRequested("/zones/" + testZoneID + "/rulesets/efb7b8c949ac4650a09736fc376e9aee") {
+		t.Error("managed ruleset is requested")
+	}
+}
+
+func TestValidatePageRules(t *testing.T) {
+	s := newAPIStandIn(t, map[string]string{
+		"/zones/" + testZoneID + "/rulesets": "rulesets_without_redirect.json",
+	})
+	ok, err := validate(t, s)
+	if err != nil || !ok {
+		t.Fatalf("ok: %v, err: %v", ok, err)
+	}
+}
+
+func TestValidateRedirectElsewhere(t *testing.T) {
+	s := newAPIStandIn(t, map[string]string{
+		"/zones/" + testZoneID + "/rulesets/9b2d5a8ea1af42e5a7a9f07d5db4b0a5": "ruleset_redirect_elsewhere.json",
+		"/zones/" + testZoneID + "/pagerules":                                 "empty_list.json",
+	})
+	if ok, err := validate(t, s); ok || !errors.Is(err, cdn_validator.ErrCanStealIP) || !strings.Contains(err.Error(), "block-cn-html") {
+		t.Fatalf("ok: %v, err: %v", ok, err)
+	}
+}
+
+func TestValidateLeaks(t *testing.T) {
+	for name, overrides := range map[string]map[string]string{
+		"logpush": {
+			"/zones/" + testZoneID + "/logpush/jobs": "logpush_jobs_enabled.json",
+		},
+		"custom rules": {
+			"/zones/" + testZoneID + "/rulesets/4814384a9e5d4991b9815dcfc25d2f1f": "ruleset_firewall_custom_enabled.json",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newAPIStandIn(t, overrides)
+			ok, err := validate(t, s)
+			if ok || !errors.Is(err, cdn_validator.ErrCanStealIP) {
+				t.Fatalf("ok: %v, err: %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestValidateWithoutLogsPermission(t *testing.T) {
+	// tokens made before logpush jobs were checked lack the permission Logs:Read
+	s := newAPIStandIn(t, map[string]string{
+		"/zones/" + testZoneID + "/logpush/jobs": "403_forbidden.json",
+	})
+	ok, err := validate(t, s)
+	if err != nil || !ok {
+		t.Fatalf("ok: %v, err: %v", ok, err)
+	}
+
+	// other errors are not skipped
+	s = newAPIStandIn(t, map[string]string{
+		"/zones/" + testZoneID + "/rulesets/9b2d5a8ea1af42e5a7a9f07d5db4b0a5": "403_forbidden.json",
+	})
+	if ok, err := validate(t, s); ok || err == nil {
+		t.Fatalf("ok: %v, err: %v", ok, err)
+	}
+}
+
+func TestRawContext(t *testing.T) {
+	s := newAPIStandIn(t, nil)
+	v, err := newWithOptions("token", cloudflare.BaseURL(s.URL), cloudflare.UsingRateLimit(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := v.(*Cloudflare).raw(ctx, "/zones/"+testZoneID+"/rulesets/9b2d5a8ea1af42e5a7a9f07d5db4b0a5"); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error with the canceled context: %v", err)
+	}
+}
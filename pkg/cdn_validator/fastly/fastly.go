@@ -0,0 +1,171 @@
+package fastly
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator"
+)
+
+const (
+	DefaultBaseURL = "https://api.fastly.com"
+
+	// BlockPagePrefix is the prefix of the URLs visitors blocked are redirected to.
+	BlockPagePrefix = "https://e14914c0-6759-480d-be89-66b7b7676451.github.io/"
+)
+
+// CIDRs are the IP ranges of Fastly, which can be replaced by cdn_validator.LoadCIDRs.
+//
+//go:embed cidrs.txt
+var CIDRs string
+
+func init() {
+	nets, err := cdn_validator.ParseCIDRs(CIDRs)
+	if err != nil {
+		panic(err)
+	}
+	cdn_validator.Register("fastly", New, nets)
+}
+
+// BlockVCL returns the VCL snippet of vcl_recv that redirects visitors from CN to the block pages, which is the
+// counterpart of the transform rules and redirect rules required on Cloudflare.
+func BlockVCL(hostname string) string {
+	return fmt.Sprintf(`if (client.geo.country_code == "CN" && req.http.User-Agent != "BitterJohn" && req.http.host == "%v") {
+  if (req.url.path ~ "/api/") {
+    error 618 "%vblock-cn.json";
+  }
+  error 618 "%vblock-cn.html";
+}`, hostname, BlockPagePrefix, BlockPagePrefix)
+}
+
+// BlockErrorVCL is the VCL snippet of vcl_error that serves the redirects of BlockVCL.
+const BlockErrorVCL = `if (obj.status == 618) {
+  set obj.status = 302;
+  set obj.http.Location = obj.response;
+  return(deliver);
+}`
+
+var (
+	spaces = regexp.MustCompile(`\s+`)
+	// logStatement matches the log statements that logging endpoints of any type are compiled to.
+	logStatement = regexp.MustCompile(`(?m)^\s*log\s`)
+)
+
+func New(token string) (cdn_validator.CDNValidator, error) {
+	return newWithBaseURL(DefaultBaseURL, token)
+}
+
+func newWithBaseURL(baseURL string, token string) (cdn_validator.CDNValidator, error) {
+	f := &Fastly{baseURL: strings.TrimSuffix(baseURL, "/"), token: token}
+	ctx, cancel := context.WithTimeout(context.TODO(), 15*time.Second)
+	defer cancel()
+	var self struct {
+		ID string `json:"id"`
+	}
+	if err := f.get(ctx, "/tokens/self", &self); err != nil {
+		return nil, err
+	}
+	if self.ID == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return f, nil
+}
+
+type Fastly struct {
+	baseURL string
+	token   string
+}
+
+type service struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Versions []struct {
+		Number int  `json:"number"`
+		Active bool `json:"active"`
+	} `json:"versions"`
+}
+
+func (f *Fastly) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Fastly-Key", f.token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "BitterJohn")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("fastly responsed with %v: %v", strconv.Quote(resp.Status), string(b))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// activeService returns the service serving the domain and its active version.
+func (f *Fastly) activeService(ctx context.Context, domain string) (serviceID string, version int, err error) {
+	var services []service
+	if err = f.get(ctx, "/service", &services); err != nil {
+		return "", 0, err
+	}
+	for _, s := range services {
+		version = 0
+		for _, v := range s.Versions {
+			if v.Active {
+				version = v.Number
+			}
+		}
+		if version == 0 {
+			continue
+		}
+		var domains []struct {
+			Name string `json:"name"`
+		}
+		if err = f.get(ctx, fmt.Sprintf("/service/%v/version/%v/domain", s.ID, version), &domains); err != nil {
+			return "", 0, err
+		}
+		for _, d := range domains {
+			if strings.EqualFold(strings.TrimSuffix(d.Name, "."), domain) {
+				return s.ID, version, nil
+			}
+		}
+	}
+	return "", 0, fmt.Errorf("no active fastly service serves %v", domain)
+}
+
+func (f *Fastly) Validate(ctx context.Context, domain string) (bool, error) {
+	serviceID, version, err := f.activeService(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+	var vcl struct {
+		Content string `json:"content"`
+	}
+	if err = f.get(ctx, fmt.Sprintf("/service/%v/version/%v/generated_vcl", serviceID, version), &vcl); err != nil {
+		return false, err
+	}
+	if logStatement.MatchString(vcl.Content) {
+		return false, fmt.Errorf("%w: sweetlisa's fastly service has logging endpoints, which can leave records of the visit", cdn_validator.ErrCanStealIP)
+	}
+	content := spaces.ReplaceAllString(vcl.Content, " ")
+	for _, snippet := range []struct {
+		sub string
+		vcl string
+	}{{"vcl_recv", BlockVCL(domain)}, {"vcl_error", BlockErrorVCL}} {
+		if !strings.Contains(content, spaces.ReplaceAllString(snippet.vcl, " ")) {
+			return false, fmt.Errorf("%w: no %v snippet redirecting visitors from CN to the block pages", cdn_validator.ErrCanStealIP, snippet.sub)
+		}
+	}
+	return true, nil
+}
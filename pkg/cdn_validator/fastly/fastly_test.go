@@ -0,0 +1,99 @@
+package fastly
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator"
+)
+
+const testDomain = "lisa.example.com"
+
+// newAPIStandIn serves the recorded responses of the Fastly API in testdata by the request path.
+func newAPIStandIn(t *testing.T, overrides map[string]string) *httptest.Server {
+	responses := map[string]string{
+		"/tokens/self": "token_self.json",
+		"/service":     "services.json",
+		"/service/SU1Z0isxPaozGVKXdv0eY/version/2/domain":         "domains_other.json",
+		"/service/7i6HN3TK9wS159v2gPAZ8A/version/3/domain":        "domains.json",
+		"/service/7i6HN3TK9wS159v2gPAZ8A/version/3/generated_vcl": "generated_vcl.json",
+	}
+	for path, file := range overrides {
+		responses[path] = file
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Fastly-Key") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"msg":"Provided credentials are missing or invalid"}`))
+			return
+		}
+		file, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"msg":"Record not found","detail":"Cannot find service"}`))
+			return
+		}
+		b, err := os.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		overrides map[string]string
+		ok        bool
+		err       error
+	}{
+		{name: "blocked", ok: true},
+		{name: "unblocked", overrides: map[string]string{
+			"/service/7i6HN3TK9wS159v2gPAZ8A/version/3/generated_vcl": "generated_vcl_unblocked.json",
+		}, err: cdn_validator.ErrCanStealIP},
+		{name: "logging", overrides: map[string]string{
+			"/service/7i6HN3TK9wS159v2gPAZ8A/version/3/generated_vcl": "generated_vcl_logging.json",
+		}, err: cdn_validator.ErrCanStealIP},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := newAPIStandIn(t, c.overrides)
+			v, err := newWithBaseURL(s.URL, "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := v.Validate(context.Background(), testDomain)
+			if ok != c.ok || (c.err == nil && err != nil) || (c.err != nil && !errors.Is(err, c.err)) {
+				t.Errorf("ok: %v, err: %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestValidateUnknownDomain(t *testing.T) {
+	s := newAPIStandIn(t, nil)
+	v, err := newWithBaseURL(s.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := v.Validate(context.Background(), "other.example.com"); ok || err == nil {
+		t.Errorf("ok: %v, err: %v", ok, err)
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	s := newAPIStandIn(t, nil)
+	if _, err := newWithBaseURL(s.URL, "wrong"); err == nil {
+		t.Error("invalid token is accepted")
+	}
+}
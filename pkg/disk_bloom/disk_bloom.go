@@ -3,6 +3,8 @@ package disk_bloom
 import (
 	"github.com/mzz2017/disk-bloom"
 	"hash/fnv"
+	"sync"
+	"sync/atomic"
 )
 
 func doubleFNVFactory(salt []byte) func(b []byte) (uint64, uint64) {
@@ -24,8 +26,60 @@ const (
 	expectFPR = 1e-6
 )
 
+// Bloom is a group of bloom filters in the disk, which counts the entries added since it is opened.
+type Bloom struct {
+	*disk_bloom.FilterGroup
+	pattern string
+	added   atomic.Uint64
+}
+
+var (
+	blooms   []*Bloom
+	muBlooms sync.Mutex
+)
+
 // NewBloom returns a bloom filter in the disk.
 // The filenames are generated by taking pattern and adding a index to the end. the Pattern should includes a "*", and the index replaces the last "*".
-func NewBloom(pattern string, salt []byte) (*disk_bloom.FilterGroup, error) {
-	return disk_bloom.NewGroup(pattern, disk_bloom.FsyncModeEverySec, n, expectFPR, doubleFNVFactory(salt))
+func NewBloom(pattern string, salt []byte) (*Bloom, error) {
+	g, err := disk_bloom.NewGroup(pattern, disk_bloom.FsyncModeEverySec, n, expectFPR, doubleFNVFactory(salt))
+	if err != nil {
+		return nil, err
+	}
+	b := &Bloom{FilterGroup: g, pattern: pattern}
+	muBlooms.Lock()
+	blooms = append(blooms, b)
+	muBlooms.Unlock()
+	return b, nil
+}
+
+// Blooms returns the blooms opened by NewBloom.
+func Blooms() []*Bloom {
+	muBlooms.Lock()
+	defer muBlooms.Unlock()
+	return append([]*Bloom(nil), blooms...)
+}
+
+// ExistOrAdd returns whether the entry was in the filters, and adds it if it was not.
+func (b *Bloom) ExistOrAdd(entry []byte) (exist bool) {
+	exist = b.FilterGroup.ExistOrAdd(entry)
+	if !exist {
+		b.added.Add(1)
+	}
+	return exist
+}
+
+// Added counts the entries added through the FilterGroup directly, such as by the TCP connections of shadowsocks.
+func (b *Bloom) Added(entries int) {
+	b.added.Add(uint64(entries))
+}
+
+// Pattern returns the pattern of the filenames.
+func (b *Bloom) Pattern() string {
+	return b.pattern
+}
+
+// FillRatio returns the ratio of the entries added since the bloom was opened to the capacity of a filter, after
+// which a new filter file is created.
+func (b *Bloom) FillRatio() float64 {
+	return float64(b.added.Load()) / n
 }
@@ -0,0 +1,101 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+func init() {
+	logs.RegisterFormatter("message_line", &messageFormatter{})
+}
+
+// messageFormatter formats a message as it is in one line, without the level and the caller.
+type messageFormatter struct{}
+
+func (f *messageFormatter) Format(lm *logs.LogMsg) string {
+	msg := lm.Msg
+	if len(lm.Args) > 0 {
+		msg = fmt.Sprintf(lm.Msg, lm.Args...)
+	}
+	return msg + "\n"
+}
+
+// AccessLog writes one line per record to its own rotating file, apart from the diagnostic log.
+type AccessLog struct {
+	logger   *logs.BeeLogger
+	redactor *Redactor
+	format   string
+}
+
+// NewAccessLog opens an access log. Files older than maxDays are removed at the daily rotation.
+func NewAccessLog(file string, maxDays int64, redact string, format string) (*AccessLog, error) {
+	redactor, err := NewRedactor(redact)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatText, FormatJson:
+	case "":
+		format = FormatText
+	default:
+		return nil, fmt.Errorf("unknown log format: %v", format)
+	}
+	logger := logs.NewLogger(200)
+	// NewLogger has set a console logger
+	_ = logger.DelLogger("console")
+	b, _ := jsoniter.Marshal(map[string]interface{}{
+		"filename":  file,
+		"maxdays":   maxDays,
+		"daily":     true,
+		"rotate":    true,
+		"formatter": "message_line",
+	})
+	if err = logger.SetLogger("file", string(b)); err != nil {
+		return nil, fmt.Errorf("access log: %w", err)
+	}
+	return &AccessLog{
+		logger:   logger,
+		redactor: redactor,
+		format:   format,
+	}, nil
+}
+
+// Write writes the fields of the entry as a line, redacted by the redactor of the access log.
+func (l *AccessLog) Write(e *Entry) {
+	now := time.Now()
+	if l.format == FormatJson {
+		var buf bytes.Buffer
+		stream := jsoniter.ConfigDefault.BorrowStream(&buf)
+		defer jsoniter.ConfigDefault.ReturnStream(stream)
+		stream.WriteObjectStart()
+		stream.WriteObjectField("time")
+		stream.WriteString(now.Format(time.RFC3339Nano))
+		for _, f := range e.fields {
+			stream.WriteMore()
+			stream.WriteObjectField(f.Key)
+			stream.WriteVal(redactValue(l.redactor, f.Value))
+		}
+		stream.WriteObjectEnd()
+		_ = stream.Flush()
+		l.logger.Info("%v", buf.String())
+		return
+	}
+	var b strings.Builder
+	b.WriteString(now.Format(time.RFC3339Nano))
+	for _, f := range e.fields {
+		b.WriteString(" ")
+		b.WriteString(f.Key)
+		b.WriteString("=")
+		b.WriteString(fmt.Sprint(redactValue(l.redactor, f.Value)))
+	}
+	l.logger.Info("%v", b.String())
+}
+
+func (l *AccessLog) Close() {
+	l.logger.Close()
+}
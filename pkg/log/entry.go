@@ -0,0 +1,215 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+type field struct {
+	Key   string
+	Value interface{}
+}
+
+// Entry is a logger carrying structured fields.
+type Entry struct {
+	fields []field
+}
+
+// With returns a logger carrying the field.
+func With(key string, value interface{}) *Entry {
+	return (&Entry{}).With(key, value)
+}
+
+// With returns a copy of the logger carrying the field additionally.
+func (e *Entry) With(key string, value interface{}) *Entry {
+	fields := make([]field, 0, len(e.fields)+1)
+	for _, f := range e.fields {
+		if f.Key != key {
+			fields = append(fields, f)
+		}
+	}
+	return &Entry{fields: append(fields, field{Key: key, Value: value})}
+}
+
+// WithError returns a copy of the logger carrying the class of the error.
+func (e *Entry) WithError(err error) *Entry {
+	if err == nil {
+		return e
+	}
+	return e.With("error_class", ErrorClass(err))
+}
+
+func (e *Entry) record(format string, v []interface{}) *record {
+	return &record{fields: e.fields, format: format, args: v}
+}
+
+func (e *Entry) Alert(format string, v ...interface{}) {
+	if !enabled(logs.LevelAlert) {
+		return
+	}
+	Log.Alert("%v", e.record(format, v))
+}
+
+func (e *Entry) Error(format string, v ...interface{}) {
+	if !enabled(logs.LevelError) {
+		return
+	}
+	Log.Error("%v", e.record(format, v))
+}
+
+func (e *Entry) Warn(format string, v ...interface{}) {
+	if !enabled(logs.LevelWarning) {
+		return
+	}
+	Log.Warn("%v", e.record(format, v))
+}
+
+func (e *Entry) Info(format string, v ...interface{}) {
+	if !enabled(logs.LevelInformational) {
+		return
+	}
+	Log.Info("%v", e.record(format, v))
+}
+
+func (e *Entry) Debug(format string, v ...interface{}) {
+	if !enabled(logs.LevelDebug) {
+		return
+	}
+	Log.Debug("%v", e.record(format, v))
+}
+
+func (e *Entry) Trace(format string, v ...interface{}) {
+	if !enabled(logs.LevelTrace) {
+		return
+	}
+	Log.Trace("%v", e.record(format, v))
+}
+
+// record is a message with fields. It is formatted lazily since the level may filter it out.
+type record struct {
+	fields []field
+	format string
+	args   []interface{}
+}
+
+// Message formats the message and redacts the values carried by fields and IPs in it.
+func (r *record) Message() string {
+	msg := r.format
+	if len(r.args) > 0 {
+		msg = fmt.Sprintf(r.format, r.args...)
+	}
+	redactor := DefaultRedactor()
+	if redactor.Mode() == RedactFull {
+		return msg
+	}
+	for _, f := range r.fields {
+		s, ok := f.Value.(Sensitive)
+		if !ok {
+			continue
+		}
+		// short values are too likely to collide with normal words
+		if id := s.identifier(); len(id) >= 4 {
+			msg = strings.ReplaceAll(msg, id, s.redactIdentifier(redactor))
+		}
+	}
+	return redactor.Scrub(msg)
+}
+
+// fieldValue returns the value of the field to output.
+func fieldValue(v interface{}) interface{} {
+	return redactValue(DefaultRedactor(), v)
+}
+
+func redactValue(r *Redactor, v interface{}) interface{} {
+	switch v := v.(type) {
+	case Sensitive:
+		return v.Redact(r)
+	case string:
+		return r.Scrub(v)
+	default:
+		return v
+	}
+}
+
+func (r *record) has(key string) bool {
+	for _, f := range r.fields {
+		if f.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the record in the text format, such as "msg conn_id=1 protocol=vmess".
+func (r *record) String() string {
+	var b strings.Builder
+	b.WriteString(r.Message())
+	for _, f := range r.fields {
+		b.WriteString(" ")
+		b.WriteString(f.Key)
+		b.WriteString("=")
+		b.WriteString(fmt.Sprint(fieldValue(f.Value)))
+	}
+	return b.String()
+}
+
+var (
+	errorClasses   []errorClass
+	muErrorClasses sync.RWMutex
+)
+
+type errorClass struct {
+	err   error
+	class string
+}
+
+// RegisterErrorClass makes errors wrapping err classified as class.
+func RegisterErrorClass(err error, class string) {
+	muErrorClasses.Lock()
+	defer muErrorClasses.Unlock()
+	errorClasses = append(errorClasses, errorClass{err: err, class: class})
+}
+
+// ErrorClass returns a short and stable class of the error for filtering and aggregation.
+func ErrorClass(err error) string {
+	muErrorClasses.RLock()
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			muErrorClasses.RUnlock()
+			return c.class
+		}
+	}
+	muErrorClasses.RUnlock()
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	return "other"
+}
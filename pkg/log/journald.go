@@ -0,0 +1,133 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+// AdapterJournald is an adapter sending messages to journald with the native protocol.
+const AdapterJournald = "journald"
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+func init() {
+	logs.Register(AdapterJournald, func() logs.Logger {
+		return &journaldWriter{
+			Socket:     journaldSocket,
+			Identifier: filepath.Base(os.Args[0]),
+		}
+	})
+}
+
+// journaldWriter sends messages to journald. Fields of records are sent as journal fields,
+// such as CONN_ID and PROTOCOL, so that they can be filtered by journalctl.
+type journaldWriter struct {
+	Socket     string `json:"socket"`
+	Identifier string `json:"identifier"`
+
+	conn *net.UnixConn
+}
+
+func (w *journaldWriter) Init(config string) error {
+	if err := json.Unmarshal([]byte(config), w); err != nil {
+		return err
+	}
+	if _, err := os.Stat(w.Socket); err != nil {
+		return fmt.Errorf("journald is unavailable: %w", err)
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: w.Socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// syslogPriority maps the level of beego logs to the priority of syslog.
+func syslogPriority(level int) int {
+	switch {
+	case level < logs.LevelEmergency:
+		return logs.LevelEmergency
+	case level > logs.LevelDebug:
+		// trace
+		return logs.LevelDebug
+	default:
+		// they are the same as the priorities of syslog
+		return level
+	}
+}
+
+func (w *journaldWriter) WriteMsg(lm *logs.LogMsg) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(syslogPriority(lm.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", w.Identifier)
+	writeJournalField(&b, "CODE_FILE", filepath.Base(lm.FilePath))
+	writeJournalField(&b, "CODE_LINE", strconv.Itoa(lm.LineNumber))
+	if r, ok := asRecord(lm); ok {
+		writeJournalField(&b, "MESSAGE", r.Message())
+		if !r.has("component") {
+			writeJournalField(&b, "COMPONENT", Component(lm.FilePath))
+		}
+		for _, f := range r.fields {
+			writeJournalField(&b, journalKey(f.Key), fmt.Sprint(fieldValue(f.Value)))
+		}
+	} else {
+		msg := lm.Msg
+		if len(lm.Args) > 0 {
+			msg = fmt.Sprintf(lm.Msg, lm.Args...)
+		}
+		writeJournalField(&b, "MESSAGE", DefaultRedactor().Scrub(msg))
+		writeJournalField(&b, "COMPONENT", Component(lm.FilePath))
+	}
+	_, err := w.conn.Write(b.Bytes())
+	return err
+}
+
+// journalKey converts a key to a valid journal field name, which consists of uppercase letters, digits and
+// underscores, and does not start with an underscore or a digit.
+func journalKey(key string) string {
+	k := []byte(strings.ToUpper(key))
+	for i, c := range k {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			k[i] = '_'
+		}
+	}
+	s := strings.TrimLeft(string(k), "_0123456789")
+	if s == "" {
+		return "FIELD"
+	}
+	return s
+}
+
+func writeJournalField(b *bytes.Buffer, key string, value string) {
+	b.WriteString(key)
+	if strings.ContainsRune(value, '\n') {
+		// the binary-safe form: the key, a newline, the little-endian 64-bit length and the value
+		b.WriteByte('\n')
+		_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	} else {
+		b.WriteByte('=')
+	}
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// SetFormatter does nothing since journald records messages in fields.
+func (w *journaldWriter) SetFormatter(f logs.LogFormatter) {}
+
+func (w *journaldWriter) Destroy() {
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+}
+
+func (w *journaldWriter) Flush() {}
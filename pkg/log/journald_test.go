@@ -0,0 +1,124 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+func TestJournaldWriter(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	w := &journaldWriter{}
+	if err = w.Init(`{"socket": "` + socket + `", "identifier": "BitterJohn"}`); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Destroy()
+	r := &record{
+		fields: []field{{Key: "conn_id", Value: uint64(7)}, {Key: "protocol", Value: "vmess"}},
+		format: "relay error: %v",
+		args:   []interface{}{"line1\nline2"},
+	}
+	if err = w.WriteMsg(&logs.LogMsg{Level: logs.LevelTrace, Msg: "%v", Args: []interface{}{r}, When: time.Now(), FilePath: "/src/server/vmess/tcp.go", LineNumber: 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	_ = journal.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := journal.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagram := buf[:n]
+	for _, want := range []string{
+		"PRIORITY=7\n",
+		"SYSLOG_IDENTIFIER=BitterJohn\n",
+		"CODE_FILE=tcp.go\n",
+		"CODE_LINE=42\n",
+		"COMPONENT=vmess\n",
+		"CONN_ID=7\n",
+		"PROTOCOL=vmess\n",
+	} {
+		if !bytes.Contains(datagram, []byte(want)) {
+			t.Errorf("%q is missing in %q", want, datagram)
+		}
+	}
+	msg := "relay error: line1\nline2"
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len(msg)))
+	if !bytes.Contains(datagram, append(append([]byte("MESSAGE\n"), length[:]...), msg...)) {
+		t.Errorf("the multi-line message is not in the binary-safe form: %q", datagram)
+	}
+}
+
+func TestJournalKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"conn_id":     "CONN_ID",
+		"error_class": "ERROR_CLASS",
+		"a-b.c":       "A_B_C",
+		"_hidden":     "HIDDEN",
+		"1st":         "ST",
+	} {
+		if got := journalKey(key); got != want {
+			t.Errorf("journalKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestSyslogWriter(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	w := &syslogWriter{Tag: "BitterJohn"}
+	if err = w.Init(`{"address": "udp://` + collector.LocalAddr().String() + `"}`); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Destroy()
+	if err = w.WriteMsg(&logs.LogMsg{Level: logs.LevelWarning, Msg: "%v", Args: []interface{}{&record{format: "hello"}}, When: time.Now(), FilePath: "/src/server/server.go", LineNumber: 1}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	_ = collector.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// facility daemon (3) * 8 + priority warning (4)
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<28>") || !strings.Contains(msg, "BitterJohn") || !strings.HasSuffix(strings.TrimSpace(msg), "[server.go:1] hello") {
+		t.Errorf("unexpected syslog message: %q", msg)
+	}
+}
+
+func TestParseSyslogAddress(t *testing.T) {
+	for address, want := range map[string][2]string{
+		"":                         {"", ""},
+		"unix:///dev/log":          {"unixgram", "/dev/log"},
+		"udp://127.0.0.1":          {"udp", "127.0.0.1:514"},
+		"udp://collector.lan:5514": {"udp", "collector.lan:5514"},
+	} {
+		network, raddr, err := ParseSyslogAddress(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if network != want[0] || raddr != want[1] {
+			t.Errorf("ParseSyslogAddress(%q) = %v, %v, want %v", address, network, raddr, want)
+		}
+	}
+	if _, _, err := ParseSyslogAddress("http://127.0.0.1"); err == nil {
+		t.Error("unsupported scheme should be rejected")
+	}
+}
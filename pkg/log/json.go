@@ -0,0 +1,96 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+var levelNames = [...]string{"emergency", "alert", "critical", "error", "warn", "notice", "info", "debug", "trace"}
+
+func init() {
+	logs.RegisterFormatter("json", &jsonFormatter{})
+	logs.RegisterFormatter("json_line", &jsonFormatter{newline: true})
+}
+
+// jsonFormatter formats a message as a JSON object in one line.
+// The console writer appends the newline by itself but the file writer does not.
+type jsonFormatter struct {
+	newline bool
+}
+
+func (f *jsonFormatter) Format(lm *logs.LogMsg) string {
+	var buf bytes.Buffer
+	stream := jsoniter.ConfigDefault.BorrowStream(&buf)
+	defer jsoniter.ConfigDefault.ReturnStream(stream)
+
+	var level string
+	if lm.Level >= 0 && lm.Level < len(levelNames) {
+		level = levelNames[lm.Level]
+	}
+	stream.WriteObjectStart()
+	stream.WriteObjectField("time")
+	stream.WriteString(lm.When.Format(time.RFC3339Nano))
+	stream.WriteMore()
+	stream.WriteObjectField("level")
+	stream.WriteString(level)
+	stream.WriteMore()
+	stream.WriteObjectField("caller")
+	stream.WriteString(fmt.Sprintf("%v:%v", filepath.Base(lm.FilePath), lm.LineNumber))
+	r, ok := asRecord(lm)
+	if !ok || !r.has("component") {
+		stream.WriteMore()
+		stream.WriteObjectField("component")
+		stream.WriteString(Component(lm.FilePath))
+	}
+	if ok {
+		stream.WriteMore()
+		stream.WriteObjectField("msg")
+		stream.WriteString(r.Message())
+		for _, field := range r.fields {
+			stream.WriteMore()
+			stream.WriteObjectField(field.Key)
+			stream.WriteVal(fieldValue(field.Value))
+		}
+	} else {
+		msg := lm.Msg
+		if len(lm.Args) > 0 {
+			msg = fmt.Sprintf(lm.Msg, lm.Args...)
+		}
+		msg = DefaultRedactor().Scrub(msg)
+		stream.WriteMore()
+		stream.WriteObjectField("msg")
+		stream.WriteString(msg)
+	}
+	stream.WriteObjectEnd()
+	if f.newline {
+		stream.WriteRaw("\n")
+	}
+	_ = stream.Flush()
+	return buf.String()
+}
+
+func asRecord(lm *logs.LogMsg) (*record, bool) {
+	if lm.Msg != "%v" || len(lm.Args) != 1 {
+		return nil, false
+	}
+	r, ok := lm.Args[0].(*record)
+	return r, ok
+}
+
+// Component returns the component a source file belongs to, which is the name of its directory.
+func Component(filePath string) string {
+	if filePath == "" {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(filePath))
+}
@@ -16,9 +16,10 @@ package log
 
 import (
 	"fmt"
-	jsoniter "github.com/json-iterator/go"
 	"os"
 
+	jsoniter "github.com/json-iterator/go"
+
 	"github.com/v2rayA/beego/v2/logs"
 )
 
@@ -28,30 +29,110 @@ var Log *logs.BeeLogger
 func init() {
 	Log = logs.NewLogger(200)
 	Log.EnableFuncCallDepth(true)
-	Log.SetLogFuncCallDepth(Log.GetLogFuncCallDepth() + 1)
 }
 
-func InitLog(logWay string, logFile string, logLevel string, maxdays int64, disableLogColor bool, disableTimestamp bool) {
-	SetLogFile(logWay, logFile, maxdays, disableLogColor, disableTimestamp)
-	SetLogLevel(logLevel)
+const (
+	OutputConsole  = "console"
+	OutputFile     = "file"
+	OutputJournald = "journald"
+	OutputSyslog   = "syslog"
+)
+
+// Options configures the diagnostic log.
+type Options struct {
+	// Output is console, file, journald or syslog. Empty means file if File is set, or console.
+	Output string
+	File   string
+	Level  string
+	// MaxDays is the number of days to keep log files
+	MaxDays int64
+	// MaxSize is the size in bytes of the log file before it is rotated. Zero means rotating daily.
+	MaxSize int64
+	// MaxBackups is the number of rotated log files to keep when MaxSize is set
+	MaxBackups int
+	// Compress compresses rotated log files with gzip when MaxSize is set
+	Compress         bool
+	DisableColor     bool
+	DisableTimestamp bool
+	// Format is text or json
+	Format string
+	// Syslog is the address of the syslog sink, such as unix:///dev/log or udp://127.0.0.1:514
+	Syslog string
+	// Modules are log levels of modules overriding Level
+	Modules map[string]string
+	// RingSize is the number of recent entries kept in memory. Zero means disabled.
+	RingSize int
+}
+
+func InitLog(opts Options) error {
+	if err := SetLogFile(opts); err != nil {
+		return err
+	}
+	if opts.RingSize > 0 {
+		b, _ := jsoniter.Marshal(map[string]interface{}{"size": opts.RingSize})
+		_ = Log.DelLogger(AdapterRing)
+		if err := Log.SetLogger(AdapterRing, string(b)); err != nil {
+			return err
+		}
+	}
+	SetLogLevel(opts.Level)
+	return SetModuleLevels(opts.Modules)
 }
 
 // SetLogFile to configure log params
-// logWay: file or console
-func SetLogFile(logWay string, logFile string, maxdays int64, disableLogColor bool, disableTimestamp bool) {
-	if logWay == "console" {
-		params := ""
-		b, _ := jsoniter.Marshal(map[string]interface{}{
-			"color":     !disableLogColor,
-			"timestamp": !disableTimestamp,
-		})
-		params = string(b)
-		Log.SetLogger("console", params)
-	} else {
-		params := fmt.Sprintf(`{"filename": "%s", "maxdays": %d}`, logFile, maxdays)
-		Log.SetLogger("file", params)
+func SetLogFile(opts Options) error {
+	output := opts.Output
+	if output == "" {
+		output = OutputConsole
+		if opts.File != "" {
+			output = OutputFile
+		}
 	}
+	var (
+		adapter string
+		params  = map[string]interface{}{}
+	)
+	switch output {
+	case OutputConsole:
+		adapter = logs.AdapterConsole
+		params["color"] = !opts.DisableColor
+		params["timestamp"] = !opts.DisableTimestamp
+		if opts.Format == FormatJson {
+			params["formatter"] = "json"
+		}
+	case OutputFile:
+		if opts.File == "" {
+			return fmt.Errorf("the log file is required for the file output")
+		}
+		adapter = logs.AdapterFile
+		params["filename"] = opts.File
+		params["maxdays"] = opts.MaxDays
+		if opts.MaxSize > 0 {
+			adapter = AdapterRotatingFile
+			params["maxsize"] = opts.MaxSize
+			params["maxbackups"] = opts.MaxBackups
+			params["compress"] = opts.Compress
+		}
+		if opts.Format == FormatJson {
+			params["formatter"] = "json_line"
+		}
+	case OutputJournald:
+		adapter = AdapterJournald
+	case OutputSyslog:
+		adapter = AdapterSyslog
+		params["address"] = opts.Syslog
+		if opts.Format == FormatJson {
+			params["formatter"] = "json"
+		}
+	default:
+		return fmt.Errorf("unknown log output: %v", output)
+	}
+	b, _ := jsoniter.Marshal(params)
+	// NewLogger has set a console logger with default params
+	_ = Log.DelLogger(logs.AdapterConsole)
+	return Log.SetLogger(adapter, string(b))
 }
+
 func ParseLevel(logLevel string) int {
 	level := 4 // warning
 	switch logLevel {
@@ -74,37 +155,55 @@ func ParseLevel(logLevel string) int {
 // SetLogLevel set log level, default is warning
 // value: error, warning, info, debug, trace
 func SetLogLevel(logLevel string) {
-	level := ParseLevel(logLevel)
-	Log.SetLevel(level)
+	defaultLevel.Store(int32(ParseLevel(logLevel)))
+	applyLevel()
 }
 
 // wrap log
 
 func Alert(format string, v ...interface{}) {
-	Log.Alert(format, v...)
+	if !enabled(logs.LevelAlert) {
+		return
+	}
+	Log.Alert("%v", &record{format: format, args: v})
 }
 
 func Error(format string, v ...interface{}) {
-	Log.Error(format, v...)
+	if !enabled(logs.LevelError) {
+		return
+	}
+	Log.Error("%v", &record{format: format, args: v})
 }
 
 func Fatal(format string, v ...interface{}) {
-	Log.Error(format, v...)
+	Log.Error("%v", &record{format: format, args: v})
 	os.Exit(1)
 }
 
 func Warn(format string, v ...interface{}) {
-	Log.Warn(format, v...)
+	if !enabled(logs.LevelWarning) {
+		return
+	}
+	Log.Warn("%v", &record{format: format, args: v})
 }
 
 func Info(format string, v ...interface{}) {
-	Log.Info(format, v...)
+	if !enabled(logs.LevelInformational) {
+		return
+	}
+	Log.Info("%v", &record{format: format, args: v})
 }
 
 func Debug(format string, v ...interface{}) {
-	Log.Debug(format, v...)
+	if !enabled(logs.LevelDebug) {
+		return
+	}
+	Log.Debug("%v", &record{format: format, args: v})
 }
 
 func Trace(format string, v ...interface{}) {
-	Log.Trace(format, v...)
+	if !enabled(logs.LevelTrace) {
+		return
+	}
+	Log.Trace("%v", &record{format: format, args: v})
 }
\ No newline at end of file
@@ -0,0 +1,145 @@
+package log
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Modules are named by the directories of their source files relative to the repository, such as
+// "server/juicity" and "pkg/cdn_validator/cloudflare". A level configured for "cdn_validator" applies to any
+// module containing the path segment, and the level of the most specific match wins.
+
+var (
+	// sourceRoot is the directory of the repository, found by the path of this file
+	sourceRoot string
+
+	defaultLevel atomic.Int32
+
+	muModules    sync.RWMutex
+	moduleLevels map[string]int
+	fileModules  = make(map[string]string)
+	// fileLevels caches the levels of source files
+	fileLevels sync.Map
+)
+
+func init() {
+	if _, file, _, ok := runtime.Caller(0); ok {
+		sourceRoot = strings.TrimSuffix(file, "pkg/log/module.go")
+	}
+	defaultLevel.Store(int32(ParseLevel("warn")))
+}
+
+// SetFileModule names the module of the calling source file as a submodule of its directory, such as
+// "server/dialer" for server/limited_dialer.go. It should be called in init.
+func SetFileModule(name string) {
+	_, file, _, ok := runtime.Caller(1)
+	if !ok {
+		return
+	}
+	muModules.Lock()
+	fileModules[file] = name
+	muModules.Unlock()
+	fileLevels.Delete(file)
+}
+
+// ModuleOf returns the module the source file belongs to.
+func ModuleOf(file string) string {
+	muModules.RLock()
+	name, ok := fileModules[file]
+	muModules.RUnlock()
+	dir := path.Dir(strings.TrimPrefix(file, sourceRoot))
+	if ok {
+		return dir + "/" + name
+	}
+	return dir
+}
+
+// SetModuleLevels sets log levels of modules, such as {"server/juicity": "trace"}. Other modules use the level
+// set by SetLogLevel.
+func SetModuleLevels(levels map[string]string) error {
+	m := make(map[string]int, len(levels))
+	for module, level := range levels {
+		if !ValidLevel(level) {
+			return fmt.Errorf("invalid log level of module %v: %v", module, level)
+		}
+		m[strings.Trim(module, "/")] = ParseLevel(level)
+	}
+	muModules.Lock()
+	moduleLevels = m
+	muModules.Unlock()
+	applyLevel()
+	return nil
+}
+
+// ValidLevel reports whether the level is one of trace, debug, info, warn and error.
+func ValidLevel(level string) bool {
+	switch level {
+	case "trace", "debug", "info", "warn", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+// applyLevel lets beego pass the messages of the most verbose module, which are filtered by enabled later.
+func applyLevel() {
+	level := int(defaultLevel.Load())
+	muModules.RLock()
+	for _, l := range moduleLevels {
+		if l > level {
+			level = l
+		}
+	}
+	muModules.RUnlock()
+	fileLevels.Range(func(key, value any) bool {
+		fileLevels.Delete(key)
+		return true
+	})
+	Log.SetLevel(level)
+}
+
+// matchModule reports whether the segments of the key are a contiguous part of the module.
+func matchModule(module, key string) bool {
+	return strings.Contains("/"+module+"/", "/"+key+"/")
+}
+
+func levelOf(file string) int {
+	if level, ok := fileLevels.Load(file); ok {
+		return level.(int)
+	}
+	module := ModuleOf(file)
+	level := int(defaultLevel.Load())
+	matched := ""
+	muModules.RLock()
+	for key, l := range moduleLevels {
+		if matchModule(module, key) && len(key) > len(matched) {
+			matched, level = key, l
+		}
+	}
+	muModules.RUnlock()
+	fileLevels.Store(file, level)
+	return level
+}
+
+// enabled reports whether the message of the level from the caller of the logging function should be output.
+func enabled(level int) bool {
+	if level > Log.GetLevel() {
+		return false
+	}
+	muModules.RLock()
+	noModules := len(moduleLevels) == 0
+	muModules.RUnlock()
+	if noModules {
+		return true
+	}
+	// enabled, the logging function and its caller
+	_, file, _, ok := runtime.Caller(2)
+	if !ok {
+		return true
+	}
+	return level <= levelOf(file)
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestModuleOf(t *testing.T) {
+	for file, want := range map[string]string{
+		sourceRoot + "server/juicity/server.go":              "server/juicity",
+		sourceRoot + "pkg/cdn_validator/cloudflare/cdn.go":   "pkg/cdn_validator/cloudflare",
+		sourceRoot + "api/api.go":                            "api",
+		"/go/pkg/mod/github.com/v2rayA/beego/v2/logs/log.go": "/go/pkg/mod/github.com/v2rayA/beego/v2/logs",
+	} {
+		if got := ModuleOf(file); got != want {
+			t.Errorf("ModuleOf(%v) = %v, want %v", file, got, want)
+		}
+	}
+	for _, c := range []struct {
+		module, key string
+		match       bool
+	}{
+		{"server/juicity", "server/juicity", true},
+		{"server/juicity", "juicity", true},
+		{"server/juicity", "server", true},
+		{"pkg/cdn_validator/cloudflare", "cdn_validator", true},
+		{"server/dialer", "dialer", true},
+		{"server/vmess", "server/juicity", false},
+		{"server/vmess", "vm", false},
+	} {
+		if got := matchModule(c.module, c.key); got != c.match {
+			t.Errorf("matchModule(%v, %v) = %v", c.module, c.key, got)
+		}
+	}
+}
+
+func TestModuleLevels(t *testing.T) {
+	defer func() {
+		_ = SetModuleLevels(nil)
+		SetLogLevel("warn")
+	}()
+	logTrace := func() string {
+		return captureLogs(t, FormatText, func() {
+			SetLogLevel("warn")
+			Trace("trace message")
+			With("k", "v").Debug("debug message")
+			Warn("warn message")
+		})
+	}
+
+	if err := SetModuleLevels(map[string]string{"server/juicity": "trace"}); err != nil {
+		t.Fatal(err)
+	}
+	out := logTrace()
+	if strings.Contains(out, "trace message") || strings.Contains(out, "debug message") || !strings.Contains(out, "warn message") {
+		t.Errorf("the level of another module should not apply:\n%v", out)
+	}
+
+	if err := SetModuleLevels(map[string]string{"pkg/log": "debug", "log": "error"}); err != nil {
+		t.Fatal(err)
+	}
+	out = logTrace()
+	if strings.Contains(out, "trace message") || !strings.Contains(out, "debug message") {
+		t.Errorf("the level of the most specific module should apply:\n%v", out)
+	}
+
+	if err := SetModuleLevels(map[string]string{"pkg/log": "verbose"}); err == nil {
+		t.Error("invalid levels should be rejected")
+	}
+}
+
+func TestSetFileModule(t *testing.T) {
+	SetFileModule("testing")
+	_, file, _, _ := runtime.Caller(0)
+	if got, want := ModuleOf(file), "pkg/log/testing"; got != want {
+		t.Errorf("ModuleOf(%v) = %v, want %v", file, got, want)
+	}
+}
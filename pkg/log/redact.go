@@ -0,0 +1,268 @@
+package log
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// RedactFull shows values as they are.
+	RedactFull = "full"
+	// RedactHash replaces values with their keyed hashes. The key changes every day.
+	RedactHash = "hash"
+	// RedactTruncate keeps only the prefix of values, such as the /24 of IPv4 addresses, and at most the last two
+	// labels of hostnames without the leftmost one.
+	RedactTruncate = "truncate"
+	// RedactOmit replaces values with a placeholder.
+	RedactOmit = "omit"
+
+	omitted = "redacted"
+)
+
+// Redactor redacts IPs, hostnames and other identifying values.
+type Redactor struct {
+	mode string
+	// secret derives the daily salt for hashing
+	secret []byte
+
+	mu      sync.Mutex
+	day     string
+	daySalt []byte
+}
+
+func NewRedactor(mode string) (*Redactor, error) {
+	switch mode {
+	case RedactFull, RedactHash, RedactTruncate, RedactOmit:
+	case "":
+		mode = RedactHash
+	default:
+		return nil, fmt.Errorf("unknown redaction mode: %v", mode)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Redactor{mode: mode, secret: secret}, nil
+}
+
+func (r *Redactor) Mode() string {
+	return r.mode
+}
+
+var defaultRedactor atomic.Pointer[Redactor]
+
+func init() {
+	r, err := NewRedactor(RedactHash)
+	if err != nil {
+		panic(err)
+	}
+	defaultRedactor.Store(r)
+}
+
+// SetRedactMode sets how the diagnostic log shows IPs, hostnames and other identifying values.
+func SetRedactMode(mode string) error {
+	r, err := NewRedactor(mode)
+	if err != nil {
+		return err
+	}
+	defaultRedactor.Store(r)
+	return nil
+}
+
+// DefaultRedactor returns the redactor of the diagnostic log.
+func DefaultRedactor() *Redactor {
+	return defaultRedactor.Load()
+}
+
+func (r *Redactor) salt(now time.Time) []byte {
+	day := now.UTC().Format(time.DateOnly)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.day != day {
+		mac := hmac.New(sha256.New, r.secret)
+		mac.Write([]byte(day))
+		r.day = day
+		r.daySalt = mac.Sum(nil)
+	}
+	return r.daySalt
+}
+
+func (r *Redactor) hash(s string) string {
+	mac := hmac.New(sha256.New, r.salt(time.Now()))
+	mac.Write([]byte(s))
+	return "h-" + hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// Host redacts an IP or a hostname.
+func (r *Redactor) Host(host string) string {
+	if host == "" {
+		return ""
+	}
+	switch r.mode {
+	case RedactFull:
+		return host
+	case RedactHash:
+		return r.hash(host)
+	case RedactTruncate:
+		if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+			bits := 24
+			if ip.Is6() && !ip.Is4In6() {
+				bits = 48
+			}
+			prefix, _ := ip.Unmap().Prefix(bits)
+			return prefix.String()
+		}
+		// keep at most the last two labels, and always drop the leftmost one
+		labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+		keep := min(len(labels)-1, 2)
+		if keep == 0 {
+			return "*"
+		}
+		return "*." + strings.Join(labels[len(labels)-keep:], ".")
+	default:
+		return omitted
+	}
+}
+
+// Addr redacts the host of an address and keeps the port.
+func (r *Redactor) Addr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return r.Host(addr)
+	}
+	return net.JoinHostPort(r.Host(host), port)
+}
+
+// Opaque redacts a value without structure, such as the From of a passage.
+func (r *Redactor) Opaque(s string) string {
+	if s == "" {
+		return ""
+	}
+	switch r.mode {
+	case RedactFull:
+		return s
+	case RedactHash:
+		return r.hash(s)
+	case RedactTruncate:
+		const keep = 4
+		if len(s) <= keep {
+			return strings.Repeat("*", len(s))
+		}
+		return s[:keep] + "*"
+	default:
+		return omitted
+	}
+}
+
+var (
+	ipv4Candidate = regexp.MustCompile(`\d{1,3}(\.\d{1,3}){3}`)
+	ipv6Candidate = regexp.MustCompile(`[0-9A-Fa-f]{0,4}(:[0-9A-Fa-f]{0,4}){2,7}(\.\d{1,3}){0,3}`)
+)
+
+// Scrub redacts IP addresses in text. Loopback and unspecified addresses, as well as prefixes, are left.
+func (r *Redactor) Scrub(text string) string {
+	if r.mode == RedactFull {
+		return text
+	}
+	replace := func(re *regexp.Regexp, text string) string {
+		var b strings.Builder
+		last := 0
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			if loc[1] < len(text) && text[loc[1]] == '/' {
+				// a prefix
+				continue
+			}
+			ip, err := netip.ParseAddr(text[loc[0]:loc[1]])
+			if err != nil || ip.IsLoopback() || ip.IsUnspecified() {
+				continue
+			}
+			b.WriteString(text[last:loc[0]])
+			b.WriteString(r.Host(ip.String()))
+			last = loc[1]
+		}
+		if last == 0 {
+			return text
+		}
+		b.WriteString(text[last:])
+		return b.String()
+	}
+	return replace(ipv6Candidate, replace(ipv4Candidate, text))
+}
+
+type sensitiveKind int
+
+const (
+	sensitiveHost sensitiveKind = iota
+	sensitiveAddr
+	sensitiveOpaque
+)
+
+// Sensitive is a value redacted by the default redactor when it is formatted.
+type Sensitive struct {
+	kind sensitiveKind
+	raw  string
+}
+
+// Host marks an IP or a hostname as sensitive.
+func Host(host string) Sensitive {
+	return Sensitive{kind: sensitiveHost, raw: host}
+}
+
+// Addr marks an address in the form of host:port as sensitive.
+func Addr(addr string) Sensitive {
+	return Sensitive{kind: sensitiveAddr, raw: addr}
+}
+
+// Opaque marks a value without structure as sensitive, such as the From of a passage.
+func Opaque(s string) Sensitive {
+	return Sensitive{kind: sensitiveOpaque, raw: s}
+}
+
+// Redact returns the value redacted by the redactor.
+func (s Sensitive) Redact(r *Redactor) string {
+	switch s.kind {
+	case sensitiveHost:
+		return r.Host(s.raw)
+	case sensitiveAddr:
+		return r.Addr(s.raw)
+	default:
+		return r.Opaque(s.raw)
+	}
+}
+
+// identifier returns the part to be found and redacted in messages.
+func (s Sensitive) identifier() string {
+	if s.kind == sensitiveAddr {
+		if host, _, err := net.SplitHostPort(s.raw); err == nil {
+			return host
+		}
+	}
+	return s.raw
+}
+
+func (s Sensitive) redactIdentifier(r *Redactor) string {
+	if s.kind == sensitiveOpaque {
+		return r.Opaque(s.identifier())
+	}
+	return r.Host(s.identifier())
+}
+
+func (s Sensitive) String() string {
+	return s.Redact(DefaultRedactor())
+}
+
+func (s Sensitive) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(s.String())
+}
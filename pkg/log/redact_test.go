@@ -0,0 +1,184 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+// memorySink keeps formatted messages in memory.
+type memorySink struct {
+	mu        sync.Mutex
+	lines     []string
+	formatter logs.LogFormatter
+}
+
+func (s *memorySink) Init(config string) error {
+	var conf struct{ Formatter string }
+	if err := json.Unmarshal([]byte(config), &conf); err != nil {
+		return err
+	}
+	if conf.Formatter != "" {
+		f, ok := logs.GetFormatter(conf.Formatter)
+		if !ok {
+			return fmt.Errorf("no formatter %v", conf.Formatter)
+		}
+		s.formatter = f
+	}
+	return nil
+}
+
+func (s *memorySink) WriteMsg(lm *logs.LogMsg) error {
+	var line string
+	if s.formatter != nil {
+		line = s.formatter.Format(lm)
+	} else {
+		line = lm.OldStyleFormat()
+	}
+	s.mu.Lock()
+	s.lines = append(s.lines, line)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memorySink) Destroy()                         {}
+func (s *memorySink) Flush()                           {}
+func (s *memorySink) SetFormatter(f logs.LogFormatter) { s.formatter = f }
+
+var sink = &memorySink{}
+
+func init() {
+	logs.Register("memory", func() logs.Logger { return sink })
+}
+
+func captureLogs(t *testing.T, format string, f func()) string {
+	t.Helper()
+	_ = Log.DelLogger("console")
+	_ = Log.DelLogger("memory")
+	config := `{}`
+	if format == FormatJson {
+		config = `{"formatter": "json"}`
+	}
+	if err := Log.SetLogger("memory", config); err != nil {
+		t.Fatal(err)
+	}
+	Log.SetLevel(ParseLevel("trace"))
+	sink.mu.Lock()
+	sink.lines = nil
+	sink.formatter = nil
+	sink.mu.Unlock()
+	if err := sink.Init(config); err != nil {
+		t.Fatal(err)
+	}
+	f()
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return strings.Join(sink.lines, "\n")
+}
+
+const (
+	rawIPv4     = "203.0.113.7"
+	rawIPv6     = "2001:db8:7:7::7"
+	rawConflict = "198.51.100.9"
+	rawHost     = "cdn.example.org"
+	rawFrom     = "relay-from-secret"
+)
+
+func logSensitive() {
+	Info("accepted from %v", rawIPv4+":5555")
+	Warn("dial tcp [%v]:443: connect: connection refused", rawIPv6)
+	With("source", Addr(rawIPv4+":5555")).
+		With("target", Addr(rawHost+":443")).
+		Warn("relay: lookup %v: no such host; read from %v", rawHost, rawIPv4)
+	err := fmt.Errorf("contention detected: from %v and %v", Host(rawIPv4), Host(rawConflict))
+	With("passage", "0123abcd").Info("handleTCP: %v", err)
+	Trace("RemovePassage: From: %v", Opaque(rawFrom))
+	With("from", Opaque(rawFrom)).Debug("passage from %v removed", rawFrom)
+}
+
+func TestNoRawValuesReachSink(t *testing.T) {
+	defer SetRedactMode(RedactHash)
+	for _, mode := range []string{RedactHash, RedactTruncate, RedactOmit} {
+		for _, format := range []string{FormatText, FormatJson} {
+			t.Run(mode+"/"+format, func(t *testing.T) {
+				if err := SetRedactMode(mode); err != nil {
+					t.Fatal(err)
+				}
+				out := captureLogs(t, format, logSensitive)
+				if out == "" {
+					t.Fatal("nothing was logged")
+				}
+				for _, raw := range []string{rawIPv4, rawIPv6, rawConflict, rawHost, rawFrom} {
+					if strings.Contains(out, raw) {
+						t.Errorf("%v reached the sink:\n%v", raw, out)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFullModeKeepsValues(t *testing.T) {
+	defer SetRedactMode(RedactHash)
+	if err := SetRedactMode(RedactFull); err != nil {
+		t.Fatal(err)
+	}
+	out := captureLogs(t, FormatText, logSensitive)
+	for _, raw := range []string{rawIPv4, rawIPv6, rawConflict, rawHost, rawFrom} {
+		if !strings.Contains(out, raw) {
+			t.Errorf("%v is missing:\n%v", raw, out)
+		}
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor(RedactTruncate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]string{
+		"203.0.113.7":       "203.0.113.0/24",
+		"2001:db8:7:7::7":   "2001:db8:7::/48",
+		"cdn.example.org":   "*.example.org",
+		"example.com":       "*.com",
+		"localhost":         "*",
+		"203.0.113.7:443":   "203.0.113.0/24:443",
+		"[2001:db8::1]:443": "[2001:db8::/48]:443",
+	} {
+		var got string
+		if strings.Contains(in, "]:") || strings.HasSuffix(in, ":443") {
+			got = r.Addr(in)
+		} else {
+			got = r.Host(in)
+		}
+		if got != want {
+			t.Errorf("truncate %v: got %v, want %v", in, got, want)
+		}
+	}
+
+	r, err = NewRedactor(RedactHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Host(rawIPv4) != r.Host(rawIPv4) {
+		t.Error("hashes of the same value differ in a day")
+	}
+	today := r.salt(time.Now())
+	tomorrow := r.salt(time.Now().Add(24 * time.Hour))
+	if string(today) == string(tomorrow) {
+		t.Error("the salt does not change across days")
+	}
+
+	text := "listen at 0.0.0.0:8880 and 127.0.0.1:8881 for 10.0.0.0/8"
+	if got := r.Scrub(text); got != text {
+		t.Errorf("unspecified, loopback addresses and prefixes should be left: %v", got)
+	}
+	if _, err = NewRedactor("unknown"); err == nil {
+		t.Error("unknown mode should be rejected")
+	}
+}
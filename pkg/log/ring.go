@@ -0,0 +1,104 @@
+package log
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+// AdapterRing is an adapter keeping recent messages in memory.
+const AdapterRing = "ring"
+
+func init() {
+	logs.Register(AdapterRing, func() logs.Logger { return recent })
+}
+
+// recent is shared by ring adapters so that the entries can be retrieved.
+var recent = &ringWriter{}
+
+// ringWriter keeps the last messages formatted as JSON objects. They are redacted in the same way as other outputs.
+type ringWriter struct {
+	Size int `json:"size"`
+
+	mu      sync.Mutex
+	entries []string
+	// next is the index to write in entries
+	next int
+	full bool
+}
+
+func (w *ringWriter) Init(config string) error {
+	var conf struct {
+		Size int `json:"size"`
+	}
+	if err := json.Unmarshal([]byte(config), &conf); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old := w.recentLocked(0)
+	w.Size = conf.Size
+	w.entries = make([]string, conf.Size)
+	w.next, w.full = 0, false
+	if len(old) > conf.Size {
+		old = old[len(old)-conf.Size:]
+	}
+	for _, e := range old {
+		w.appendLocked(e)
+	}
+	return nil
+}
+
+func (w *ringWriter) WriteMsg(lm *logs.LogMsg) error {
+	entry := strings.TrimSuffix((&jsonFormatter{}).Format(lm), "\n")
+	w.mu.Lock()
+	w.appendLocked(entry)
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *ringWriter) appendLocked(entry string) {
+	if len(w.entries) == 0 {
+		return
+	}
+	w.entries[w.next] = entry
+	w.next++
+	if w.next == len(w.entries) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+// recentLocked returns the last n entries from the oldest. Zero n means all.
+func (w *ringWriter) recentLocked(n int) []string {
+	var entries []string
+	if w.full {
+		entries = append(entries, w.entries[w.next:]...)
+	}
+	entries = append(entries, w.entries[:w.next]...)
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries
+}
+
+func (w *ringWriter) SetFormatter(f logs.LogFormatter) {}
+
+func (w *ringWriter) Destroy() {}
+
+func (w *ringWriter) Flush() {}
+
+// RecentEntries returns the last n log entries kept in memory from the oldest, each of which is a JSON object.
+// Zero n means all.
+func RecentEntries(n int) []json.RawMessage {
+	recent.mu.Lock()
+	entries := recent.recentLocked(n)
+	recent.mu.Unlock()
+	raw := make([]json.RawMessage, len(entries))
+	for i, e := range entries {
+		raw[i] = json.RawMessage(e)
+	}
+	return raw
+}
@@ -0,0 +1,57 @@
+package log
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRecentEntries(t *testing.T) {
+	defer func() {
+		_ = Log.DelLogger(AdapterRing)
+		SetLogLevel("warn")
+	}()
+	_ = Log.DelLogger(AdapterRing)
+	if err := Log.SetLogger(AdapterRing, `{"size": 3}`); err != nil {
+		t.Fatal(err)
+	}
+	SetLogLevel("info")
+	for _, msg := range []string{"one", "two", "three", "four"} {
+		Info("%v", msg)
+	}
+	With("source", Addr("203.0.113.7:443")).Warn("five from %v", "203.0.113.7")
+
+	msgs := func(entries []json.RawMessage) (msgs []string) {
+		for _, e := range entries {
+			var entry struct {
+				Level string
+				Msg   string
+			}
+			if err := json.Unmarshal(e, &entry); err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, entry.Level+":"+strings.Fields(entry.Msg)[0])
+		}
+		return msgs
+	}
+	if got := strings.Join(msgs(RecentEntries(0)), ","); got != "info:three,info:four,warn:five" {
+		t.Errorf("unexpected entries: %v", got)
+	}
+	if got := strings.Join(msgs(RecentEntries(1)), ","); got != "warn:five" {
+		t.Errorf("unexpected last entry: %v", got)
+	}
+	for _, e := range RecentEntries(0) {
+		if strings.Contains(string(e), "203.0.113.7") {
+			t.Errorf("the raw IP is kept: %s", e)
+		}
+	}
+
+	// shrinking keeps the newest entries
+	_ = Log.DelLogger(AdapterRing)
+	if err := Log.SetLogger(AdapterRing, `{"size": 2}`); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(msgs(RecentEntries(0)), ","); got != "info:four,warn:five" {
+		t.Errorf("unexpected entries after resizing: %v", got)
+	}
+}
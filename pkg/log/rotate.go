@@ -0,0 +1,222 @@
+package log
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+// AdapterRotatingFile is a file adapter rotating by size.
+const AdapterRotatingFile = "rotating_file"
+
+func init() {
+	logs.Register(AdapterRotatingFile, newRotatingFileWriter)
+}
+
+// rotatingFileWriter writes to a file and rotates it when it exceeds the max size.
+// Rotated files are named like "john.log.1", "john.log.2" from the newest, optionally with the suffix ".gz".
+type rotatingFileWriter struct {
+	Filename   string `json:"filename"`
+	MaxSize    int64  `json:"maxsize"`
+	MaxBackups int    `json:"maxbackups"`
+	MaxDays    int64  `json:"maxdays"`
+	Compress   bool   `json:"compress"`
+	Formatter  string `json:"formatter"`
+
+	formatter logs.LogFormatter
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+}
+
+func newRotatingFileWriter() logs.Logger {
+	w := &rotatingFileWriter{
+		MaxSize:    100 << 20,
+		MaxBackups: 5,
+	}
+	w.formatter = w
+	return w
+}
+
+func (w *rotatingFileWriter) Init(config string) error {
+	if err := json.Unmarshal([]byte(config), w); err != nil {
+		return err
+	}
+	if w.Filename == "" {
+		return fmt.Errorf("%v: filename is required", AdapterRotatingFile)
+	}
+	if w.MaxSize <= 0 {
+		return fmt.Errorf("%v: maxsize should be positive", AdapterRotatingFile)
+	}
+	if w.Formatter != "" {
+		f, ok := logs.GetFormatter(w.Formatter)
+		if !ok {
+			return fmt.Errorf("the formatter with name: %v not found", w.Formatter)
+		}
+		w.formatter = f
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.open()
+}
+
+// Format formats the message in the same way as the file adapter of beego.
+func (w *rotatingFileWriter) Format(lm *logs.LogMsg) string {
+	return lm.When.Format("2006/01/02 15:04:05.000") + " " + lm.OldStyleFormat() + "\n"
+}
+
+func (w *rotatingFileWriter) SetFormatter(f logs.LogFormatter) {
+	w.formatter = f
+}
+
+func (w *rotatingFileWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.Filename), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingFileWriter) WriteMsg(lm *logs.LogMsg) error {
+	msg := w.formatter.Format(lm)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	if w.size > 0 && w.size+int64(len(msg)) > w.MaxSize {
+		if err := w.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v(%q): %v\n", AdapterRotatingFile, w.Filename, err)
+		}
+	}
+	n, err := io.WriteString(w.file, msg)
+	w.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups and reopens the file. The caller should hold the lock.
+func (w *rotatingFileWriter) rotate() error {
+	_ = w.file.Close()
+	w.file = nil
+	var errs []error
+	for i := w.MaxBackups - 1; i >= 1; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			from := w.backupName(i) + ext
+			if _, err := os.Stat(from); err == nil {
+				errs = append(errs, os.Rename(from, w.backupName(i+1)+ext))
+			}
+		}
+	}
+	if w.MaxBackups > 0 {
+		backup := w.backupName(1)
+		if err := os.Rename(w.Filename, backup); err != nil {
+			errs = append(errs, err)
+		} else if w.Compress {
+			errs = append(errs, compressFile(backup))
+		}
+	} else {
+		errs = append(errs, os.Remove(w.Filename))
+	}
+	errs = append(errs, w.prune())
+	if err := w.open(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (w *rotatingFileWriter) backupName(i int) string {
+	return w.Filename + "." + strconv.Itoa(i)
+}
+
+// prune removes the backups beyond MaxBackups or older than MaxDays.
+func (w *rotatingFileWriter) prune() error {
+	matches, err := filepath.Glob(w.Filename + ".*")
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, name := range matches {
+		i, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, w.Filename+"."), ".gz"))
+		if err != nil {
+			// not a backup
+			continue
+		}
+		expired := false
+		if w.MaxDays > 0 {
+			if info, err := os.Stat(name); err == nil {
+				expired = time.Since(info.ModTime()) > time.Duration(w.MaxDays)*24*time.Hour
+			}
+		}
+		if i > w.MaxBackups || expired {
+			errs = append(errs, os.Remove(name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func compressFile(name string) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(name + ".gz")
+		}
+	}()
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+func (w *rotatingFileWriter) Destroy() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+}
+
+func (w *rotatingFileWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		_ = w.file.Sync()
+	}
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+func TestRotatingFileWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "john.log")
+	w := newRotatingFileWriter()
+	if err := w.Init(`{"filename": "` + file + `", "maxsize": 100, "maxbackups": 2, "compress": true, "formatter": "message_line"}`); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Destroy()
+	line := strings.Repeat("x", 39)
+	for i := 0; i < 10; i++ {
+		// 40 bytes per line and 2 lines per file
+		if err := w.WriteMsg(&logs.LogMsg{Level: logs.LevelInformational, Msg: line, When: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matches, _ := filepath.Glob(file + "*")
+	want := []string{file, file + ".1.gz", file + ".2.gz"}
+	if strings.Join(matches, ",") != strings.Join(want, ",") {
+		t.Fatalf("files: %v, want %v", matches, want)
+	}
+	f, err := os.Open(file + ".1.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != line+"\n"+line+"\n" {
+		t.Errorf("unexpected backup content: %q", b)
+	}
+	if info, _ := os.Stat(file); info.Size() > 100 {
+		t.Errorf("the file exceeds the max size: %v", info.Size())
+	}
+}
+
+func TestRotatingFileWriterPrune(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "john.log")
+	old := time.Now().Add(-72 * time.Hour)
+	for _, name := range []string{file + ".1", file + ".2.gz", file + ".9"} {
+		if err := os.WriteFile(name, []byte("x"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// expired
+	_ = os.Chtimes(file+".2.gz", old, old)
+
+	w := newRotatingFileWriter().(*rotatingFileWriter)
+	if err := w.Init(`{"filename": "` + file + `", "maxsize": 100, "maxbackups": 3, "maxdays": 1}`); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Destroy()
+	if err := w.prune(); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(file + ".*")
+	if len(matches) != 1 || matches[0] != file+".1" {
+		t.Errorf("backups after pruning: %v", matches)
+	}
+}
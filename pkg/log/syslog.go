@@ -0,0 +1,127 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/v2rayA/beego/v2/logs"
+)
+
+// AdapterSyslog is an adapter sending messages to syslog through a unix socket or UDP.
+const AdapterSyslog = "syslog"
+
+func init() {
+	logs.Register(AdapterSyslog, func() logs.Logger {
+		return &syslogWriter{Tag: filepath.Base(os.Args[0])}
+	})
+}
+
+type syslogWriter struct {
+	// Address is like unix:///dev/log or udp://127.0.0.1:514. Empty means the local syslog.
+	Address   string `json:"address"`
+	Tag       string `json:"tag"`
+	Formatter string `json:"formatter"`
+
+	formatter logs.LogFormatter
+	writer    *syslog.Writer
+}
+
+// ParseSyslogAddress parses an address like unix:///dev/log or udp://127.0.0.1:514 to the network and
+// the address for syslog.Dial.
+func ParseSyslogAddress(address string) (network string, raddr string, err error) {
+	if address == "" {
+		return "", "", nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "unix", "unixgram":
+		return "unixgram", u.Path, nil
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		if u.Port() == "" {
+			return u.Scheme, u.Host + ":514", nil
+		}
+		return u.Scheme, u.Host, nil
+	default:
+		return "", "", fmt.Errorf("unsupported syslog address: %v", address)
+	}
+}
+
+func (w *syslogWriter) Init(config string) error {
+	if err := json.Unmarshal([]byte(config), w); err != nil {
+		return err
+	}
+	if w.Formatter != "" {
+		f, ok := logs.GetFormatter(w.Formatter)
+		if !ok {
+			return fmt.Errorf("the formatter with name: %v not found", w.Formatter)
+		}
+		w.formatter = f
+	}
+	network, raddr, err := ParseSyslogAddress(w.Address)
+	if err != nil {
+		return err
+	}
+	w.writer, err = syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, w.Tag)
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+	return nil
+}
+
+func (w *syslogWriter) SetFormatter(f logs.LogFormatter) {
+	w.formatter = f
+}
+
+func (w *syslogWriter) WriteMsg(lm *logs.LogMsg) error {
+	var msg string
+	if w.formatter != nil {
+		msg = w.formatter.Format(lm)
+	} else {
+		// syslog records the time and the priority by itself
+		msg = fmt.Sprintf("[%v:%v] ", filepath.Base(lm.FilePath), lm.LineNumber)
+		if r, ok := asRecord(lm); ok {
+			msg += r.String()
+		} else {
+			text := lm.Msg
+			if len(lm.Args) > 0 {
+				text = fmt.Sprintf(lm.Msg, lm.Args...)
+			}
+			msg += DefaultRedactor().Scrub(text)
+		}
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+	switch syslogPriority(lm.Level) {
+	case logs.LevelEmergency:
+		return w.writer.Emerg(msg)
+	case logs.LevelAlert:
+		return w.writer.Alert(msg)
+	case logs.LevelCritical:
+		return w.writer.Crit(msg)
+	case logs.LevelError:
+		return w.writer.Err(msg)
+	case logs.LevelWarning:
+		return w.writer.Warning(msg)
+	case logs.LevelNotice:
+		return w.writer.Notice(msg)
+	case logs.LevelInformational:
+		return w.writer.Info(msg)
+	default:
+		return w.writer.Debug(msg)
+	}
+}
+
+func (w *syslogWriter) Destroy() {
+	if w.writer != nil {
+		_ = w.writer.Close()
+	}
+}
+
+func (w *syslogWriter) Flush() {}
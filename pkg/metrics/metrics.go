@@ -0,0 +1,254 @@
+// Package metrics is a minimal implementation of the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sample is a value of a metric with the label values.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registry   []metric
+	muRegistry sync.Mutex
+)
+
+func register(m metric) {
+	muRegistry.Lock()
+	defer muRegistry.Unlock()
+	registry = append(registry, m)
+}
+
+// Handler serves all registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// WriteTo writes all registered metrics in the Prometheus text format.
+func WriteTo(w io.Writer) {
+	muRegistry.Lock()
+	metrics := make([]metric, len(registry))
+	copy(metrics, registry)
+	muRegistry.Unlock()
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type desc struct {
+	n      string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.n
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", d.n, helpEscaper.Replace(d.help), d.n, d.typ)
+}
+
+var (
+	// helpEscaper escapes the HELP text, where only backslashes and line feeds are escaped
+	helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	// labelValueEscaper escapes label values, where double quotes are also escaped
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func quoteLabelValue(v string) string {
+	return `"` + labelValueEscaper.Replace(v) + `"`
+}
+
+func (d *desc) writeSample(w io.Writer, suffix string, labelValues []string, extraLabel string, value float64) {
+	var pairs []string
+	for i, l := range d.labels {
+		var v string
+		if i < len(labelValues) {
+			v = labelValues[i]
+		}
+		pairs = append(pairs, l+"="+quoteLabelValue(v))
+	}
+	if extraLabel != "" {
+		pairs = append(pairs, extraLabel)
+	}
+	var labels string
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%v%v%v %v\n", d.n, suffix, labels, formatFloat(value))
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*Sample
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{n: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]*Sample),
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &Sample{LabelValues: labelValues}
+		c.values[key] = s
+	}
+	s.Value += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		c.writeSample(w, "", c.values[k].LabelValues, "", c.values[k].Value)
+	}
+}
+
+// Func is a metric whose samples are collected by a function at every scrape.
+type Func struct {
+	desc
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers a gauge collected by f at every scrape.
+func NewGaugeFunc(name string, help string, f func() []Sample, labels ...string) *Func {
+	return newFunc("gauge", name, help, f, labels)
+}
+
+// NewCounterFunc registers a counter collected by f at every scrape.
+func NewCounterFunc(name string, help string, f func() []Sample, labels ...string) *Func {
+	return newFunc("counter", name, help, f, labels)
+}
+
+func newFunc(typ string, name string, help string, f func() []Sample, labels []string) *Func {
+	m := &Func{
+		desc:    desc{n: name, help: help, typ: typ, labels: labels},
+		collect: f,
+	}
+	register(m)
+	return m
+}
+
+func (f *Func) write(w io.Writer) {
+	f.writeHeader(w)
+	for _, s := range f.collect() {
+		f.writeSample(w, "", s.LabelValues, "", s.Value)
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{n: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	o, ok := h.values[key]
+	if !ok {
+		o = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = o
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			o.counts[i]++
+		}
+	}
+	o.count++
+	o.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o := h.values[k]
+		for i, b := range h.buckets {
+			h.writeSample(w, "_bucket", o.labelValues, "le="+quoteLabelValue(formatFloat(b)), float64(o.counts[i]))
+		}
+		h.writeSample(w, "_bucket", o.labelValues, `le="+Inf"`, float64(o.count))
+		h.writeSample(w, "_sum", o.labelValues, "", o.sum)
+		h.writeSample(w, "_count", o.labelValues, "", float64(o.count))
+	}
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func output(m metric) string {
+	var buf bytes.Buffer
+	m.write(&buf)
+	return buf.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Number of requests.", "method", "code")
+	c.Inc("GET", "200")
+	c.Add(2, "GET", "200")
+	c.Inc("POST", "500")
+	want := `# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",code="200"} 3
+test_requests_total{method="POST",code="500"} 1
+`
+	if got := output(c); got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestFuncWithoutLabels(t *testing.T) {
+	f := NewGaugeFunc("test_temperature", "Temperature.", func() []Sample {
+		return []Sample{{Value: 0.5}}
+	})
+	want := `# HELP test_temperature Temperature.
+# TYPE test_temperature gauge
+test_temperature 0.5
+`
+	if got := output(f); got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	f := NewCounterFunc("test_escaped_total", "Backslash \\ and\nline feed with \"quotes\".", func() []Sample {
+		return []Sample{
+			{LabelValues: []string{`C:\dir`}, Value: 1},
+			{LabelValues: []string{"two\nlines"}, Value: 2},
+			{LabelValues: []string{`say "hi"`}, Value: 3},
+			// UTF-8 is written as it is
+			{LabelValues: []string{"例子"}, Value: 4},
+		}
+	}, "value")
+	want := `# HELP test_escaped_total Backslash \\ and\nline feed with "quotes".
+# TYPE test_escaped_total counter
+test_escaped_total{value="C:\\dir"} 1
+test_escaped_total{value="two\nlines"} 2
+test_escaped_total{value="say \"hi\""} 3
+test_escaped_total{value="例子"} 4
+`
+	if got := output(f); got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestMissingLabelValues(t *testing.T) {
+	f := NewGaugeFunc("test_missing", "Missing label values.", func() []Sample {
+		return []Sample{{LabelValues: []string{"a"}, Value: 1}}
+	}, "first", "second")
+	if got, want := output(f), `test_missing{first="a",second=""} 1`; !strings.Contains(got, want+"\n") {
+		t.Errorf("got:\n%v\nwant the line: %v", got, want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "Duration.", []float64{.1, 1}, "op")
+	h.Observe(.05, "read")
+	h.Observe(.5, "read")
+	h.Observe(5, "read")
+	want := `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="read",le="0.1"} 1
+test_duration_seconds_bucket{op="read",le="1"} 2
+test_duration_seconds_bucket{op="read",le="+Inf"} 3
+test_duration_seconds_sum{op="read"} 5.55
+test_duration_seconds_count{op="read"} 3
+`
+	if got := output(h); got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestWriteToSorted(t *testing.T) {
+	NewGaugeFunc("test_sorted_b", "B.", func() []Sample { return nil })
+	NewGaugeFunc("test_sorted_a", "A.", func() []Sample { return nil })
+	var buf bytes.Buffer
+	WriteTo(&buf)
+	out := buf.String()
+	a, b := strings.Index(out, "# HELP test_sorted_a "), strings.Index(out, "# HELP test_sorted_b ")
+	if a < 0 || b < 0 || a > b {
+		t.Errorf("metrics are not written in the order of names:\n%v", out)
+	}
+}
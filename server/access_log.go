@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+var accessLog atomic.Pointer[log.AccessLog]
+
+// InitAccessLog opens the access log if it is configured.
+func InitAccessLog(conf config.AccessLog) error {
+	if conf.File == "" {
+		return nil
+	}
+	l, err := log.NewAccessLog(conf.File, conf.MaxDays, conf.Redact, conf.Format)
+	if err != nil {
+		return err
+	}
+	if old := accessLog.Swap(l); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// logAccess writes a line for the finished session to the access log.
+func logAccess(s *Session) {
+	l := accessLog.Load()
+	if l == nil {
+		return
+	}
+	up, down := s.Traffic()
+	l.Write(log.With("protocol", s.Protocol).
+		With("conn_id", s.ID).
+		With("passage", PassageHash(s.Passage)).
+		With("use", string(s.Passage.Use())).
+		With("network", s.Network).
+		With("target", log.Addr(s.Target)).
+		With("up", up).
+		With("down", down).
+		With("duration", fmt.Sprintf("%.3fs", time.Since(s.Start).Seconds())).
+		With("reason", s.CloseReason()))
+}
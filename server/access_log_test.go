@@ -0,0 +1,68 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+)
+
+func TestAccessLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	if err := InitAccessLog(config.AccessLog{File: file, MaxDays: 7, Format: "text", Redact: "truncate"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		accessLog.Swap(nil).Close()
+	}()
+
+	passage := &Passage{Passage: model.Passage{In: model.In{
+		From:     "relay-from",
+		Argument: model.Argument{Protocol: "shadowsocks", Password: "secret", Method: "chacha20-ietf-poly1305"},
+	}}}
+	sess := NewSession(SessionInfo{
+		Protocol: "shadowsocks",
+		Network:  "tcp",
+		Passage:  passage,
+		Source:   "198.51.100.9:5555",
+		Target:   "203.0.113.7:443",
+	})
+	sess.AddUp(100)
+	sess.AddDown(2000)
+	_ = sess.End(io.EOF)
+	// the first reason is kept
+	_ = sess.End(nil)
+	sess.Done()
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := string(b)
+	for _, want := range []string{
+		"protocol=shadowsocks",
+		"passage=" + PassageHash(passage),
+		"use=relay",
+		"network=tcp",
+		"target=203.0.113.0/24:443",
+		"up=100",
+		"down=2000",
+		"reason=eof",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("%v is missing in %q", want, line)
+		}
+	}
+	for _, raw := range []string{"203.0.113.7", "198.51.100.9", "relay-from", "secret"} {
+		if strings.Contains(line, raw) {
+			t.Errorf("%v is in %q", raw, line)
+		}
+	}
+	if strings.Count(line, "\n") != 1 {
+		t.Errorf("expect one line: %q", line)
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const AdminSocketFile = "admin.sock"
+
+var ErrAdminTokenRequired = fmt.Errorf("token is required to serve the admin API through TCP")
+
+// AdminStatus is the response of GET /status.
+type AdminStatus struct {
+	Protocol       string
+	Servers        []AdminServer
+	Sessions       int
+	RelayedUp      int64
+	RelayedDown    int64
+	QuotaExhausted bool
+	// Withdrawn is true if the node is withdrawn from any group
+	Withdrawn bool
+	// WithdrawnGroups are the redacted tickets of the groups withdrawn
+	WithdrawnGroups []string              `json:",omitempty"`
+	CDNValidation   *cdn_validator.Result `json:",omitempty"`
+}
+
+type AdminServer struct {
+	Registered bool
+	LastAlive  time.Time `json:",omitempty"`
+	Passages   int
+}
+
+// AdminPassage is a passage without credentials. From and To are redacted like the log.
+type AdminPassage struct {
+	// Key is a short fingerprint of the inbound argument
+	Key      string
+	Use      PassageUse
+	Protocol string `json:",omitempty"`
+	Method   string `json:",omitempty"`
+	From     string `json:",omitempty"`
+	To       string `json:",omitempty"`
+}
+
+// AdminConn is an active relaying session. Source and Target are redacted like the log.
+type AdminConn struct {
+	ID       uint64
+	Protocol string
+	Network  string
+	Passage  string
+	Source   string
+	Target   string
+	Up       int64
+	Down     int64
+	Start    time.Time
+}
+
+// AdminSocket returns the path of the unix socket of the admin API.
+func AdminSocket(conf config.Admin) (string, error) {
+	if conf.Socket != "" {
+		return conf.Socket, nil
+	}
+	return config.DataFile(AdminSocketFile)
+}
+
+// ValidateAdmin checks the admin config before the admin API is served.
+func ValidateAdmin(conf config.Admin) error {
+	if conf.Listen != "" {
+		if conf.Token == "" {
+			return ErrAdminTokenRequired
+		}
+		if _, _, err := net.SplitHostPort(conf.Listen); err != nil {
+			return fmt.Errorf("invalid admin listen address: %w", err)
+		}
+	}
+	_, err := AdminSocket(conf)
+	return err
+}
+
+// ListenAdmin serves the admin API at the unix socket, and at the TCP address if given.
+func ListenAdmin(conf config.Admin) error {
+	if err := ValidateAdmin(conf); err != nil {
+		return err
+	}
+	socket, err := AdminSocket(conf)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(socket), 0750); err != nil {
+		return err
+	}
+	// remove the socket left by the last run
+	_ = os.Remove(socket)
+	lu, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer lu.Close()
+	if err = os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+	eCh := make(chan error, 2)
+	go func() {
+		eCh <- http.Serve(lu, AdminHandler(""))
+	}()
+	log.Info("Serving admin API at %v", socket)
+	if conf.Listen != "" {
+		lt, err := net.Listen("tcp", conf.Listen)
+		if err != nil {
+			return err
+		}
+		defer lt.Close()
+		go func() {
+			eCh <- http.Serve(lt, AdminHandler(conf.Token))
+		}()
+		log.Info("Serving admin API at %v", conf.Listen)
+	}
+	return <-eCh
+}
+
+// AdminHandler returns the handler of the admin API. Requests should carry the token if it is not empty.
+func AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", adminMethod(http.MethodGet, adminStatus))
+	mux.HandleFunc("/passages", adminMethod(http.MethodGet, adminPassages))
+	mux.HandleFunc("/conns", adminMethod(http.MethodGet, adminConns))
+	mux.HandleFunc("/conns/kill", adminMethod(http.MethodPost, adminKill))
+	mux.HandleFunc("/reregister", adminMethod(http.MethodPost, adminReregister))
+	mux.HandleFunc("/sync", adminMethod(http.MethodPost, adminSync))
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			adminError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func adminMethod(method string, f func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			adminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v is not allowed", r.Method))
+			return
+		}
+		v, err := f(r)
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = jsoniter.NewEncoder(w).Encode(v)
+	}
+}
+
+func adminError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = jsoniter.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+}
+
+func adminStatus(r *http.Request) (interface{}, error) {
+	status := AdminStatus{
+		Protocol:       config.ParamsObj.John.Protocol,
+		QuotaExhausted: QuotaExhausted(),
+		CDNValidation:  cdn_validator.LastResult(),
+	}
+	for _, group := range WithdrawnGroups() {
+		status.Withdrawn = true
+		status.WithdrawnGroups = append(status.WithdrawnGroups, log.Opaque(group).String())
+	}
+	for _, s := range Servers() {
+		lastAlive := s.LastAlive()
+		status.Servers = append(status.Servers, AdminServer{
+			Registered: !lastAlive.IsZero() && time.Since(lastAlive) < LostThreshold,
+			LastAlive:  lastAlive,
+			Passages:   len(s.Passages()),
+		})
+	}
+	RangeSessions(func(s *Session) {
+		status.Sessions++
+	})
+	status.RelayedUp, status.RelayedDown = RelayedTraffic()
+	return status, nil
+}
+
+func adminPassages(r *http.Request) (interface{}, error) {
+	passages := make([]AdminPassage, 0)
+	for _, s := range Servers() {
+		for _, passage := range s.Passages() {
+			p := AdminPassage{
+				Key:      PassageHash(&passage),
+				Use:      passage.Use(),
+				Protocol: string(passage.In.Protocol),
+				Method:   passage.In.Method,
+				From:     log.Opaque(passage.In.From).String(),
+			}
+			if passage.Out != nil {
+				p.To = log.Addr(passage.Out.To).String()
+			}
+			passages = append(passages, p)
+		}
+	}
+	return passages, nil
+}
+
+func adminConns(r *http.Request) (interface{}, error) {
+	conns := make([]AdminConn, 0)
+	RangeSessions(func(s *Session) {
+		up, down := s.Traffic()
+		conns = append(conns, AdminConn{
+			ID:       s.ID,
+			Protocol: s.Protocol,
+			Network:  s.Network,
+			Passage:  PassageHash(s.Passage),
+			Source:   log.Addr(s.Source).String(),
+			Target:   log.Addr(s.Target).String(),
+			Up:       up,
+			Down:     down,
+			Start:    s.Start,
+		})
+	})
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+	return conns, nil
+}
+
+func adminKill(r *http.Request) (interface{}, error) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad id: %w", err)
+	}
+	n := CloseSessions(CloseReasonKilled, func(s *Session) bool {
+		return s.ID == id
+	})
+	if n == 0 {
+		return nil, fmt.Errorf("no such connection: %v", id)
+	}
+	log.Info("Killed connection %v through the admin API", id)
+	return struct{ Killed int }{n}, nil
+}
+
+func adminReregister(r *http.Request) (interface{}, error) {
+	var errs []error
+	for _, s := range Servers() {
+		errs = append(errs, s.Reregister())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+func adminSync(r *http.Request) (interface{}, error) {
+	var errs []error
+	for _, s := range Servers() {
+		passages, ok := SyncedPassages(s)
+		if !ok {
+			errs = append(errs, fmt.Errorf("no passages have been synced yet"))
+			continue
+		}
+		errs = append(errs, s.SyncPassages(passages))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestAdminRedaction(t *testing.T) {
+	passage := testPassage("secret", false)
+	passage.In.From = "relay-from"
+	passage.Out = &model.Out{To: "203.0.113.8:8443"}
+	s := &fakeServer{passages: []Passage{passage}}
+	muServers.Lock()
+	servers = append(servers, s)
+	muServers.Unlock()
+	defer func() {
+		muServers.Lock()
+		servers = servers[:len(servers)-1]
+		muServers.Unlock()
+	}()
+	sess := NewSession(SessionInfo{
+		Protocol: "shadowsocks",
+		Network:  "tcp",
+		Passage:  &passage,
+		Source:   "198.51.100.9:5555",
+		Target:   "203.0.113.7:443",
+	})
+	defer sess.Done()
+
+	passages, err := adminPassages(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, err := adminConns(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := jsoniter.Marshal([]interface{}{passages, conns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{"relay-from", "203.0.113.8", "198.51.100.9", "203.0.113.7", "secret"} {
+		if strings.Contains(string(b), raw) {
+			t.Errorf("%v is not redacted in %s", raw, b)
+		}
+	}
+	if !strings.Contains(string(b), PassageHash(&passage)) {
+		t.Errorf("the passage key is missing in %s", b)
+	}
+}
+
+func TestValidateAdmin(t *testing.T) {
+	for _, c := range []struct {
+		conf config.Admin
+		ok   bool
+	}{
+		{conf: config.Admin{Socket: "/tmp/admin.sock"}, ok: true},
+		{conf: config.Admin{Socket: "/tmp/admin.sock", Listen: "127.0.0.1:8881", Token: "token"}, ok: true},
+		{conf: config.Admin{Socket: "/tmp/admin.sock", Listen: "127.0.0.1:8881"}},
+		{conf: config.Admin{Socket: "/tmp/admin.sock", Listen: "127.0.0.1", Token: "token"}},
+	} {
+		if err := ValidateAdmin(c.conf); (err == nil) != c.ok {
+			t.Errorf("%+v: %v", c.conf, err)
+		}
+	}
+	if err := ValidateAdmin(config.Admin{Listen: ":8881"}); err != ErrAdminTokenRequired {
+		t.Errorf("TCP without the token: %v", err)
+	}
+}
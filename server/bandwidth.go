@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common/procfs"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+)
+
+const (
+	AccountingInterface = "interface"
+	AccountingProxy     = "proxy"
+)
+
+func GenerateBandwidthLimit() (l model.BandwidthLimit, err error) {
+	limit := config.ParamsObj.John.BandwidthLimit
+	if !limit.Enable {
+		return model.BandwidthLimit{}, nil
+	}
+	txKiB, rxKiB, err := TrafficKiB(limit)
+	if err != nil {
+		return model.BandwidthLimit{}, err
+	}
+	cycle, err := NewCycle(limit)
+	if err != nil {
+		return model.BandwidthLimit{}, err
+	}
+	l = model.BandwidthLimit{
+		ResetDay:         cycle.ResetDay(),
+		UplinkLimitGiB:   limit.UplinkLimitGiB,
+		DownlinkLimitGiB: limit.DownlinkLimitGiB,
+		TotalLimitGiB:    limit.TotalLimitGiB,
+		UplinkKiB:        txKiB,
+		DownlinkKiB:      rxKiB,
+	}
+	return l, nil
+}
+
+// PingResp is the response to the ping of SweetLisa.
+type PingResp struct {
+	model.PingResp
+	// NextResetTime is the time the bandwidth limit will be reset. Nil means never.
+	NextResetTime *time.Time `json:",omitempty"`
+	// PassagesVersion is the version of the passages of the group, with which SweetLisa detects the drift and
+	// syncs all passages again. Zero means unknown.
+	PassagesVersion uint64 `json:",omitempty"`
+}
+
+// GeneratePingResp returns the response to the ping from the manager of the group.
+func GeneratePingResp(s Server, group string) (resp PingResp, err error) {
+	resp.PassagesVersion = PassagesVersion(s, group)
+	resp.BandwidthLimit, err = GenerateBandwidthLimit()
+	if err != nil {
+		return PingResp{}, err
+	}
+	if limit := config.ParamsObj.John.BandwidthLimit; limit.Enable {
+		cycle, err := NewCycle(limit)
+		if err != nil {
+			return PingResp{}, err
+		}
+		if next := cycle.NextReset(time.Now()); !next.IsZero() {
+			resp.NextResetTime = &next
+		}
+	}
+	return resp, nil
+}
+
+// TrafficKiB returns the transmitted and received KiB counted in the way of the given limit.
+func TrafficKiB(limit config.BandwidthLimit) (txKiB int64, rxKiB int64, err error) {
+	switch limit.Accounting {
+	case AccountingProxy:
+		// Every relayed byte is received from one side and transmitted to the other side, but counted once as
+		// providers bill: bytes to users are transmitted and bytes from users are received, so that the total
+		// is the bytes relayed.
+		up, down := RelayedTraffic()
+		return down / 1024, up / 1024, nil
+	case AccountingInterface, "":
+	default:
+		return 0, 0, fmt.Errorf("unknown bandwidth accounting: %v", strconv.Quote(limit.Accounting))
+	}
+	txRxes, err := procfs.InterfacesTxRx()
+	if err != nil {
+		return 0, 0, err
+	}
+	txBytes, rxBytes := interfacesTraffic(limit, txRxes)
+	return txBytes / 1024, rxBytes / 1024, nil
+}
+
+// interfacesTraffic returns the transmitted and received bytes of the interfaces selected by the limit. The ones
+// excluded are never counted, and the biggest one of the others is taken if no interface is selected.
+func interfacesTraffic(limit config.BandwidthLimit, txRxes []procfs.TxRx) (txBytes int64, rxBytes int64) {
+	for _, txRx := range txRxes {
+		if matchInterface(limit.ExcludeInterfaces, txRx.InterfaceName) {
+			continue
+		}
+		if len(limit.Interfaces) > 0 {
+			// Sum up the selected interfaces.
+			if matchInterface(limit.Interfaces, txRx.InterfaceName) {
+				txBytes += txRx.TxBytes
+				rxBytes += txRx.RxBytes
+			}
+			continue
+		}
+		// Take the biggest one if no interface is selected.
+		if txRx.RxBytes > rxBytes {
+			rxBytes = txRx.RxBytes
+		}
+		if txRx.TxBytes > txBytes {
+			txBytes = txRx.TxBytes
+		}
+	}
+	return txBytes, rxBytes
+}
+
+// proxyAccounting reports whether the bandwidth limit counts the bytes relayed.
+func proxyAccounting() bool {
+	limit := config.ParamsObj.John.BandwidthLimit
+	return limit.Enable && limit.Accounting == AccountingProxy
+}
+
+func matchInterface(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
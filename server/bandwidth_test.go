@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common/procfs"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+func TestInterfacesTraffic(t *testing.T) {
+	txRxes := []procfs.TxRx{
+		{InterfaceName: "lo", TxBytes: 9000, RxBytes: 9000},
+		{InterfaceName: "eth0", TxBytes: 300, RxBytes: 100},
+		{InterfaceName: "eth1", TxBytes: 30, RxBytes: 500},
+		{InterfaceName: "docker0", TxBytes: 5000, RxBytes: 5000},
+		{InterfaceName: "wg0", TxBytes: 7, RxBytes: 7},
+	}
+	tt := []struct {
+		name    string
+		include []string
+		exclude []string
+		tx, rx  int64
+	}{
+		{name: "biggest of all", tx: 9000, rx: 9000},
+		{name: "biggest without excluded", exclude: []string{"lo", "docker*"}, tx: 300, rx: 500},
+		{name: "selected", include: []string{"eth0"}, tx: 300, rx: 100},
+		{name: "selected by glob", include: []string{"eth*"}, tx: 330, rx: 600},
+		{name: "excluded from selected", include: []string{"eth*", "wg*"}, exclude: []string{"eth1"}, tx: 307, rx: 107},
+		{name: "none matched", include: []string{"ens*"}},
+		{name: "bad pattern", include: []string{"["}},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			tx, rx := interfacesTraffic(config.BandwidthLimit{Interfaces: test.include, ExcludeInterfaces: test.exclude}, txRxes)
+			if tx != test.tx || rx != test.rx {
+				t.Errorf("got %v and %v, want %v and %v", tx, rx, test.tx, test.rx)
+			}
+		})
+	}
+}
+
+func TestTrafficKiB(t *testing.T) {
+	if _, _, err := TrafficKiB(config.BandwidthLimit{Accounting: "interfaces"}); err == nil {
+		t.Error("unknown accounting is accepted")
+	}
+
+	// every relayed byte is counted once
+	up, down := RelayedTraffic()
+	AddRelayedUp(3 * 1024)
+	AddRelayedDown(5 * 1024)
+	txKiB, rxKiB, err := TrafficKiB(config.BandwidthLimit{Accounting: AccountingProxy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txKiB != (down/1024)+5 || rxKiB != (up/1024)+3 {
+		t.Errorf("unexpected traffic of the proxy accounting: %v KiB transmitted and %v KiB received", txKiB, rxKiB)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestContentionCache(t *testing.T) {
+	c := NewContentionCache()
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	protectTime := ProtectTime[PassageUseManager]
+	if protectTime == 0 {
+		t.Fatal("the manager passage is not protected")
+	}
+	if accept, _ := c.Check("manager", protectTime, ip1); !accept {
+		t.Fatal("the first IP is rejected")
+	}
+	if accept, _ := c.Check("manager", protectTime, ip1); !accept {
+		t.Error("the same IP is rejected")
+	}
+	if accept, conflictIP := c.Check("manager", protectTime, ip2); accept || !conflictIP.Equal(ip1) {
+		t.Errorf("another IP is accepted in the protect time: %v, %v", accept, conflictIP)
+	}
+	// users are not protected
+	if accept, _ := c.Check("user", ProtectTime[PassageUseUser], ip1); !accept {
+		t.Error("the user is rejected")
+	}
+	if accept, _ := c.Check("user", ProtectTime[PassageUseUser], ip2); !accept {
+		t.Error("the user is rejected from another IP")
+	}
+
+	// another IP is accepted after the protect time
+	if accept, _ := c.Check("relay", 50*time.Millisecond, ip1); !accept {
+		t.Fatal("the first IP is rejected")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if accept, _ := c.Check("relay", 50*time.Millisecond, ip2); !accept {
+		t.Error("another IP is rejected after the protect time")
+	}
+}
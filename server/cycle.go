@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+const (
+	CycleMonthly = "monthly"
+	CycleDays    = "days"
+	CycleNever   = "never"
+)
+
+// Cycle is the billing cycle to reset the bandwidth limit.
+type Cycle struct {
+	typ    string
+	day    int
+	days   int
+	anchor time.Time
+	loc    *time.Location
+}
+
+func NewCycle(limit config.BandwidthLimit) (*Cycle, error) {
+	conf := limit.Cycle
+	c := &Cycle{
+		typ: conf.Type,
+		loc: time.Local,
+	}
+	if conf.Timezone != "" {
+		loc, err := time.LoadLocation(conf.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("bad timezone of cycle: %w", err)
+		}
+		c.loc = loc
+	}
+	if c.typ == "" {
+		if conf.Day != 0 || limit.ResetDay != 0 {
+			c.typ = CycleMonthly
+		} else {
+			c.typ = CycleNever
+		}
+	}
+	switch c.typ {
+	case CycleMonthly:
+		c.day = int(conf.Day)
+		if c.day == 0 {
+			c.day = int(limit.ResetDay)
+		}
+		if c.day < 1 || c.day > 31 {
+			return nil, fmt.Errorf("bad day of monthly cycle: %v", c.day)
+		}
+	case CycleDays:
+		if conf.Days <= 0 {
+			return nil, fmt.Errorf("bad days of cycle: %v", conf.Days)
+		}
+		c.days = conf.Days
+		anchor, err := time.ParseInLocation(time.DateOnly, conf.Anchor, c.loc)
+		if err != nil {
+			return nil, fmt.Errorf("bad anchor of cycle: %w", err)
+		}
+		c.anchor = anchor
+	case CycleNever:
+	default:
+		return nil, fmt.Errorf("unknown cycle type: %v", strconv.Quote(c.typ))
+	}
+	return c, nil
+}
+
+// LastReset returns the beginning of the cycle that now is in. Zero means never reset.
+func (c *Cycle) LastReset(now time.Time) time.Time {
+	now = now.In(c.loc)
+	switch c.typ {
+	case CycleMonthly:
+		t := c.monthDay(now.Year(), now.Month())
+		if now.Before(t) {
+			t = c.monthDay(now.Year(), now.Month()-1)
+		}
+		return t
+	case CycleDays:
+		// Estimate the index of the cycle and fix it up, for days may not be 24 hours around DST changes.
+		i := int(now.Sub(c.anchor).Hours()/24) / c.days
+		t := c.anchor.AddDate(0, 0, i*c.days)
+		for now.Before(t) {
+			i--
+			t = c.anchor.AddDate(0, 0, i*c.days)
+		}
+		for next := c.anchor.AddDate(0, 0, (i+1)*c.days); !now.Before(next); next = c.anchor.AddDate(0, 0, (i+1)*c.days) {
+			i++
+			t = next
+		}
+		return t
+	default:
+		return time.Time{}
+	}
+}
+
+// NextReset returns the end of the cycle that now is in. Zero means never reset.
+func (c *Cycle) NextReset(now time.Time) time.Time {
+	last := c.LastReset(now)
+	if last.IsZero() {
+		return time.Time{}
+	}
+	switch c.typ {
+	case CycleMonthly:
+		return c.monthDay(last.Year(), last.Month()+1)
+	case CycleDays:
+		return last.AddDate(0, 0, c.days)
+	default:
+		return time.Time{}
+	}
+}
+
+// ResetDay returns the day of monthly cycles for SweetLisa, which resets its counters on that day every month.
+// Zero is returned for the other cycles, whose resets SweetLisa learns from NextResetTime in ping responses.
+func (c *Cycle) ResetDay() time.Time {
+	if c.typ != CycleMonthly {
+		return time.Time{}
+	}
+	// 7th and 8th months have 31 days
+	return time.Date(2000, 7, c.day, 0, 0, 0, 0, c.loc)
+}
+
+// monthDay returns the reset time in the given month. The day is clamped to the end of the month.
+func (c *Cycle) monthDay(year int, month time.Month) time.Time {
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, c.loc).Day()
+	return time.Date(year, month, min(c.day, lastDay), 0, 0, 0, 0, c.loc)
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+func TestCycle_Monthly(t *testing.T) {
+	c, err := NewCycle(config.BandwidthLimit{
+		Cycle: config.BillingCycle{Day: 31, Timezone: "UTC"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := [][3]string{
+		// now, last reset, next reset
+		{"2023-02-15", "2023-01-31", "2023-02-28"},
+		{"2023-02-28", "2023-02-28", "2023-03-31"},
+		{"2024-02-29", "2024-02-29", "2024-03-31"},
+		{"2023-04-30", "2023-04-30", "2023-05-31"},
+		{"2023-01-01", "2022-12-31", "2023-01-31"},
+	}
+	for _, test := range tt {
+		now, _ := time.Parse(time.DateOnly, test[0])
+		now = now.Add(time.Hour)
+		if last := c.LastReset(now).Format(time.DateOnly); last != test[1] {
+			t.Error(test[0], "last reset", last, "should be", test[1])
+		}
+		if next := c.NextReset(now).Format(time.DateOnly); next != test[2] {
+			t.Error(test[0], "next reset", next, "should be", test[2])
+		}
+	}
+}
+
+func TestCycle_Days(t *testing.T) {
+	c, err := NewCycle(config.BandwidthLimit{
+		Cycle: config.BillingCycle{Type: CycleDays, Days: 30, Anchor: "2023-03-01", Timezone: "America/Los_Angeles"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	tt := [][3]string{
+		// now, last reset, next reset
+		{"2023-03-01", "2023-03-01", "2023-03-31"},
+		{"2023-03-30", "2023-03-01", "2023-03-31"},
+		{"2023-03-31", "2023-03-31", "2023-04-30"},
+		{"2023-11-27", "2023-11-26", "2023-12-26"},
+		{"2023-02-28", "2023-01-30", "2023-03-01"},
+	}
+	for _, test := range tt {
+		now, _ := time.ParseInLocation(time.DateOnly, test[0], loc)
+		if last := c.LastReset(now).Format(time.DateOnly); last != test[1] {
+			t.Error(test[0], "last reset", last, "should be", test[1])
+		}
+		if next := c.NextReset(now).Format(time.DateOnly); next != test[2] {
+			t.Error(test[0], "next reset", next, "should be", test[2])
+		}
+	}
+}
+
+func TestCycle_Never(t *testing.T) {
+	c, err := NewCycle(config.BandwidthLimit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.LastReset(time.Now()).IsZero() || !c.NextReset(time.Now()).IsZero() {
+		t.Fatal("should never reset")
+	}
+}
+
+func TestCycle_ResetDay(t *testing.T) {
+	tt := []struct {
+		limit config.BandwidthLimit
+		day   int
+	}{
+		{config.BandwidthLimit{ResetDay: 15}, 15},
+		// the day is not clamped to the month of the next reset
+		{config.BandwidthLimit{Cycle: config.BillingCycle{Day: 31}}, 31},
+		{config.BandwidthLimit{Cycle: config.BillingCycle{Type: CycleDays, Days: 30, Anchor: "2023-03-01"}}, 0},
+		// the legacy day is ignored if the cycle never resets
+		{config.BandwidthLimit{ResetDay: 15, Cycle: config.BillingCycle{Type: CycleNever}}, 0},
+	}
+	for _, test := range tt {
+		c, err := NewCycle(test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resetDay := c.ResetDay()
+		if test.day == 0 {
+			if !resetDay.IsZero() {
+				t.Errorf("%+v: reset day should be zero: %v", test.limit, resetDay)
+			}
+		} else if resetDay.Day() != test.day {
+			t.Errorf("%+v: reset day %v should be %v", test.limit, resetDay.Day(), test.day)
+		}
+	}
+}
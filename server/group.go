@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+// Group is a SweetLisa instance the node registers at. Each group has its own ticket, manager passage and passages,
+// and Passage.Group is the ticket of the group the passage belongs to.
+type Group struct {
+	Lisa   config.Lisa
+	Ticket string
+}
+
+// Groups returns the group of sweetLisa and arg.Ticket followed by arg.Groups.
+func Groups(sweetLisa config.Lisa, arg Argument) []Group {
+	return append([]Group{{Lisa: sweetLisa, Ticket: arg.Ticket}}, arg.Groups...)
+}
+
+// ConfigGroups returns the extra groups in the config.
+func ConfigGroups(conf *config.Params) (groups []Group, err error) {
+	tickets := map[string]struct{}{conf.John.Ticket: {}}
+	for _, g := range conf.John.Groups {
+		if g.Host == "" || g.Ticket == "" {
+			return nil, fmt.Errorf("both the host and the ticket of a group are required")
+		}
+		if _, ok := tickets[g.Ticket]; ok {
+			return nil, fmt.Errorf("duplicate ticket of groups: %v", log.Opaque(g.Ticket))
+		}
+		tickets[g.Ticket] = struct{}{}
+		lisa := conf.Lisa
+		lisa.Host = g.Host
+		groups = append(groups, Group{Lisa: lisa, Ticket: g.Ticket})
+	}
+	return groups, nil
+}
+
+// Registration is the state of the node registered at a group.
+type Registration struct {
+	Group
+	mu        sync.Mutex
+	lastAlive time.Time
+}
+
+func NewRegistrations(groups []Group) []*Registration {
+	regs := make([]*Registration, len(groups))
+	for i, g := range groups {
+		regs[i] = &Registration{Group: g}
+	}
+	return regs
+}
+
+// Alive records that SweetLisa of the group was seen.
+func (r *Registration) Alive() {
+	r.mu.Lock()
+	r.lastAlive = time.Now()
+	r.mu.Unlock()
+}
+
+// Forget makes the group registered again as soon as possible.
+func (r *Registration) Forget() {
+	r.mu.Lock()
+	r.lastAlive = time.Time{}
+	r.mu.Unlock()
+}
+
+// Registered reports whether the node has registered at the group since it was forgotten.
+func (r *Registration) Registered() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.lastAlive.IsZero()
+}
+
+// LastAlive returns the last time SweetLisa of the group was seen, including heartbeats.
+func (r *Registration) LastAlive() time.Time {
+	r.mu.Lock()
+	lastAlive := r.lastAlive
+	r.mu.Unlock()
+	return LastSeen(r.Ticket, lastAlive)
+}
+
+// FindRegistration returns the registration of the group, or nil if not found.
+func FindRegistration(regs []*Registration, group string) *Registration {
+	for _, r := range regs {
+		if r.Ticket == group {
+			return r
+		}
+	}
+	return nil
+}
+
+// OldestAlive returns the earliest LastAlive of the registrations, which is zero if any group is not registered.
+func OldestAlive(regs []*Registration) (oldest time.Time) {
+	for i, r := range regs {
+		lastAlive := r.LastAlive()
+		if lastAlive.IsZero() {
+			return time.Time{}
+		}
+		if i == 0 || lastAlive.Before(oldest) {
+			oldest = lastAlive
+		}
+	}
+	return oldest
+}
+
+// ManagerOf returns the manager passage of the group.
+func ManagerOf(passages []Passage, group string) (manager Passage) {
+	for _, p := range passages {
+		if p.Manager && p.Group == group && p.RetireAt.IsZero() {
+			return p
+		}
+	}
+	return Passage{}
+}
+
+// InGroup sets the group of the passages.
+func InGroup(group string, passages []Passage) []Passage {
+	for i := range passages {
+		passages[i].Group = group
+	}
+	return passages
+}
+
+// PassageKey identifies the passage in its group, so that the same credentials can be used in different groups.
+func PassageKey(p *Passage) string {
+	return p.Group + "|" + p.In.Argument.Hash()
+}
+
+// LisaOf returns SweetLisa of the group, which is used to relay the passages of the group.
+func LisaOf(regs []*Registration, group string) *config.Lisa {
+	if r := FindRegistration(regs, group); r != nil {
+		return &r.Lisa
+	}
+	return &config.Lisa{}
+}
+
+// RegisterAll registers at the groups by register, or at every group if none is given, and returns the errors
+// joined. Groups withdrawn are skipped until their CDN validation passes.
+func RegisterAll(regs []*Registration, register func(r *Registration) error, groups ...string) error {
+	var errs []error
+	for _, r := range regs {
+		if Withdrawn(r.Ticket) || (len(groups) > 0 && !slices.Contains(groups, r.Ticket)) {
+			continue
+		}
+		if err := register(r); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", r.Lisa.Host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RegisterFirst registers at every group when the server starts. Only the error of the primary group is returned,
+// and the other groups failed are left to register in the background, so that a SweetLisa down does not stop the
+// node from serving the others.
+func RegisterFirst(regs []*Registration, register func(r *Registration) error) error {
+	if len(regs) == 0 {
+		return nil
+	}
+	if err := RegisterAll(regs[:1], register); err != nil {
+		return err
+	}
+	if err := RegisterAll(regs[1:], register); err != nil {
+		log.Warn("Failed to register at some groups. Retry in the background: %v", err)
+	}
+	return nil
+}
+
+// Pinged records a ping from SweetLisa of the group.
+func Pinged(regs []*Registration, group string) error {
+	r := FindRegistration(regs, group)
+	if r == nil {
+		return fmt.Errorf("ping from the manager of an unknown group")
+	}
+	r.Alive()
+	ReceivedPing(group)
+	return nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+func TestSyncGroupPassages(t *testing.T) {
+	s := &fakeServer{}
+	managers := []Passage{testPassage("manager1", true), testPassage("manager2", true)}
+	managers[0].Group, managers[1].Group = "ticket1", "ticket2"
+	if err := s.AddPassages(managers); err != nil {
+		t.Fatal(err)
+	}
+	// the same credentials can be used in both groups
+	if err := SyncGroupPassages(s, "ticket1", []Passage{testPassage("user1", false), testPassage("shared", false)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncGroupPassages(s, "ticket2", []Passage{testPassage("user2", false), testPassage("shared", false)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countUsers(s.Passages()); n != 4 {
+		t.Fatalf("unexpected users after syncing both groups: %v", n)
+	}
+
+	if err := SyncGroupPassages(s, "ticket1", nil); err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	for _, p := range s.Passages() {
+		if !p.Manager {
+			if p.Group != "ticket2" {
+				t.Errorf("passage of %v is kept after its group is emptied", p.Group)
+			}
+			users = append(users, p.In.Password)
+		}
+	}
+	if len(users) != 2 || len(s.Passages()) != 4 {
+		t.Errorf("unexpected passages after emptying a group: %v of %v", users, len(s.Passages()))
+	}
+	if m := ManagerOf(s.Passages(), "ticket1"); m.In.Password != "manager1" {
+		t.Errorf("unexpected manager of the emptied group: %v", m.In.Password)
+	}
+}
+
+func TestRegistrations(t *testing.T) {
+	resetHeartbeat()
+	defer resetHeartbeat()
+	regs := NewRegistrations(Groups(config.Lisa{Host: "lisa1"}, Argument{
+		Ticket: "ticket1",
+		Groups: []Group{{Lisa: config.Lisa{Host: "lisa2"}, Ticket: "ticket2"}},
+	}))
+	if len(regs) != 2 || regs[1].Lisa.Host != "lisa2" {
+		t.Fatalf("unexpected registrations: %v", regs)
+	}
+	if err := Pinged(regs, "ticket1"); err != nil {
+		t.Fatal(err)
+	}
+	if !OldestAlive(regs).IsZero() {
+		t.Error("registered before every group is")
+	}
+	if err := Pinged(regs, "unknown"); err == nil {
+		t.Error("ping from an unknown group is accepted")
+	}
+	before := time.Now()
+	regs[1].Alive()
+	if oldest := OldestAlive(regs); oldest.IsZero() || !oldest.Before(before) {
+		t.Errorf("unexpected oldest alive: %v", oldest)
+	}
+	regs[0].Forget()
+	if regs[0].Registered() || !OldestAlive(regs).IsZero() {
+		t.Error("the forgotten group is still registered")
+	}
+	if LisaOf(regs, "ticket2").Host != "lisa2" {
+		t.Error("unexpected SweetLisa of the group")
+	}
+}
+
+func TestConfigGroups(t *testing.T) {
+	conf := &config.Params{Lisa: config.Lisa{Host: "lisa1", Client: config.LisaClient{TimeoutSec: 10}}}
+	conf.John.Ticket = "ticket1"
+	conf.John.Groups = []config.Group{{Host: "lisa2", Ticket: "ticket2"}}
+	groups, err := ConfigGroups(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Lisa.Host != "lisa2" || groups[0].Lisa.Client.TimeoutSec != 10 {
+		t.Errorf("unexpected groups: %+v", groups)
+	}
+	for _, g := range [][]config.Group{
+		{{Host: "lisa2", Ticket: "ticket1"}},
+		{{Host: "lisa2"}},
+		{{Host: "lisa2", Ticket: "ticket2"}, {Host: "lisa3", Ticket: "ticket2"}},
+	} {
+		conf.John.Groups = g
+		if _, err = ConfigGroups(conf); err == nil {
+			t.Errorf("%+v should be rejected", g)
+		}
+	}
+}
+
+func TestRegisterFirst(t *testing.T) {
+	regs := NewRegistrations([]Group{{Ticket: "ticket1"}, {Ticket: "ticket2"}, {Ticket: "ticket3"}})
+	var registered []string
+	register := func(failing string) func(r *Registration) error {
+		return func(r *Registration) error {
+			registered = append(registered, r.Ticket)
+			if r.Ticket == failing {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+	}
+	// failures of other groups are left to the background
+	if err := RegisterFirst(regs, register("ticket2")); err != nil {
+		t.Errorf("failure of another group is returned: %v", err)
+	}
+	if len(registered) != 3 {
+		t.Errorf("unexpected groups registered: %v", registered)
+	}
+	if err := RegisterFirst(regs, register("ticket1")); err == nil {
+		t.Error("failure of the primary group is not returned")
+	}
+
+	registered = nil
+	if err := RegisterAll(regs, register(""), "ticket3"); err != nil || len(registered) != 1 || registered[0] != "ticket3" {
+		t.Errorf("unexpected groups registered: %v, %v", registered, err)
+	}
+}
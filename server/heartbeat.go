@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+)
+
+const (
+	// HeartbeatModeAuto sends heartbeats only while pings from SweetLisa do not arrive.
+	HeartbeatModeAuto = "auto"
+	// HeartbeatModePush only waits for pings from SweetLisa.
+	HeartbeatModePush = "push"
+	// HeartbeatModePull always sends heartbeats to SweetLisa.
+	HeartbeatModePull = "pull"
+
+	DefaultHeartbeatInterval    = time.Minute
+	DefaultHeartbeatPushTimeout = 2 * time.Minute
+)
+
+// ErrHeartbeatUnsupported means SweetLisa does not accept heartbeats.
+var ErrHeartbeatUnsupported = fmt.Errorf("SweetLisa does not support heartbeats")
+
+// HeartbeatReq is sent to SweetLisa in the pull mode.
+type HeartbeatReq struct {
+	PingResp
+	Sessions int
+}
+
+// HeartbeatResp is the response of SweetLisa to a heartbeat.
+type HeartbeatResp struct {
+	// Passages are the passages to sync. Nil means unchanged.
+	Passages []model.Passage `json:",omitempty"`
+}
+
+// SendHeartbeat sends the heartbeat to SweetLisa.
+type SendHeartbeat func(ctx context.Context, req HeartbeatReq) (*HeartbeatResp, error)
+
+var (
+	muHeartbeat sync.Mutex
+	// lastPing and lastHeartbeat are keyed by the group
+	lastPing      = make(map[string]time.Time)
+	lastHeartbeat = make(map[string]time.Time)
+)
+
+// ReceivedPing should be called when a ping from SweetLisa of the group is received.
+func ReceivedPing(group string) {
+	muHeartbeat.Lock()
+	lastPing[group] = time.Now()
+	muHeartbeat.Unlock()
+}
+
+// LastHeartbeat returns the time of the last heartbeat accepted by SweetLisa of the group.
+func LastHeartbeat(group string) time.Time {
+	muHeartbeat.Lock()
+	defer muHeartbeat.Unlock()
+	return lastHeartbeat[group]
+}
+
+// LastSeen returns the later one of lastAlive and the last heartbeat of the group.
+func LastSeen(group string, lastAlive time.Time) time.Time {
+	if t := LastHeartbeat(group); t.After(lastAlive) {
+		return t
+	}
+	return lastAlive
+}
+
+type heartbeater struct {
+	server      Server
+	group       string
+	send        SendHeartbeat
+	mode        string
+	interval    time.Duration
+	pushTimeout time.Duration
+	start       time.Time
+
+	pulling bool
+	// unsupportedUntil is the time to try heartbeats again after SweetLisa did not support them
+	unsupportedUntil time.Time
+}
+
+func newHeartbeater(s Server, group string, conf config.Heartbeat, send SendHeartbeat) (*heartbeater, error) {
+	h := &heartbeater{
+		server:      s,
+		group:       group,
+		send:        send,
+		mode:        conf.Mode,
+		interval:    DefaultHeartbeatInterval,
+		pushTimeout: DefaultHeartbeatPushTimeout,
+		start:       time.Now(),
+	}
+	switch h.mode {
+	case "":
+		h.mode = HeartbeatModeAuto
+	case HeartbeatModeAuto, HeartbeatModePush, HeartbeatModePull:
+	default:
+		return nil, fmt.Errorf("invalid heartbeat mode: %v", conf.Mode)
+	}
+	if conf.IntervalSec > 0 {
+		h.interval = time.Duration(conf.IntervalSec) * time.Second
+	}
+	if conf.PushTimeoutSec > 0 {
+		h.pushTimeout = time.Duration(conf.PushTimeoutSec) * time.Second
+	}
+	return h, nil
+}
+
+// RunHeartbeat sends heartbeats to SweetLisa of the group at intervals according to the mode until done is closed.
+func RunHeartbeat(done <-chan error, s Server, group string, conf config.Heartbeat, send SendHeartbeat) error {
+	h, err := newHeartbeater(s, group, conf, send)
+	if err != nil {
+		return err
+	}
+	if h.mode == HeartbeatModePush {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				h.tick(now)
+			}
+		}
+	}()
+	return nil
+}
+
+// shouldPull reports whether a heartbeat should be sent now.
+func (h *heartbeater) shouldPull(now time.Time) bool {
+	if Withdrawn(h.group) {
+		// SweetLisa should take the node as offline
+		return false
+	}
+	if now.Before(h.unsupportedUntil) {
+		return false
+	}
+	if h.mode == HeartbeatModePull {
+		return true
+	}
+	muHeartbeat.Lock()
+	since := lastPing[h.group]
+	muHeartbeat.Unlock()
+	pushing := !since.IsZero() && now.Sub(since) < h.pushTimeout
+	if since.IsZero() {
+		since = h.start
+	}
+	switch {
+	case pushing && h.pulling:
+		h.pulling = false
+		log.Alert("Pings from SweetLisa arrive again. Stop sending heartbeats")
+	case !pushing && !h.pulling && now.Sub(since) >= h.pushTimeout:
+		h.pulling = true
+		log.Warn("No ping from SweetLisa in %v. Send heartbeats instead", h.pushTimeout)
+	}
+	return h.pulling
+}
+
+func (h *heartbeater) tick(now time.Time) {
+	if !h.shouldPull(now) {
+		return
+	}
+	if err := h.beat(now); err != nil {
+		if errors.Is(err, ErrHeartbeatUnsupported) {
+			// Keep waiting for pings, and re-registering takes over if they do not come.
+			h.unsupportedUntil = now.Add(10 * h.interval)
+		}
+		log.Warn("heartbeat: %v", err)
+	}
+}
+
+func (h *heartbeater) beat(now time.Time) error {
+	pingResp, err := GeneratePingResp(h.server, h.group)
+	if err != nil {
+		return err
+	}
+	req := HeartbeatReq{PingResp: pingResp}
+	RangeSessions(func(s *Session) {
+		req.Sessions++
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	resp, err := h.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	muHeartbeat.Lock()
+	lastHeartbeat[h.group] = now
+	muHeartbeat.Unlock()
+	log.Trace("Sent a heartbeat")
+	if resp == nil || resp.Passages == nil {
+		return nil
+	}
+	passages := make([]Passage, 0, len(resp.Passages))
+	for _, p := range resp.Passages {
+		passages = append(passages, Passage{Passage: p})
+	}
+	// the manager is kept as it is in registering
+	return SyncGroupPassages(h.server, h.group, passages)
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+)
+
+func resetHeartbeat() {
+	muHeartbeat.Lock()
+	lastPing, lastHeartbeat = make(map[string]time.Time), make(map[string]time.Time)
+	muHeartbeat.Unlock()
+}
+
+func TestHeartbeatAuto(t *testing.T) {
+	resetHeartbeat()
+	defer resetHeartbeat()
+	s := &fakeServer{}
+	other := testPassage("other", false)
+	other.Group = "other"
+	if err := s.SyncPassages(InGroup("ticket", []Passage{testPassage("manager", true)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddPassages([]Passage{other}); err != nil {
+		t.Fatal(err)
+	}
+	var sent int
+	resp := &HeartbeatResp{}
+	h, err := newHeartbeater(s, "ticket", config.Heartbeat{IntervalSec: 60, PushTimeoutSec: 120}, func(ctx context.Context, req HeartbeatReq) (*HeartbeatResp, error) {
+		sent++
+		return resp, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := h.start
+
+	// pings have not arrived yet since the start
+	h.tick(now.Add(time.Minute))
+	if sent != 0 {
+		t.Fatal("heartbeats are sent before the push timeout")
+	}
+	h.tick(now.Add(2 * time.Minute))
+	if sent != 1 || !LastHeartbeat("ticket").Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("no heartbeat is sent after the push timeout: %v sent", sent)
+	}
+	if n := countUsers(s.Passages()); n != 1 {
+		t.Errorf("passages are changed by a response without passages: %v users", n)
+	}
+
+	// passages in the response are synced, and the manager and passages of other groups are kept
+	resp.Passages = []model.Passage{testPassage("user1", false).Passage, testPassage("user2", false).Passage}
+	h.tick(now.Add(3 * time.Minute))
+	if n := countUsers(s.Passages()); n != 3 || len(s.Passages()) != 4 {
+		t.Errorf("unexpected passages after the heartbeat: %v users of %v", n, len(s.Passages()))
+	}
+
+	// pings arrive again
+	ReceivedPing("ticket")
+	h.tick(time.Now())
+	if sent != 2 || h.pulling {
+		t.Errorf("heartbeats are still sent while pings arrive: %v sent", sent)
+	}
+}
+
+func TestHeartbeatUnsupported(t *testing.T) {
+	resetHeartbeat()
+	defer resetHeartbeat()
+	var sent int
+	h, err := newHeartbeater(&fakeServer{}, "ticket", config.Heartbeat{Mode: HeartbeatModePull}, func(ctx context.Context, req HeartbeatReq) (*HeartbeatResp, error) {
+		sent++
+		return nil, ErrHeartbeatUnsupported
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := h.start
+	h.tick(now)
+	if sent != 1 || !LastHeartbeat("ticket").IsZero() {
+		t.Fatalf("unexpected heartbeats: %v sent", sent)
+	}
+	// the unsupported SweetLisa is tried again later
+	for i := 1; i < 10; i++ {
+		h.tick(now.Add(time.Duration(i) * DefaultHeartbeatInterval))
+	}
+	if sent != 1 {
+		t.Errorf("heartbeats are sent to the unsupported SweetLisa: %v sent", sent)
+	}
+	h.tick(now.Add(10 * DefaultHeartbeatInterval))
+	if sent != 2 {
+		t.Errorf("heartbeats are not tried again: %v sent", sent)
+	}
+
+	if _, err = newHeartbeater(&fakeServer{}, "ticket", config.Heartbeat{Mode: "poll"}, nil); err == nil {
+		t.Error("invalid mode is accepted")
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	jsoniter "github.com/json-iterator/go"
+)
+
+type Event string
+
+const (
+	EventSweetLisaLost       Event = "sweetlisa_lost"
+	EventSweetLisaRecovered  Event = "sweetlisa_recovered"
+	EventCDNCanStealIP       Event = "cdn_can_steal_ip"
+	EventQuotaNearExhaustion Event = "quota_near_exhaustion"
+	EventQuotaExhausted      Event = "quota_exhausted"
+	EventCertRenewed         Event = "cert_renewed"
+	EventCertRenewalFailed   Event = "cert_renewal_failed"
+	EventPassagesChanged     Event = "passages_changed"
+	EventWithdrawn           Event = "withdrawn"
+	EventResumed             Event = "resumed"
+)
+
+var Events = []Event{
+	EventSweetLisaLost,
+	EventSweetLisaRecovered,
+	EventCDNCanStealIP,
+	EventQuotaNearExhaustion,
+	EventQuotaExhausted,
+	EventCertRenewed,
+	EventCertRenewalFailed,
+	EventPassagesChanged,
+	EventWithdrawn,
+	EventResumed,
+}
+
+const (
+	DefaultHookTimeout     = 10 * time.Second
+	DefaultHookMinInterval = time.Minute
+)
+
+// hookRetryInterval is the interval before the first retry, which doubles for every retry.
+var hookRetryInterval = 2 * time.Second
+
+// HookEvent is posted to URLs and written to stdin of commands as JSON.
+type HookEvent struct {
+	Event   Event
+	Time    time.Time
+	Node    string
+	Message string
+	Data    interface{} `json:",omitempty"`
+}
+
+type hook struct {
+	config.Hook
+	events map[Event]struct{}
+
+	mu sync.Mutex
+	// lastRun is the time of the last run for every event to limit the rate
+	lastRun map[Event]time.Time
+}
+
+var (
+	hooks atomic.Pointer[[]*hook]
+	// runningHooks tracks the running hooks to wait for them before exiting
+	runningHooks sync.WaitGroup
+)
+
+// InitHooks validates and sets the hooks.
+func InitHooks(conf []config.Hook) error {
+	var hs []*hook
+	for i, c := range conf {
+		if c.URL == "" && c.Command == "" {
+			return fmt.Errorf("hook %v: url or command is required", i)
+		}
+		h := &hook{Hook: c, events: make(map[Event]struct{}), lastRun: make(map[Event]time.Time)}
+		for _, e := range c.Events {
+			if !common.StringsHas(eventNames(), e) {
+				return fmt.Errorf("hook %v: unknown event: %v", i, e)
+			}
+			h.events[Event(e)] = struct{}{}
+		}
+		hs = append(hs, h)
+	}
+	hooks.Store(&hs)
+	return nil
+}
+
+func eventNames() []string {
+	names := make([]string, len(Events))
+	for i, e := range Events {
+		names[i] = string(e)
+	}
+	return names
+}
+
+// Emit runs the hooks of the event in the background. The message should be redacted already.
+func Emit(event Event, message string, data interface{}) {
+	hs := hooks.Load()
+	if hs == nil {
+		return
+	}
+	e := HookEvent{
+		Event:   event,
+		Time:    time.Now(),
+		Node:    config.ParamsObj.John.Name,
+		Message: message,
+		Data:    data,
+	}
+	for _, h := range *hs {
+		if !h.match(event) || !h.allow(event, e.Time) {
+			continue
+		}
+		runningHooks.Add(1)
+		go func(h *hook) {
+			defer runningHooks.Done()
+			if err := h.run(e); err != nil {
+				log.With("event", string(event)).Warn("hook: %v", err)
+			}
+		}(h)
+	}
+}
+
+// WaitHooks waits for the running hooks until the timeout.
+func WaitHooks(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		runningHooks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+func (h *hook) match(event Event) bool {
+	if len(h.events) == 0 {
+		return true
+	}
+	_, ok := h.events[event]
+	return ok
+}
+
+// allow reports whether the hook can run for the event now, and records the run if so.
+func (h *hook) allow(event Event, now time.Time) bool {
+	minInterval := DefaultHookMinInterval
+	if h.MinIntervalSec < 0 {
+		return true
+	} else if h.MinIntervalSec > 0 {
+		minInterval = time.Duration(h.MinIntervalSec) * time.Second
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if last, ok := h.lastRun[event]; ok && now.Sub(last) < minInterval {
+		return false
+	}
+	h.lastRun[event] = now
+	return true
+}
+
+// run runs the hook for the event with retries.
+func (h *hook) run(e HookEvent) (err error) {
+	b, err := jsoniter.Marshal(e)
+	if err != nil {
+		return err
+	}
+	timeout := DefaultHookTimeout
+	if h.TimeoutSec > 0 {
+		timeout = time.Duration(h.TimeoutSec) * time.Second
+	}
+	interval := hookRetryInterval
+	for i := 0; ; i++ {
+		err = h.attempt(e.Event, b, timeout)
+		if err == nil || i >= h.Retries {
+			return err
+		}
+		log.With("event", string(e.Event)).Debug("hook: %v. retry in %v", err, interval)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+func (h *hook) attempt(event Event, body []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if h.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range h.Header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("POST %v: unexpected status: %v", h.URL, resp.Status)
+		}
+	}
+	if h.Command != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(), "BITTERJOHN_EVENT="+string(event))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("command: %w: %v", err, string(bytes.TrimSpace(out)))
+		}
+	}
+	return nil
+}
+
+// LostTracker emits events when the connection with SweetLisa is lost and recovered.
+type LostTracker struct {
+	lost bool
+}
+
+// Lost should be called when no message from SweetLisa is received for LostThreshold.
+func (t *LostTracker) Lost(lastAlive time.Time) {
+	if t.lost || lastAlive.IsZero() {
+		return
+	}
+	t.lost = true
+	Emit(EventSweetLisaLost, fmt.Sprintf("no message from SweetLisa since %v", lastAlive.Format(time.RFC3339)), nil)
+}
+
+// Registered should be called when registering succeeds.
+func (t *LostTracker) Registered() {
+	if !t.lost {
+		return
+	}
+	t.lost = false
+	Emit(EventSweetLisaRecovered, "registered to SweetLisa again", nil)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+// hookStandIn is a local HTTP server receiving events. It fails the first failures requests.
+type hookStandIn struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	events   []HookEvent
+	headers  []http.Header
+	attempts int
+}
+
+func newHookStandIn(failures int) *hookStandIn {
+	s := &hookStandIn{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.attempts++
+		if s.attempts <= s.failures {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var e HookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.events = append(s.events, e)
+		s.headers = append(s.headers, r.Header.Clone())
+	}))
+	return s
+}
+
+func (s *hookStandIn) received() ([]HookEvent, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]HookEvent(nil), s.events...), s.attempts
+}
+
+func setupHooks(t *testing.T, hooks ...config.Hook) {
+	t.Helper()
+	interval := hookRetryInterval
+	hookRetryInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		hookRetryInterval = interval
+		_ = InitHooks(nil)
+	})
+	if err := InitHooks(hooks); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHookPostWithRetries(t *testing.T) {
+	standIn := newHookStandIn(2)
+	defer standIn.Close()
+	setupHooks(t, config.Hook{
+		URL:     standIn.URL,
+		Header:  map[string]string{"Authorization": "Bearer token"},
+		Retries: 2,
+	})
+
+	Emit(EventSweetLisaLost, "no message from SweetLisa", nil)
+	WaitHooks(5 * time.Second)
+
+	events, attempts := standIn.received()
+	if attempts != 3 || len(events) != 1 {
+		t.Fatalf("attempts: %v, events: %v", attempts, events)
+	}
+	if events[0].Event != EventSweetLisaLost || events[0].Message != "no message from SweetLisa" || events[0].Time.IsZero() {
+		t.Errorf("unexpected event: %+v", events[0])
+	}
+	if got := standIn.headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("unexpected Authorization: %v", got)
+	}
+}
+
+func TestHookGivesUp(t *testing.T) {
+	standIn := newHookStandIn(10)
+	defer standIn.Close()
+	setupHooks(t, config.Hook{URL: standIn.URL, Retries: 1})
+
+	Emit(EventQuotaExhausted, "exhausted", nil)
+	WaitHooks(5 * time.Second)
+	if events, attempts := standIn.received(); attempts != 2 || len(events) != 0 {
+		t.Errorf("attempts: %v, events: %v", attempts, events)
+	}
+}
+
+func TestHookRateLimitAndFilter(t *testing.T) {
+	standIn := newHookStandIn(0)
+	defer standIn.Close()
+	setupHooks(t, config.Hook{
+		URL:    standIn.URL,
+		Events: []string{string(EventPassagesChanged), string(EventCertRenewed)},
+	})
+
+	for i := 0; i < 5; i++ {
+		Emit(EventPassagesChanged, "changed", PassagesChange{Added: i})
+	}
+	Emit(EventCertRenewed, "renewed", nil)
+	Emit(EventSweetLisaLost, "not subscribed", nil)
+	WaitHooks(5 * time.Second)
+
+	events, _ := standIn.received()
+	var names []string
+	for _, e := range events {
+		names = append(names, string(e.Event))
+	}
+	if len(events) != 2 || !strings.Contains(strings.Join(names, ","), string(EventPassagesChanged)) ||
+		!strings.Contains(strings.Join(names, ","), string(EventCertRenewed)) {
+		t.Errorf("unexpected events: %v", names)
+	}
+}
+
+func TestHookCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "event")
+	setupHooks(t, config.Hook{
+		Command:        `{ echo "$BITTERJOHN_EVENT"; cat; } > ` + out,
+		MinIntervalSec: -1,
+	})
+
+	Emit(EventCDNCanStealIP, "the CDN can steal IP", nil)
+	WaitHooks(5 * time.Second)
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, body, _ := strings.Cut(string(b), "\n")
+	if event != string(EventCDNCanStealIP) {
+		t.Errorf("unexpected BITTERJOHN_EVENT: %v", event)
+	}
+	var e HookEvent
+	if err = json.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Event != EventCDNCanStealIP || e.Message != "the CDN can steal IP" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func TestInitHooks(t *testing.T) {
+	defer InitHooks(nil)
+	if err := InitHooks([]config.Hook{{Events: []string{"sweetlisa_lost"}}}); err == nil {
+		t.Error("hooks without url or command should be rejected")
+	}
+	if err := InitHooks([]config.Hook{{URL: "http://127.0.0.1", Events: []string{"unknown"}}}); err == nil {
+		t.Error("unknown events should be rejected")
+	}
+}
@@ -17,7 +17,6 @@ import (
 
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
 	jsoniter "github.com/json-iterator/go"
 
 	"github.com/daeuniverse/softwind/netproxy"
@@ -101,7 +100,7 @@ func (s *Server) Serve(addr string) (err error) {
 				if errors.As(err, &netError) && netError.Timeout() {
 					return // ignore i/o timeout
 				}
-				log.Warn("%v", err)
+				log.With("protocol", string(protocol.ProtocolJuicity)).WithError(err).Warn("%v", err)
 			}
 		}(conn)
 	}
@@ -116,7 +115,7 @@ func (s *Server) handleConn(conn quic.Connection) (err error) {
 	var id uuid.UUID
 	go func() {
 		if _id, err := s.handleAuth(ctx, conn); err != nil {
-			log.Warn("handleAuth: %v", err)
+			log.With("protocol", string(protocol.ProtocolJuicity)).WithError(err).Warn("handleAuth: %v", err)
 			cancel()
 			_ = conn.CloseWithError(tuic.AuthenticationFailed, "")
 		} else {
@@ -130,14 +129,19 @@ func (s *Server) handleConn(conn quic.Connection) (err error) {
 			return err
 		}
 		go func(stream quic.Stream) {
-			if err = s.handleStream(ctx, authCtx, &id, conn, stream); err != nil {
-				log.Warn("handleStream: %v", err)
+			info := server.SessionInfo{
+				ID:       server.NewConnID(),
+				Protocol: string(protocol.ProtocolJuicity),
+				Source:   conn.RemoteAddr().String(),
+			}
+			if err := s.handleStream(ctx, authCtx, &id, conn, stream, &info); err != nil {
+				info.Logger().WithError(err).Warn("handleStream: %v", err)
 			}
 		}(stream)
 	}
 }
 
-func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *uuid.UUID, conn quic.Connection, stream quic.Stream) error {
+func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *uuid.UUID, conn quic.Connection, stream quic.Stream, info *server.SessionInfo) error {
 	defer stream.Close()
 	lConn := juicity.NewConn(stream, nil, nil)
 	// Read the header and initiate the metadata
@@ -157,6 +161,7 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *
 		return fmt.Errorf("no such user: %v", *id)
 	}
 	passage := _passage.(*Passage)
+	info.Passage = &passage.Passage
 	if err := s.ContentionCheck(conn.RemoteAddr().(*net.UDPAddr).IP, passage); err != nil {
 		return err
 	}
@@ -168,9 +173,12 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *
 	if passage.Manager {
 		return fmt.Errorf("%w: manager key is ubused for a non-cmd connection", server.ErrPassageAbuse)
 	}
+	if err := server.CheckServing(&passage.Passage); err != nil {
+		return err
+	}
 	dialer := s.dialer
 	if passage.Out != nil {
-		header, err := server.GetHeader(*passage.Out, &s.sweetLisa)
+		header, err := server.GetHeader(*passage.Out, server.LisaOf(s.registrations, passage.Group))
 		if err != nil {
 			return err
 		}
@@ -180,6 +188,8 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *
 		}
 	}
 	target := net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port)))
+	info.Network = mdata.Network
+	info.Target = target
 	d := &netproxy.ContextDialerConverter{
 		Dialer: dialer,
 	}
@@ -187,17 +197,22 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *
 	defer cancel()
 	switch mdata.Network {
 	case "tcp":
+		dialStart := time.Now()
 		rConn, err := d.DialContext(ctx, "tcp", target)
+		server.ObserveDial(string(protocol.ProtocolJuicity), "tcp", dialStart, err)
+		info.Logger().Trace("dial: %v", time.Since(dialStart))
 		if err != nil {
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
-				log.Debug("%v", err)
+				info.Logger().WithError(err).Debug("%v", err)
 				return nil // ignore i/o timeout
 			}
 			return err
 		}
 		defer rConn.Close()
-		if err = server.RelayTCP(lConn, rConn); err != nil {
+		sess := server.NewSession(*info, lConn, rConn)
+		defer sess.Done()
+		if err = sess.End(server.RelayTCP(sess, lConn, rConn)); err != nil {
 			var netErr net.Error
 			if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) || strings.HasSuffix(err.Error(), "with error code 0") {
 				return nil // ignore i/o timeout
@@ -215,7 +230,11 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *
 			return fmt.Errorf("ReadFrom: %w", err)
 		}
 
+		dialStart := time.Now()
 		c, err := d.DialContext(ctx, "udp", addr.String())
+		server.ObserveDial(string(protocol.ProtocolJuicity), "udp", dialStart, err)
+		info.Target = addr.String()
+		info.Logger().Trace("dial: %v", time.Since(dialStart))
 		if err != nil {
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
@@ -224,19 +243,24 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, id *
 			return fmt.Errorf("Dial: %w", err)
 		}
 		rConn := c.(netproxy.PacketConn)
+		sess := server.NewSession(*info, lConn, rConn)
+		defer sess.Done()
 		_ = rConn.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout)) // should keep consistent
-		_, err = rConn.WriteTo(buf[:n], addr.String())
+		n, err = rConn.WriteTo(buf[:n], addr.String())
+		sess.AddUp(n)
 		if err != nil {
+			_ = sess.End(err)
 			if errors.Is(err, net.ErrWriteToConnected) {
-				log.Warn("relayConnToUDP: %v", err)
+				sess.Logger().Warn("relayConnToUDP: %v", err)
 			}
 			return fmt.Errorf("WriteTo: %w", err)
 		}
-		if err = relayUoT(
+		if err = sess.End(relayUoT(
+			sess,
 			rConn,
 			lConn,
 			len(buf),
-		); err != nil {
+		)); err != nil {
 			var netErr net.Error
 			if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) || strings.HasSuffix(err.Error(), "with error code 0") {
 				return nil // ignore i/o timeout
@@ -285,7 +309,8 @@ func (s *Server) handleAuth(ctx context.Context, conn quic.Connection) (uuid *uu
 					_ = conn.CloseWithError(tuic.AuthenticationFailed, ErrAuthenticationFailed.Error())
 				}
 			}
-			return nil, fmt.Errorf("%w: %v", ErrAuthenticationFailed, authenticate.UUID)
+			server.CountAuthFailure(string(protocol.ProtocolJuicity))
+			return nil, fmt.Errorf("%w: %v", ErrAuthenticationFailed, log.Opaque(authenticate.UUID.String()))
 		default:
 			return nil, fmt.Errorf("%w: %v", ErrUnexpectedCmdType, commandHead.TYPE)
 		}
@@ -311,10 +336,18 @@ func (s *Server) handleMsg(conn *juicity.Conn, reqMetadata *trojanc.Metadata, pa
 	}
 
 	var reqBody = io.LimitReader(conn, int64(binary.BigEndian.Uint32(bufLen)))
+	reqBody, err := server.VerifyMsg(passage.Group, reqMetadata.Cmd, reqBody)
+	if err != nil {
+		return err
+	}
 
 	var resp []byte
 	switch reqMetadata.Cmd {
 	case protocol.MetadataCmdPing:
+		if server.Withdrawn(passage.Group) {
+			// SweetLisa should take the node as offline
+			return server.ErrWithdrawn
+		}
 		buf := pool.Get(4)
 		defer pool.Put(buf)
 		if _, err := io.ReadFull(reqBody, buf); err != nil {
@@ -324,40 +357,41 @@ func (s *Server) handleMsg(conn *juicity.Conn, reqMetadata *trojanc.Metadata, pa
 			log.Warn("the body of received ping message is %v instead of %v", strconv.Quote(string(buf)), strconv.Quote("ping"))
 		}
 		log.Trace("Received a ping message")
-		s.lastAlive = time.Now()
-		bandwidthLimit, err := server.GenerateBandwidthLimit()
+		if err := server.Pinged(s.registrations, passage.Group); err != nil {
+			return err
+		}
+		pingResp, err := server.GeneratePingResp(s, passage.Group)
 		if err != nil {
 			log.Warn("generatePingResp: %v", err)
 			return err
 		}
-		bPingResp, err := jsoniter.Marshal(model.PingResp{BandwidthLimit: bandwidthLimit})
+		bPingResp, err := jsoniter.Marshal(pingResp)
 		if err != nil {
 			log.Warn("%v", err)
 			return err
 		}
 		resp = bPingResp
 	case protocol.MetadataCmdSyncPassages:
-		var passages []model.Passage
-		if err := jsoniter.NewDecoder(reqBody).Decode(&passages); err != nil {
+		if err := server.HandleSyncPassages(s, passage.Group, reqBody); err != nil {
 			return err
 		}
-		var serverPassages []server.Passage
-		for _, passage := range passages {
-			var user = server.Passage{
-				Passage: passage,
-				Manager: false,
-			}
-			serverPassages = append(serverPassages, user)
-		}
-		log.Info("Server asked to SyncPassages")
-		// sweetLisa can replace the manager passage here
-		if err := s.SyncPassages(serverPassages); err != nil {
+		resp = pool.Get(2)
+		defer pool.Put(resp)
+		copy(resp, "OK")
+	case server.MetadataCmdUpdatePassages:
+		if err := server.HandleUpdatePassages(s, passage.Group, reqBody); err != nil {
 			return err
 		}
-
 		resp = pool.Get(2)
 		defer pool.Put(resp)
 		copy(resp, "OK")
+	case server.MetadataCmdRecentLogs:
+		log.Info("Server asked for recent logs")
+		bResp, err := server.GenerateRecentLogsResp(reqBody)
+		if err != nil {
+			return err
+		}
+		resp = bResp
 	default:
 		return fmt.Errorf("%w: unexpected metadata cmd type: %v", protocol.ErrFailAuth, reqMetadata.Cmd)
 	}
@@ -365,6 +399,6 @@ func (s *Server) handleMsg(conn *juicity.Conn, reqMetadata *trojanc.Metadata, pa
 	defer pool.Put(buf)
 	binary.BigEndian.PutUint32(buf, uint32(len(resp)))
 	copy(buf[4:], resp)
-	_, err := conn.Write(buf)
+	_, err = conn.Write(buf)
 	return err
 }
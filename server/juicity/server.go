@@ -37,15 +37,14 @@ type Server struct {
 	cwnd                   int
 	users                  sync.Map
 
-	sweetLisa             config.Lisa
 	arg                   server.Argument
+	registrations         []*server.Registration
 	pinnedCertchainSha256 string
 	// mutex protects passages
 	mutex    sync.Mutex
 	passages []Passage
 	// passageContentionCache log the last client IP of passages
 	passageContentionCache *server.ContentionCache
-	lastAlive              time.Time
 	ctx                    context.Context
 	close                  func()
 	listener               net.Listener
@@ -69,28 +68,35 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.
 		return nil, err
 	}
 	john := s
-	john.sweetLisa = sweetLisa
 	john.arg = arg
+	john.registrations = server.NewRegistrations(server.Groups(sweetLisa, arg))
 	john.pinnedCertchainSha256, err = common.GenerateCertChainHashFromBytes(cert)
 	if err != nil {
 		return nil, err
 	}
 	john.passageContentionCache = server.NewContentionCache()
-	if err := s.AddPassages([]server.Passage{{Manager: true}}); err != nil {
+	var managers []server.Passage
+	for _, r := range john.registrations {
+		managers = append(managers, server.Passage{Manager: true, Group: r.Ticket})
+	}
+	if err := s.AddPassages(managers); err != nil {
 		return nil, err
 	}
 	john.ctx, john.close = context.WithCancel(context.Background())
 
 	// connect to SweetLisa and register
-	if err := john.register(); err != nil {
+	if err := server.RegisterFirst(john.registrations, john.register); err != nil {
 		return nil, err
 	}
-	go john.registerBackground()
+	for _, r := range john.registrations {
+		go john.registerBackground(r)
+	}
 	return john, nil
 }
 
-func (s *Server) registerBackground() {
+func (s *Server) registerBackground(r *server.Registration) {
 	var interval = 2 * time.Second
+	var lost server.LostTracker
 	ticker := time.NewTicker(interval)
 	for {
 		select {
@@ -99,12 +105,17 @@ func (s *Server) registerBackground() {
 			log.Debug("Server was closed")
 			return
 		case <-ticker.C:
-			if time.Since(s.lastAlive) < server.LostThreshold {
+			if server.Withdrawn(r.Ticket) {
+				// registering waits for the CDN validation to pass
+				continue
+			}
+			if time.Since(r.LastAlive()) < server.LostThreshold {
 				continue
 			} else {
-				log.Warn("Lost connection with SweetLisa more than 5 minutes. Try to register again")
+				lost.Lost(r.LastAlive())
+				log.Warn("Lost connection with SweetLisa %v more than 5 minutes. Try to register again", strconv.Quote(r.Lisa.Host))
 			}
-			if err := s.register(); err != nil {
+			if err := s.register(r); err != nil {
 				// binary exponential backoff algorithm
 				// to avoid DDoS
 				interval *= 2
@@ -114,6 +125,7 @@ func (s *Server) registerBackground() {
 				log.Warn("registerBackground: %v. retry in %v", err, interval.String())
 			} else {
 				log.Debug("Suc Reg")
+				lost.Registered()
 				interval = 2 * time.Second
 			}
 			ticker.Reset(interval)
@@ -121,28 +133,17 @@ func (s *Server) registerBackground() {
 	}
 }
 
-func (s *Server) register() error {
-	var manager server.Passage
-	users := s.Passages()
-	for _, u := range users {
-		if u.Manager {
-			manager = u
-			break
-		}
-	}
+func (s *Server) register(r *server.Registration) error {
+	manager := server.ManagerOf(s.Passages(), r.Ticket)
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
-	var validateToken string
-	if len(t) > 0 {
-		validateToken = t[0]
-	}
+	validateToken := api.DefaultClient().LookupValidateToken(ctx, r.Lisa.Host)
 	bandwidthLimit, err := server.GenerateBandwidthLimit()
 	if err != nil {
 		return err
 	}
-	cdnNames, users, err := api.Register(ctx, s.sweetLisa.Host, validateToken, model.Server{
-		Ticket: s.arg.Ticket,
+	cdnNames, users, err := api.Register(ctx, r.Lisa.Host, validateToken, model.Server{
+		Ticket: r.Ticket,
 		Name:   s.arg.ServerName,
 		Hosts:  s.arg.Hostnames,
 		Port:   s.arg.Port,
@@ -158,15 +159,28 @@ func (s *Server) register() error {
 	if err != nil {
 		return err
 	}
-	log.Alert("Succeed to register at %v (%v)", strconv.Quote(s.sweetLisa.Host), cdnNames)
-	s.lastAlive = time.Now()
+	log.Alert("Succeed to register at %v (%v)", strconv.Quote(r.Lisa.Host), cdnNames)
+	r.Alive()
 	// sweetLisa can replace the manager key here
-	if err := s.SyncPassages(users); err != nil {
+	if err := server.SyncGroupPassages(s, r.Ticket, users); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (s *Server) LastAlive() time.Time {
+	return server.OldestAlive(s.registrations)
+}
+
+// Registrations returns the registrations of the groups of the server.
+func (s *Server) Registrations() []*server.Registration {
+	return s.registrations
+}
+
+func (s *Server) Reregister(groups ...string) error {
+	return server.RegisterAll(s.registrations, s.register, groups...)
+}
+
 func (s *Server) SyncPassages(passages []server.Passage) (err error) {
 	return server.SyncPassages(s, passages)
 }
@@ -183,15 +197,21 @@ func (s *Server) Close() error {
 	return nil
 }
 
-func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passage) {
+func LocalizePassages(passages []server.Passage) (psgs []Passage, managers map[string]*Passage) {
 	psgs = make([]Passage, len(passages))
+	managers = make(map[string]*Passage)
 	for i, psg := range passages {
-		if psg.Manager {
-			psg.In.Username = ManagerUuid
+		if psg.Manager && psg.RetireAt.IsZero() {
+			if psg.Group == "" || psg.Group == config.ParamsObj.John.Ticket {
+				psg.In.Username = ManagerUuid
+			} else {
+				// users are looked up by UUID, so managers of other groups cannot share ManagerUuid
+				psg.In.Username = uuid.NewString()
+			}
 			psg.In.Password, _ = gonanoid.Generate(common.Alphabet, 23)
-			// allow only one manager
-			if manager == nil {
-				manager = &psgs[i]
+			// allow only one manager in a group
+			if managers[psg.Group] == nil {
+				managers[psg.Group] = &psgs[i]
 			} else {
 				psg.Manager = false
 				log.Warn("found more than one manager")
@@ -200,19 +220,20 @@ func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passa
 		psgs[i].Passage = psg
 		psgs[i].uuid, _ = uuid.Parse(psg.In.Username)
 	}
-	return psgs, manager
+	return psgs, managers
 }
 
 func (s *Server) AddPassages(passages []server.Passage) (err error) {
 	log.Trace("AddPassages: %v", len(passages))
-	us, managerKey := LocalizePassages(passages)
+	us, managers := LocalizePassages(passages)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	// update manager key
-	if managerKey != nil {
-		// remove manager key in UserContext
+	s.avoidRetiringUuids(managers)
+	// update manager keys
+	if len(managers) > 0 {
+		// remove manager keys of the groups in UserContext
 		s.removePassagesFunc(func(passage *Passage) (remove bool) {
-			return passage.Manager == true
+			return passage.Manager && passage.RetireAt.IsZero() && managers[passage.Group] != nil
 		})
 	}
 	s.addPassages(us)
@@ -229,12 +250,12 @@ func (s *Server) RemovePassages(passages []server.Passage, alsoManager bool) (er
 		if passage.Manager && !alsoManager {
 			continue
 		}
-		keySet[passage.In.Argument.Hash()] = struct{}{}
+		keySet[server.PassageKey(&passage.Passage)] = struct{}{}
 	}
 	s.removePassagesFunc(func(passage *Passage) (remove bool) {
-		_, ok := keySet[passage.In.Argument.Hash()]
+		_, ok := keySet[server.PassageKey(&passage.Passage)]
 		if ok {
-			log.Trace("RemovePassage: From: %v", passage.In.From)
+			log.Trace("RemovePassage: From: %v", log.Opaque(passage.In.From))
 		}
 		return ok
 	})
@@ -250,6 +271,47 @@ func (s *Server) Passages() (passages []server.Passage) {
 	return passages
 }
 
+func (s *Server) UpdatePassages(toRemove []server.Passage, toAdd []server.Passage) (err error) {
+	log.Trace("UpdatePassages: %v to remove, %v to add", len(toRemove), len(toAdd))
+	us, managers := LocalizePassages(toAdd)
+	var keySet = make(map[string]struct{})
+	for i := range toRemove {
+		if !toRemove[i].Manager {
+			keySet[server.PassageKey(&toRemove[i])] = struct{}{}
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.avoidRetiringUuids(managers)
+	added := make(map[*Passage]struct{}, len(us))
+	for i := range us {
+		added[&us[i]] = struct{}{}
+	}
+	// users are replaced in place, so that a passage being replaced is always found
+	n := len(s.passages)
+	s.addPassages(us)
+	for i := n - 1; i >= 0; i-- {
+		passage := &s.passages[i]
+		var remove bool
+		if passage.Manager {
+			remove = passage.RetireAt.IsZero() && managers[passage.Group] != nil
+		} else {
+			_, remove = keySet[server.PassageKey(&passage.Passage)]
+		}
+		if !remove {
+			continue
+		}
+		if v, ok := s.users.Load(passage.uuid); ok {
+			if _, isNew := added[v.(*Passage)]; !isNew {
+				s.users.Delete(passage.uuid)
+			}
+		}
+		s.passages = append(s.passages[:i], s.passages[i+1:]...)
+	}
+	s.restoreUsers()
+	return nil
+}
+
 func (s *Server) addPassages(passages []Passage) {
 	s.passages = append(s.passages, passages...)
 
@@ -265,9 +327,42 @@ func (s *Server) removePassagesFunc(f func(passage *Passage) (remove bool)) {
 			s.passages = append(s.passages[:i], s.passages[i+1:]...)
 		}
 	}
+	s.restoreUsers()
+}
+
+// avoidRetiringUuids gives the managers new UUIDs if their UUIDs are still used by retiring managers, which stay
+// valid until they are removed.
+func (s *Server) avoidRetiringUuids(managers map[string]*Passage) {
+	for _, manager := range managers {
+		for i := range s.passages {
+			if !s.passages[i].RetireAt.IsZero() && s.passages[i].uuid == manager.uuid {
+				manager.In.Username = uuid.NewString()
+				manager.uuid, _ = uuid.Parse(manager.In.Username)
+				break
+			}
+		}
+	}
+}
+
+// restoreUsers stores the passages whose UUIDs were deleted with passages of another group.
+func (s *Server) restoreUsers() {
+	for i := range s.passages {
+		if _, ok := s.users.Load(s.passages[i].uuid); !ok {
+			passage := s.passages[i]
+			s.users.Store(passage.uuid, &passage)
+		}
+	}
 }
 
 func (s *Server) ContentionCheck(thisIP net.IP, passage *Passage) (err error) {
+	if passage.Manager {
+		if passage.Retired(time.Now()) {
+			return server.ErrRetiredManager
+		}
+		if err = server.CheckManagerSource(s, passage.Group, thisIP); err != nil {
+			return err
+		}
+	}
 	if s.passageContentionCache == nil {
 		return nil
 	}
@@ -276,7 +371,7 @@ func (s *Server) ContentionCheck(thisIP net.IP, passage *Passage) (err error) {
 		passageKey := passage.In.Argument.Hash()
 		accept, conflictIP := s.passageContentionCache.Check(passageKey, contentionDuration, thisIP)
 		if !accept {
-			return fmt.Errorf("%w: from %v and %v: contention detected", server.ErrPassageAbuse, thisIP.String(), conflictIP.String())
+			return fmt.Errorf("%w: from %v and %v: contention detected", server.ErrPassageAbuse, log.Host(thisIP.String()), log.Host(conflictIP.String()))
 		}
 	}
 	return nil
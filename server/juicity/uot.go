@@ -10,11 +10,10 @@ import (
 	"github.com/daeuniverse/softwind/netproxy"
 	"github.com/daeuniverse/softwind/pool"
 	"github.com/daeuniverse/softwind/protocol/juicity"
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 )
 
-func relayConnToUDP(dst netproxy.PacketConn, src *juicity.PacketConn, timeout time.Duration, bufLen int) (err error) {
+func relayConnToUDP(sess *server.Session, dst netproxy.PacketConn, src *juicity.PacketConn, timeout time.Duration, bufLen int) (err error) {
 	var n int
 	var addr netip.AddrPort
 	buf := pool.GetFullCap(bufLen)
@@ -26,10 +25,11 @@ func relayConnToUDP(dst netproxy.PacketConn, src *juicity.PacketConn, timeout ti
 			return
 		}
 		_ = dst.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout)) // should keep consistent
-		_, err = dst.WriteTo(buf[:n], addr.String())
+		n, err = dst.WriteTo(buf[:n], addr.String())
+		sess.AddUp(n)
 		// WARNING: if the dst is an pre-connected conn, Write should be invoked here.
 		if errors.Is(err, net.ErrWriteToConnected) {
-			log.Error("relayConnToUDP: %v", err)
+			sess.Logger().Error("relayConnToUDP: %v", err)
 		}
 		if err != nil {
 			return
@@ -37,14 +37,14 @@ func relayConnToUDP(dst netproxy.PacketConn, src *juicity.PacketConn, timeout ti
 	}
 }
 
-func relayUoT(rConn netproxy.PacketConn, lConn *juicity.PacketConn, bufLen int) (err error) {
+func relayUoT(sess *server.Session, rConn netproxy.PacketConn, lConn *juicity.PacketConn, bufLen int) (err error) {
 	eCh := make(chan error, 1)
 	go func() {
-		e := relayConnToUDP(rConn, lConn, server.DefaultNatTimeout, bufLen)
+		e := relayConnToUDP(sess, rConn, lConn, server.DefaultNatTimeout, bufLen)
 		_ = rConn.SetReadDeadline(time.Now().Add(10 * time.Second))
 		eCh <- e
 	}()
-	e := server.RelayUDPToConn(lConn, rConn, server.DefaultNatTimeout, bufLen)
+	e := server.RelayUDPToConn(sess, lConn, rConn, server.DefaultNatTimeout, bufLen)
 	_ = lConn.CloseWrite()
 	_ = lConn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	var netErr net.Error
@@ -13,9 +13,14 @@ import (
 	"github.com/daeuniverse/softwind/pool"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"golang.org/x/net/dns/dnsmessage"
 )
 
+func init() {
+	log.SetFileModule("dialer")
+}
+
 type ForceNetworkType int
 
 const (
@@ -58,7 +63,8 @@ func NewLimitedDialer(fullCone bool, forceNetwork ForceNetworkType) *PrivateLimi
 					return err
 				}
 				if common.IsPrivate(ip.AsSlice()) {
-					return fmt.Errorf("%w: %v", ErrDialPrivateAddress, ip.String())
+					privateAddressBlocks.Inc()
+					return fmt.Errorf("%w: %v", ErrDialPrivateAddress, log.Host(ip.String()))
 				}
 				return nil
 			},
@@ -138,6 +144,7 @@ func (c *PrivateLimitedUDPConn) WriteTo(b []byte, addr string) (int, error) {
 		return 0, err
 	}
 	if common.IsPrivate(a.IP) {
+		privateAddressBlocks.Inc()
 		return 0, ErrDialPrivateAddress
 	}
 	return c.UDPConn.WriteTo(b, a)
@@ -149,6 +156,7 @@ func (c *PrivateLimitedUDPConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n
 		return n, 0, err
 	}
 	if common.IsPrivate(addr.IP) {
+		privateAddressBlocks.Inc()
 		return 0, 0, ErrDialPrivateAddress
 	}
 	return c.UDPConn.WriteMsgUDP(b, oob, addr)
@@ -159,6 +167,7 @@ func (c *PrivateLimitedUDPConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, er
 		return c.Write(b)
 	}
 	if common.IsPrivate(addr.IP) {
+		privateAddressBlocks.Inc()
 		return 0, ErrDialPrivateAddress
 	}
 	return c.UDPConn.WriteToUDP(b, addr)
@@ -233,8 +242,9 @@ func (c *LimitedDNSConn) Read(b []byte) (int, error) {
 				ip = body.AAAA[:]
 			}
 			if common.IsPrivate(ip) {
+				privateAddressBlocks.Inc()
 				pool.Put(buf)
-				return 0, fmt.Errorf("%w: %v(%v)", ErrDialPrivateAddress, ip.String(), ans.Header.Name)
+				return 0, fmt.Errorf("%w: %v(%v)", ErrDialPrivateAddress, log.Host(ip.String()), log.Host(ans.Header.Name.String()))
 			}
 		}
 		binary.BigEndian.PutUint16(buf, uint16(n))
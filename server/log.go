@@ -0,0 +1,52 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync/atomic"
+
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+var lastConnID atomic.Uint64
+
+func init() {
+	log.RegisterErrorClass(protocol.ErrFailAuth, "auth")
+	log.RegisterErrorClass(protocol.ErrReplayAttack, "replay")
+	log.RegisterErrorClass(ErrPassageAbuse, "abuse")
+	log.RegisterErrorClass(ErrDialPrivateAddress, "private_address")
+	log.RegisterErrorClass(ErrQuotaExhausted, "quota")
+}
+
+// NewConnID allocates an ID for an inbound connection, which is also the ID of its session.
+func NewConnID() uint64 {
+	return lastConnID.Add(1)
+}
+
+// PassageHash returns a short fingerprint of the passage to identify it without exposing credentials.
+func PassageHash(passage *Passage) string {
+	h := sha256.Sum256([]byte(passage.In.Argument.Hash()))
+	return hex.EncodeToString(h[:4])
+}
+
+// Logger returns a logger carrying the known information of the connection.
+func (info *SessionInfo) Logger() *log.Entry {
+	logger := log.With("protocol", info.Protocol)
+	if info.ID != 0 {
+		logger = logger.With("conn_id", info.ID)
+	}
+	if info.Network != "" {
+		logger = logger.With("network", info.Network)
+	}
+	if info.Passage != nil {
+		logger = logger.With("passage", PassageHash(info.Passage))
+	}
+	if info.Source != "" {
+		logger = logger.With("source", log.Addr(info.Source))
+	}
+	if info.Target != "" {
+		logger = logger.With("target", log.Addr(info.Target))
+	}
+	return logger
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+const DefaultManagerRotationOverlap = 5 * time.Minute
+
+var ErrRetiredManager = fmt.Errorf("retired manager passage")
+
+// muRotation serializes rotations, which are scheduled or triggered by untrusted manager sources.
+var muRotation sync.Mutex
+
+// RotateManager replaces the manager passages of the groups with new ones and registers at the groups again to
+// publish them. The old ones are kept valid for the overlap, so that messages SweetLisa sent before learning the new
+// ones are accepted.
+func RotateManager(s Server, overlap time.Duration, groups ...string) error {
+	muRotation.Lock()
+	defer muRotation.Unlock()
+	for _, group := range groups {
+		old := ManagerOf(s.Passages(), group)
+		if overlap > 0 && old.Manager {
+			old.RetireAt = time.Now().Add(overlap)
+			if err := s.AddPassages([]Passage{old}); err != nil {
+				return err
+			}
+			time.AfterFunc(overlap, func() {
+				if err := s.RemovePassages([]Passage{old}, true); err != nil {
+					log.Warn("Failed to remove the retired manager passage: %v", err)
+				}
+			})
+		}
+		if err := s.AddPassages([]Passage{{Manager: true, Group: group}}); err != nil {
+			return err
+		}
+	}
+	return s.Reregister(groups...)
+}
+
+// RunManagerRotation rotates the manager passages of the groups at intervals until done is closed. Nothing is done
+// if the interval in the config is not positive.
+func RunManagerRotation(done <-chan error, s Server, groups []string, conf config.ManagerRotation) {
+	if conf.IntervalSec <= 0 {
+		return
+	}
+	overlap := DefaultManagerRotationOverlap
+	if conf.OverlapSec > 0 {
+		overlap = time.Duration(conf.OverlapSec) * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(conf.IntervalSec) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// managers of withdrawn groups are rotated when registering again
+				var serving []string
+				for _, group := range groups {
+					if !Withdrawn(group) {
+						serving = append(serving, group)
+					}
+				}
+				if len(serving) == 0 {
+					continue
+				}
+				log.Info("Rotate the manager passages")
+				if err := RotateManager(s, overlap, serving...); err != nil {
+					log.Warn("Failed to rotate the manager passages: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotateManager(t *testing.T) {
+	user := testPassage("user", false)
+	user.Group = "ticket"
+	other := testPassage("other", false)
+	other.Group = "other"
+	s := &fakeServer{}
+	if err := s.AddPassages([]Passage{{Manager: true, Group: "ticket"}, {Manager: true, Group: "other"}, user, other}); err != nil {
+		t.Fatal(err)
+	}
+	s.users = []Passage{user, other}
+	old := ManagerOf(s.Passages(), "ticket")
+	otherManager := ManagerOf(s.Passages(), "other")
+
+	const overlap = 200 * time.Millisecond
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := RotateManager(s, overlap, "ticket"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	current := ManagerOf(s.Passages(), "ticket")
+	if !current.Manager || current.In.Password == "" || current.In.Password == old.In.Password {
+		t.Fatalf("the manager passage is not rotated: %+v", current)
+	}
+	if ManagerOf(s.Passages(), "other").In.Password != otherManager.In.Password {
+		t.Error("the manager passage of the other group is rotated")
+	}
+	// only the rotated group registers again
+	for _, groups := range s.reregistered {
+		if len(groups) != 1 || groups[0] != "ticket" {
+			t.Errorf("unexpected groups registered again: %v", groups)
+		}
+	}
+	if len(s.reregistered) != 2 {
+		t.Errorf("registered again %v times", len(s.reregistered))
+	}
+
+	var retiring int
+	var retiredOld bool
+	retired := make(map[string]bool)
+	for _, p := range s.Passages() {
+		if !p.Manager || p.RetireAt.IsZero() || p.Group != "ticket" {
+			continue
+		}
+		retiring++
+		retired[p.In.Password] = true
+		if p.In.Password == old.In.Password {
+			retiredOld = true
+		}
+		if p.Retired(time.Now()) || !p.Retired(p.RetireAt) {
+			t.Errorf("unexpected retirement of the old manager passage at %v", p.RetireAt)
+		}
+	}
+	// rotations are serialized, so the original and the intermediate ones are kept during the overlap
+	if retiring != 2 || len(retired) != 2 || !retiredOld {
+		t.Fatalf("unexpected managers during the overlap: %v retiring", retiring)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Passages()) != 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	passages := s.Passages()
+	if len(passages) != 4 || ManagerOf(passages, "ticket").In.Password != current.In.Password {
+		t.Fatalf("unexpected passages after the overlap: %+v", passages)
+	}
+	if n := countUsers(passages); n != 2 {
+		t.Errorf("unexpected users after the overlap: %v", n)
+	}
+}
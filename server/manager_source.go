@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/metrics"
+)
+
+const (
+	DefaultManagerSourcesResolveInterval = 5 * time.Minute
+	// ManagerRotationCooldown is the min interval between two rotations triggered by untrusted sources of a group.
+	ManagerRotationCooldown = 10 * time.Minute
+)
+
+var ErrUntrustedManagerSource = fmt.Errorf("manager passage used from an untrusted source")
+
+var untrustedManagerSources = metrics.NewCounterVec("bitterjohn_untrusted_manager_sources_total",
+	"Number of manager connections rejected for the source address.")
+
+// ManagerSources is the allowlist of source addresses that can use the manager passage.
+type ManagerSources struct {
+	nets  []*net.IPNet
+	hosts []string
+	// RotateOnViolation rotates the manager passage of the group and registers again when it is used from
+	// untrusted sources.
+	RotateOnViolation bool
+	ResolveInterval   time.Duration
+	Resolver          *net.Resolver
+
+	mu          sync.Mutex
+	resolved    []net.IP
+	lastRotated map[string]time.Time
+}
+
+var managerSources *ManagerSources
+
+// NewManagerSources parses the CIDRs, IPs and hostnames to allow, which are resolved by the resolver. Nil is
+// returned if none is given.
+func NewManagerSources(conf config.ManagerSources, resolver *net.Resolver) (*ManagerSources, error) {
+	if len(conf.Allow) == 0 {
+		return nil, nil
+	}
+	m := &ManagerSources{
+		RotateOnViolation: conf.RotateOnViolation,
+		ResolveInterval:   DefaultManagerSourcesResolveInterval,
+		Resolver:          resolver,
+		lastRotated:       make(map[string]time.Time),
+	}
+	if conf.ResolveIntervalSec > 0 {
+		m.ResolveInterval = time.Duration(conf.ResolveIntervalSec) * time.Second
+	}
+	for _, a := range conf.Allow {
+		a = strings.TrimSpace(a)
+		if _, n, err := net.ParseCIDR(a); err == nil {
+			m.nets = append(m.nets, n)
+		} else if ip := net.ParseIP(a); ip != nil {
+			m.nets = append(m.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else if a != "" && !strings.ContainsAny(a, "/ ") {
+			m.hosts = append(m.hosts, a)
+		} else {
+			return nil, fmt.Errorf("invalid manager source: %v", a)
+		}
+	}
+	return m, nil
+}
+
+// InitManagerSources sets the allowlist of manager sources and resolves the hostnames in it by the resolver at
+// intervals until done is closed.
+func InitManagerSources(done <-chan error, conf config.ManagerSources, resolver *net.Resolver) error {
+	m, err := NewManagerSources(conf, resolver)
+	if err != nil {
+		return err
+	}
+	managerSources = m
+	if m == nil || len(m.hosts) == 0 {
+		return nil
+	}
+	m.Resolve(context.Background())
+	go func() {
+		ticker := time.NewTicker(m.ResolveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				m.Resolve(context.Background())
+			}
+		}
+	}()
+	return nil
+}
+
+// Resolve resolves the hostnames in the allowlist. The last addresses of a hostname are kept if it fails to resolve.
+func (m *ManagerSources) Resolve(ctx context.Context) {
+	m.mu.Lock()
+	old := m.resolved
+	m.mu.Unlock()
+	var resolved []net.IP
+	var failed bool
+	for _, host := range m.hosts {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		addrs, err := m.Resolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			log.Warn("Failed to resolve the manager source %v: %v", host, err)
+			failed = true
+			continue
+		}
+		for _, addr := range addrs {
+			resolved = append(resolved, addr.IP)
+		}
+	}
+	if failed {
+		resolved = append(resolved, old...)
+	}
+	m.mu.Lock()
+	m.resolved = resolved
+	m.mu.Unlock()
+}
+
+// Allowed reports whether the manager passage can be used from the IP.
+func (m *ManagerSources) Allowed(ip net.IP) bool {
+	for _, n := range m.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.resolved {
+		if r.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns ErrUntrustedManagerSource if the manager passage of the group of the server is used from an IP not
+// in the allowlist, and rotates the manager passage if RotateOnViolation.
+func (m *ManagerSources) Check(s Server, group string, ip net.IP) error {
+	if m == nil || m.Allowed(ip) {
+		return nil
+	}
+	untrustedManagerSources.Inc()
+	if m.RotateOnViolation {
+		m.mu.Lock()
+		rotate := time.Since(m.lastRotated[group]) >= ManagerRotationCooldown
+		if rotate {
+			m.lastRotated[group] = time.Now()
+		}
+		m.mu.Unlock()
+		if rotate {
+			go func() {
+				log.Alert("The manager passage was used from %v. Rotate it", log.Host(ip.String()))
+				if err := RotateManager(s, 0, group); err != nil {
+					log.Warn("Failed to rotate the manager passage: %v", err)
+				}
+			}()
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrUntrustedManagerSource, log.Host(ip.String()))
+}
+
+// CheckManagerSource checks the source IP of the manager passage of the group with the allowlist in the config.
+func CheckManagerSource(s Server, group string, ip net.IP) error {
+	return managerSources.Check(s, group, ip)
+}
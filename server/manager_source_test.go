@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+func TestManagerSources(t *testing.T) {
+	if m, err := NewManagerSources(config.ManagerSources{}, net.DefaultResolver); err != nil || m != nil {
+		t.Fatalf("an empty allowlist is not nil: %v, %v", m, err)
+	}
+	if _, err := NewManagerSources(config.ManagerSources{Allow: []string{"10.0.0.0/33"}}, net.DefaultResolver); err == nil {
+		t.Error("invalid CIDR is accepted")
+	}
+	m, err := NewManagerSources(config.ManagerSources{
+		Allow:             []string{"10.0.0.0/8", "2001:db8::1", "localhost"},
+		RotateOnViolation: true,
+	}, net.DefaultResolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.resolved = []net.IP{net.ParseIP("127.0.0.1")}
+
+	s := &fakeServer{}
+	for _, ip := range []string{"10.1.2.3", "2001:db8::1", "127.0.0.1"} {
+		if err := m.Check(s, "ticket", net.ParseIP(ip)); err != nil {
+			t.Errorf("the manager source %v is rejected: %v", ip, err)
+		}
+	}
+	if err := m.Check(s, "ticket", net.ParseIP("192.0.2.1")); !errors.Is(err, ErrUntrustedManagerSource) {
+		t.Errorf("unexpected error of the untrusted source: %v", err)
+	}
+	// rotations are limited by the cooldown
+	_ = m.Check(s, "ticket", net.ParseIP("192.0.2.2"))
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		registered := s.registered
+		s.mu.Unlock()
+		if registered > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	var managers int
+	for _, p := range s.Passages() {
+		if p.Manager && p.Group == "ticket" {
+			managers++
+		}
+	}
+	s.mu.Lock()
+	registered := s.registered
+	s.mu.Unlock()
+	if managers != 1 || registered != 1 {
+		t.Errorf("unexpected rotation: %v managers and %v registrations", managers, registered)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/disk_bloom"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/metrics"
+)
+
+var (
+	authFailures = metrics.NewCounterVec("bitterjohn_auth_failures_total",
+		"Number of connections failed to authenticate.", "protocol")
+	replayAttacks = metrics.NewCounterVec("bitterjohn_replay_attacks_total",
+		"Number of detected replay attacks.", "protocol")
+	privateAddressBlocks = metrics.NewCounterVec("bitterjohn_private_address_blocks_total",
+		"Number of requests blocked for dialing private addresses.")
+	dialDuration = metrics.NewHistogramVec("bitterjohn_dial_duration_seconds",
+		"Time taken to dial targets.", []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "protocol", "network")
+	dialErrors = metrics.NewCounterVec("bitterjohn_dial_errors_total",
+		"Number of failures to dial targets.", "protocol", "network")
+)
+
+func init() {
+	metrics.NewGaugeFunc("bitterjohn_sessions", "Number of active relaying sessions.", func() (samples []metrics.Sample) {
+		count := make(map[[2]string]int)
+		RangeSessions(func(s *Session) {
+			count[[2]string{s.Protocol, s.Network}]++
+		})
+		for k, v := range count {
+			samples = append(samples, metrics.Sample{LabelValues: k[:], Value: float64(v)})
+		}
+		return samples
+	}, "protocol", "network")
+	metrics.NewCounterFunc("bitterjohn_relayed_bytes_total", "Number of bytes relayed. Up is from users to targets.", func() []metrics.Sample {
+		up, down := RelayedTraffic()
+		return []metrics.Sample{
+			{LabelValues: []string{"up"}, Value: float64(up)},
+			{LabelValues: []string{"down"}, Value: float64(down)},
+		}
+	}, "direction")
+	metrics.NewGaugeFunc("bitterjohn_registered", "Whether the server is registered at SweetLisa of the group and alive.", func() []metrics.Sample {
+		return registrationSamples(func(r *Registration) (float64, bool) {
+			if lastAlive := r.LastAlive(); !lastAlive.IsZero() && time.Since(lastAlive) < LostThreshold {
+				return 1, true
+			}
+			return 0, true
+		})
+	}, "group")
+	metrics.NewGaugeFunc("bitterjohn_last_alive_age_seconds", "Seconds since SweetLisa of the group was seen last time.", func() []metrics.Sample {
+		return registrationSamples(func(r *Registration) (float64, bool) {
+			lastAlive := r.LastAlive()
+			return time.Since(lastAlive).Seconds(), !lastAlive.IsZero()
+		})
+	}, "group")
+	metrics.NewGaugeFunc("bitterjohn_user_contexts", "Number of user contexts in the pool.", func() (samples []metrics.Sample) {
+		for _, s := range Servers() {
+			if s, ok := s.(interface{ UserContextPoolSize() int }); ok {
+				samples = append(samples, metrics.Sample{Value: float64(s.UserContextPoolSize())})
+			}
+		}
+		return samples
+	})
+	metrics.NewGaugeFunc("bitterjohn_bloom_fill_ratio", "Ratio of the entries added to the bloom filters since the start to the capacity of a filter.", func() []metrics.Sample {
+		return bloomSamples(disk_bloom.Blooms())
+	}, "pattern")
+}
+
+// registrationSamples returns the samples of the registrations of all servers labeled by the host of SweetLisa.
+// Groups at the same host are told apart by a suffix of their order.
+func registrationSamples(f func(r *Registration) (value float64, ok bool)) (samples []metrics.Sample) {
+	seen := make(map[string]int)
+	for _, s := range Servers() {
+		s, ok := s.(interface{ Registrations() []*Registration })
+		if !ok {
+			continue
+		}
+		for _, r := range s.Registrations() {
+			group := r.Lisa.Host
+			if seen[r.Lisa.Host]++; seen[r.Lisa.Host] > 1 {
+				group += "#" + strconv.Itoa(seen[r.Lisa.Host])
+			}
+			if v, ok := f(r); ok {
+				samples = append(samples, metrics.Sample{LabelValues: []string{group}, Value: v})
+			}
+		}
+	}
+	return samples
+}
+
+func bloomSamples(blooms []*disk_bloom.Bloom) (samples []metrics.Sample) {
+	for _, b := range blooms {
+		samples = append(samples, metrics.Sample{LabelValues: []string{filepath.Base(b.Pattern())}, Value: b.FillRatio()})
+	}
+	return samples
+}
+
+// ObserveAuthError counts the error of authentication as an auth failure or a replay attack.
+func ObserveAuthError(proto string, err error) {
+	switch {
+	case errors.Is(err, protocol.ErrReplayAttack):
+		replayAttacks.Inc(proto)
+	case errors.Is(err, protocol.ErrFailAuth):
+		authFailures.Inc(proto)
+	}
+}
+
+// ObserveDial records the duration and the result of dialing a target since start.
+func ObserveDial(proto string, network string, start time.Time, err error) {
+	if err != nil {
+		dialErrors.Inc(proto, network)
+		return
+	}
+	dialDuration.Observe(time.Since(start).Seconds(), proto, network)
+}
+
+// CountAuthFailure counts an auth failure of the protocol.
+func CountAuthFailure(proto string) {
+	authFailures.Inc(proto)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/disk_bloom"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/metrics"
+)
+
+type registeredServer struct {
+	fakeServer
+	regs []*Registration
+}
+
+func (s *registeredServer) Registrations() []*Registration {
+	return s.regs
+}
+
+func TestRegistrationMetrics(t *testing.T) {
+	regs := NewRegistrations([]Group{
+		{Lisa: config.Lisa{Host: "lisa.example.com"}, Ticket: "ticket1"},
+		{Lisa: config.Lisa{Host: "lisa.example.com"}, Ticket: "ticket2"},
+		{Lisa: config.Lisa{Host: "other.example.com"}, Ticket: "ticket3"},
+	})
+	regs[0].Alive()
+	s := &registeredServer{regs: regs}
+	muServers.Lock()
+	servers = append(servers, s)
+	muServers.Unlock()
+	defer func() {
+		muServers.Lock()
+		servers = servers[:len(servers)-1]
+		muServers.Unlock()
+	}()
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		`bitterjohn_registered{group="lisa.example.com"} 1`,
+		`bitterjohn_registered{group="lisa.example.com#2"} 0`,
+		`bitterjohn_registered{group="other.example.com"} 0`,
+		`bitterjohn_last_alive_age_seconds{group="lisa.example.com"} `,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("the line is not found: %v", line)
+		}
+	}
+	// groups never seen have no age
+	if strings.Contains(out, `bitterjohn_last_alive_age_seconds{group="other.example.com"}`) {
+		t.Error("age of a group never seen")
+	}
+}
+
+func TestBloomMetrics(t *testing.T) {
+	b, err := disk_bloom.NewBloom(filepath.Join(t.TempDir(), "disk_bloom_*"), []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"a", "b", "a", "c"} {
+		b.ExistOrAdd([]byte(entry))
+	}
+	b.Added(1)
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	// 4 of the capacity of 1e8 entries
+	if line := `bitterjohn_bloom_fill_ratio{pattern="disk_bloom_*"} 4e-08`; !strings.Contains(buf.String(), line) {
+		t.Errorf("the line is not found: %v", line)
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/metrics"
+)
+
+const (
+	// MsgAuthOff accepts manager messages without checking signatures.
+	MsgAuthOff = "off"
+	// MsgAuthOptional verifies signed manager messages and accepts unsigned ones with a warning. It has to be set
+	// explicitly to migrate from a SweetLisa not signing yet: anyone holding the manager key can still send unsigned
+	// messages.
+	MsgAuthOptional = "optional"
+	// MsgAuthRequired rejects unsigned manager messages. It is the default and the only mode protecting against a
+	// leaked manager key.
+	MsgAuthRequired = "required"
+
+	MsgAlgHMACSHA256 byte = 1
+	MsgAlgEd25519    byte = 2
+
+	// MsgMaxSkew is the max difference between the timestamp of a signed message and the local time.
+	MsgMaxSkew = 5 * time.Minute
+	// MaxMsgBodySize is the max size of the body of a manager message to verify.
+	MaxMsgBodySize = 16 << 20
+
+	msgNonceSize  = 16
+	msgHeaderSize = 4 + 1 + 8 + msgNonceSize
+)
+
+// SignedMsgMagic starts the body of a signed manager message, which is
+//
+//	magic (4) | alg (1) | unix timestamp (8, big endian) | nonce (16) | signature | payload
+//
+// and the signature covers cmd (1) | timestamp | nonce | node | payload, where node is the SHA-256 of the server name
+// so that a message for a node cannot be replayed to another one of the same ticket. Bodies of unsigned messages
+// never start with it.
+var SignedMsgMagic = []byte("BJS1")
+
+var (
+	ErrUnsignedMsg     = fmt.Errorf("unsigned manager message")
+	ErrStaleMsg        = fmt.Errorf("stale manager message")
+	ErrReplayedMsg     = fmt.Errorf("replayed manager message")
+	ErrBadMsgSignature = fmt.Errorf("bad signature of manager message")
+)
+
+var (
+	rejectedMsgs = metrics.NewCounterVec("bitterjohn_rejected_manager_msgs_total",
+		"Number of manager messages rejected for the signature.", "reason")
+	unsignedMsgsAccepted = metrics.NewCounterVec("bitterjohn_unsigned_manager_msgs_accepted_total",
+		"Number of unsigned manager messages accepted in the optional mode.")
+)
+
+type msgVerifier struct {
+	hmacKey   []byte
+	publicKey ed25519.PublicKey
+}
+
+var (
+	muMsgAuth    sync.Mutex
+	msgAuthMode  = MsgAuthRequired
+	msgVerifiers = make(map[string]*msgVerifier)
+	// msgNode is the SHA-256 of the server name
+	msgNode = MsgNode("")
+	// msgNonces are the nonces seen with their expiry
+	msgNonces = make(map[string]time.Time)
+)
+
+// MsgHMACKey returns the HMAC key of manager messages of the group with the ticket.
+func MsgHMACKey(ticket string) []byte {
+	mac := hmac.New(sha256.New, []byte(ticket))
+	mac.Write([]byte("BitterJohn manager message"))
+	return mac.Sum(nil)
+}
+
+// MsgNode returns the identity of the node with the server name in signed manager messages.
+func MsgNode(serverName string) []byte {
+	h := sha256.Sum256([]byte(serverName))
+	return h[:]
+}
+
+// InitMsgAuth sets how manager messages of the groups in the config are verified. A group with a public key only
+// accepts Ed25519 signatures, and the others accept HMAC keyed by MsgHMACKey of their tickets.
+func InitMsgAuth(conf *config.Params) error {
+	mode := conf.John.MsgAuth.Mode
+	switch mode {
+	case "":
+		mode = MsgAuthRequired
+	case MsgAuthOff, MsgAuthOptional, MsgAuthRequired:
+	default:
+		return fmt.Errorf("invalid msgAuth mode: %v", mode)
+	}
+	verifiers := make(map[string]*msgVerifier)
+	add := func(ticket string, publicKey string) error {
+		v := &msgVerifier{hmacKey: MsgHMACKey(ticket)}
+		if publicKey != "" {
+			b, err := base64.StdEncoding.DecodeString(publicKey)
+			if err != nil || len(b) != ed25519.PublicKeySize {
+				return fmt.Errorf("invalid Ed25519 public key: %v", publicKey)
+			}
+			v.publicKey = b
+		}
+		verifiers[ticket] = v
+		return nil
+	}
+	if err := add(conf.John.Ticket, conf.John.MsgAuth.PublicKey); err != nil {
+		return err
+	}
+	for _, g := range conf.John.Groups {
+		if err := add(g.Ticket, g.PublicKey); err != nil {
+			return err
+		}
+	}
+	if mode == MsgAuthOptional {
+		log.Warn("Unsigned manager messages are accepted. Set msgAuth.mode to %v to reject them", MsgAuthRequired)
+	}
+	muMsgAuth.Lock()
+	msgAuthMode = mode
+	msgVerifiers = verifiers
+	msgNode = MsgNode(conf.John.Name)
+	muMsgAuth.Unlock()
+	return nil
+}
+
+func signedData(cmd protocol.MetadataCmd, header []byte, node []byte, payload []byte) []byte {
+	data := make([]byte, 0, 1+8+msgNonceSize+len(node)+len(payload))
+	data = append(data, byte(cmd))
+	data = append(data, header[5:msgHeaderSize]...)
+	data = append(data, node...)
+	return append(data, payload...)
+}
+
+func newMsgHeader(alg byte, now time.Time) []byte {
+	header := make([]byte, msgHeaderSize)
+	copy(header, SignedMsgMagic)
+	header[4] = alg
+	binary.BigEndian.PutUint64(header[5:], uint64(now.Unix()))
+	_, _ = rand.Read(header[13:])
+	return header
+}
+
+// SignMsgHMAC returns the body of the manager message to the node with the server name signed by HMAC keyed by
+// MsgHMACKey of the ticket.
+func SignMsgHMAC(ticket string, serverName string, cmd protocol.MetadataCmd, payload []byte, now time.Time) []byte {
+	header := newMsgHeader(MsgAlgHMACSHA256, now)
+	mac := hmac.New(sha256.New, MsgHMACKey(ticket))
+	mac.Write(signedData(cmd, header, MsgNode(serverName), payload))
+	return append(append(header, mac.Sum(nil)...), payload...)
+}
+
+// SignMsgEd25519 returns the body of the manager message to the node with the server name signed by the Ed25519
+// private key.
+func SignMsgEd25519(privateKey ed25519.PrivateKey, serverName string, cmd protocol.MetadataCmd, payload []byte, now time.Time) []byte {
+	header := newMsgHeader(MsgAlgEd25519, now)
+	sig := ed25519.Sign(privateKey, signedData(cmd, header, MsgNode(serverName), payload))
+	return append(append(header, sig...), payload...)
+}
+
+func rejectMsg(reason string, err error) error {
+	rejectedMsgs.Inc(reason)
+	return err
+}
+
+// VerifyMsg reads the body of the manager message of the group and returns the payload. Unsigned messages are
+// rejected if signatures are required, and signed ones must be fresh and never seen before.
+func VerifyMsg(group string, cmd protocol.MetadataCmd, body io.Reader) (payload io.Reader, err error) {
+	muMsgAuth.Lock()
+	mode := msgAuthMode
+	v := msgVerifiers[group]
+	node := msgNode
+	muMsgAuth.Unlock()
+	if mode == MsgAuthOff {
+		return body, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(body, MaxMsgBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxMsgBodySize {
+		return nil, fmt.Errorf("manager message is too large")
+	}
+	if !bytes.HasPrefix(b, SignedMsgMagic) {
+		if mode == MsgAuthRequired {
+			return nil, rejectMsg("unsigned", ErrUnsignedMsg)
+		}
+		unsignedMsgsAccepted.Inc()
+		log.Warn("Accepted an unsigned manager message of cmd %v", cmd)
+		return bytes.NewReader(b), nil
+	}
+	if len(b) < msgHeaderSize {
+		return nil, rejectMsg("bad_signature", fmt.Errorf("%w: truncated", ErrBadMsgSignature))
+	}
+	if v == nil {
+		return nil, rejectMsg("bad_signature", fmt.Errorf("%w: unknown group", ErrBadMsgSignature))
+	}
+	header := b[:msgHeaderSize]
+	var sigSize int
+	switch alg := header[4]; {
+	case alg == MsgAlgEd25519 && v.publicKey != nil:
+		sigSize = ed25519.SignatureSize
+	case alg == MsgAlgHMACSHA256 && v.publicKey == nil:
+		sigSize = sha256.Size
+	default:
+		return nil, rejectMsg("bad_signature", fmt.Errorf("%w: unexpected algorithm %v", ErrBadMsgSignature, alg))
+	}
+	if len(b) < msgHeaderSize+sigSize {
+		return nil, rejectMsg("bad_signature", fmt.Errorf("%w: truncated", ErrBadMsgSignature))
+	}
+	sig, data := b[msgHeaderSize:msgHeaderSize+sigSize], b[msgHeaderSize+sigSize:]
+	signed := signedData(cmd, header, node, data)
+	if v.publicKey != nil {
+		if !ed25519.Verify(v.publicKey, signed, sig) {
+			return nil, rejectMsg("bad_signature", ErrBadMsgSignature)
+		}
+	} else {
+		mac := hmac.New(sha256.New, v.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return nil, rejectMsg("bad_signature", ErrBadMsgSignature)
+		}
+	}
+	now := time.Now()
+	t := time.Unix(int64(binary.BigEndian.Uint64(header[5:13])), 0)
+	if t.Before(now.Add(-MsgMaxSkew)) || t.After(now.Add(MsgMaxSkew)) {
+		return nil, rejectMsg("stale", fmt.Errorf("%w: signed at %v", ErrStaleMsg, t))
+	}
+	if !rememberNonce(group+"|"+string(header[13:msgHeaderSize]), now) {
+		return nil, rejectMsg("replayed", ErrReplayedMsg)
+	}
+	log.Trace("Verified the manager message of cmd %v", cmd)
+	return bytes.NewReader(data), nil
+}
+
+// rememberNonce returns false if the nonce has been seen within the skew.
+func rememberNonce(nonce string, now time.Time) bool {
+	muMsgAuth.Lock()
+	defer muMsgAuth.Unlock()
+	if expiry, ok := msgNonces[nonce]; ok && now.Before(expiry) {
+		return false
+	}
+	for k, expiry := range msgNonces {
+		if !now.Before(expiry) {
+			delete(msgNonces, k)
+		}
+	}
+	// a message older than twice the skew is stale anyway
+	msgNonces[nonce] = now.Add(2 * MsgMaxSkew)
+	return true
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/metrics"
+)
+
+func verify(group string, cmd protocol.MetadataCmd, body []byte) (string, error) {
+	payload, err := VerifyMsg(group, cmd, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(payload)
+	return string(b), err
+}
+
+func TestVerifyMsg(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Params{}
+	conf.John.Name = "nodeA"
+	conf.John.Ticket = "ticket1"
+	conf.John.MsgAuth.Mode = MsgAuthRequired
+	conf.John.Groups = []config.Group{{Host: "lisa2", Ticket: "ticket2", PublicKey: base64.StdEncoding.EncodeToString(publicKey)}}
+	if err = InitMsgAuth(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = InitMsgAuth(&config.Params{})
+	}()
+
+	now := time.Now()
+	body := SignMsgHMAC("ticket1", "nodeA", protocol.MetadataCmdSyncPassages, []byte("[]"), now)
+	if payload, err := verify("ticket1", protocol.MetadataCmdSyncPassages, body); err != nil || payload != "[]" {
+		t.Fatalf("unexpected payload of the signed message: %q, %v", payload, err)
+	}
+	if _, err = verify("ticket1", protocol.MetadataCmdSyncPassages, body); !errors.Is(err, ErrReplayedMsg) {
+		t.Errorf("unexpected error of the replayed message: %v", err)
+	}
+	// the signature covers the cmd
+	body = SignMsgHMAC("ticket1", "nodeA", protocol.MetadataCmdPing, []byte("ping"), now)
+	if _, err = verify("ticket1", protocol.MetadataCmdSyncPassages, body); !errors.Is(err, ErrBadMsgSignature) {
+		t.Errorf("unexpected error of the message with another cmd: %v", err)
+	}
+	body = SignMsgHMAC("ticket2", "nodeA", protocol.MetadataCmdPing, []byte("ping"), now)
+	if _, err = verify("ticket1", protocol.MetadataCmdPing, body); !errors.Is(err, ErrBadMsgSignature) {
+		t.Errorf("unexpected error of the message signed with another ticket: %v", err)
+	}
+	body = SignMsgHMAC("ticket1", "nodeA", protocol.MetadataCmdPing, []byte("ping"), now.Add(-time.Hour))
+	if _, err = verify("ticket1", protocol.MetadataCmdPing, body); !errors.Is(err, ErrStaleMsg) {
+		t.Errorf("unexpected error of the stale message: %v", err)
+	}
+	if _, err = verify("ticket1", protocol.MetadataCmdPing, []byte("ping")); !errors.Is(err, ErrUnsignedMsg) {
+		t.Errorf("unexpected error of the unsigned message: %v", err)
+	}
+
+	// the group with a public key only accepts Ed25519 signatures
+	body = SignMsgEd25519(privateKey, "nodeA", protocol.MetadataCmdPing, []byte("ping"), now)
+	if payload, err := verify("ticket2", protocol.MetadataCmdPing, body); err != nil || payload != "ping" {
+		t.Errorf("unexpected payload of the message signed by Ed25519: %q, %v", payload, err)
+	}
+	body = SignMsgHMAC("ticket2", "nodeA", protocol.MetadataCmdPing, []byte("ping"), now)
+	if _, err = verify("ticket2", protocol.MetadataCmdPing, body); !errors.Is(err, ErrBadMsgSignature) {
+		t.Errorf("unexpected error of the HMAC message of the group with a public key: %v", err)
+	}
+
+	// a message for a node is rejected by another node of the same ticket
+	body = SignMsgHMAC("ticket1", "nodeA", protocol.MetadataCmdSyncPassages, []byte("[]"), now)
+	conf.John.Name = "nodeB"
+	if err = InitMsgAuth(conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verify("ticket1", protocol.MetadataCmdSyncPassages, body); !errors.Is(err, ErrBadMsgSignature) {
+		t.Errorf("unexpected error of the message for another node: %v", err)
+	}
+
+	// unsigned messages are rejected by default
+	if err = InitMsgAuth(&config.Params{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verify("", protocol.MetadataCmdPing, []byte("ping")); !errors.Is(err, ErrUnsignedMsg) {
+		t.Errorf("unexpected error of the unsigned message by default: %v", err)
+	}
+
+	// unsigned messages are accepted only in the optional mode, and counted apart from the rejected ones
+	conf.John.MsgAuth.Mode = MsgAuthOptional
+	if err = InitMsgAuth(conf); err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := verify("ticket1", protocol.MetadataCmdPing, []byte("ping")); err != nil || payload != "ping" {
+		t.Errorf("unexpected payload of the unsigned message: %q, %v", payload, err)
+	}
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	if !strings.Contains(buf.String(), "bitterjohn_unsigned_manager_msgs_accepted_total 1\n") {
+		t.Errorf("the accepted unsigned message is not counted:\n%v", buf.String())
+	}
+	if strings.Contains(buf.String(), `reason="unsigned_accepted"`) {
+		t.Error("the accepted unsigned message is counted as rejected")
+	}
+
+	conf.John.MsgAuth.Mode = "strict"
+	if err = InitMsgAuth(conf); err == nil {
+		t.Error("invalid mode is accepted")
+	}
+}
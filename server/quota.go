@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	QuotaCheckInterval = 30 * time.Second
+	QuotaStateFile     = "quota.json"
+)
+
+var (
+	ErrQuotaExhausted = fmt.Errorf("traffic quota is exhausted")
+
+	quotaExhausted atomic.Bool
+	quotaNear      atomic.Bool
+)
+
+// QuotaUsage is the data of quota events.
+type QuotaUsage struct {
+	UplinkKiB   int64
+	DownlinkKiB int64
+}
+
+// quotaState is the traffic usage of the current cycle, which is persisted to survive restarts.
+type quotaState struct {
+	CycleStart   time.Time
+	TxInitialKiB int64
+	RxInitialKiB int64
+	TxKiB        int64
+	RxKiB        int64
+}
+
+// QuotaExhausted returns if the local quota guard found the quota exhausted in the current cycle.
+func QuotaExhausted() bool {
+	return quotaExhausted.Load()
+}
+
+// CheckQuota returns ErrQuotaExhausted if the quota is exhausted and the passage is not the manager.
+func CheckQuota(passage *Passage) error {
+	if passage.Use() != PassageUseManager && QuotaExhausted() {
+		return ErrQuotaExhausted
+	}
+	return nil
+}
+
+// GuardQuota checks the traffic usage at intervals and enforces the bandwidth limit locally until ctx is done.
+func GuardQuota(ctx context.Context) {
+	statePath, err := config.DataFile(QuotaStateFile)
+	if err != nil {
+		log.Warn("GuardQuota: %v", err)
+	}
+	state := loadQuotaState(statePath)
+	ticker := time.NewTicker(QuotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		limit := config.ParamsObj.John.BandwidthLimit
+		txKiB, rxKiB, err := TrafficKiB(limit)
+		if err == nil {
+			err = checkQuota(&state, limit, txKiB, rxKiB, time.Now())
+		}
+		if err != nil {
+			log.Warn("GuardQuota: %v", err)
+		} else if err = saveQuotaState(statePath, state); err != nil {
+			log.Warn("GuardQuota: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadQuotaState reads the state persisted at path. An empty state is returned if path is empty or unreadable.
+func loadQuotaState(path string) (state quotaState) {
+	if path == "" {
+		return state
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return state
+	}
+	if err = jsoniter.Unmarshal(b, &state); err != nil {
+		log.Warn("GuardQuota: failed to parse %v: %v", path, err)
+		return quotaState{}
+	}
+	return state
+}
+
+// saveQuotaState persists the state at path, which does nothing if path is empty.
+func saveQuotaState(path string, state quotaState) error {
+	if path == "" {
+		return nil
+	}
+	b, err := jsoniter.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// checkQuota updates the state with the traffic counters read at now, and enforces the limit if the usage of the
+// current cycle exhausts it.
+func checkQuota(state *quotaState, limit config.BandwidthLimit, txKiB int64, rxKiB int64, now time.Time) error {
+	cycle, err := NewCycle(limit)
+	if err != nil {
+		return err
+	}
+	if cycleStart := cycle.LastReset(now); !state.CycleStart.Equal(cycleStart) {
+		// A new cycle begins.
+		state.CycleStart = cycleStart
+		state.TxInitialKiB = txKiB
+		state.RxInitialKiB = rxKiB
+	} else {
+		// The counters decreased abnormally, such as after a reboot. Keep the usage.
+		if txKiB < state.TxKiB {
+			state.TxInitialKiB = txKiB - (state.TxKiB - state.TxInitialKiB)
+		}
+		if rxKiB < state.RxKiB {
+			state.RxInitialKiB = rxKiB - (state.RxKiB - state.RxInitialKiB)
+		}
+	}
+	state.TxKiB = txKiB
+	state.RxKiB = rxKiB
+
+	l := model.BandwidthLimit{
+		UplinkLimitGiB:     limit.UplinkLimitGiB,
+		DownlinkLimitGiB:   limit.DownlinkLimitGiB,
+		TotalLimitGiB:      limit.TotalLimitGiB,
+		UplinkKiB:          state.TxKiB,
+		DownlinkKiB:        state.RxKiB,
+		UplinkInitialKiB:   state.TxInitialKiB,
+		DownlinkInitialKiB: state.RxInitialKiB,
+	}
+	exhausted := l.Exhausted()
+	near := !exhausted && limit.NearPercent > 0 && 100*quotaUsage(l) >= float64(limit.NearPercent)
+	if wasNear := quotaNear.Swap(near); near && !wasNear {
+		Emit(EventQuotaNearExhaustion, fmt.Sprintf("%.1f%% of the traffic quota is used in this cycle", 100*quotaUsage(l)), QuotaUsage{
+			UplinkKiB:   state.TxKiB - state.TxInitialKiB,
+			DownlinkKiB: state.RxKiB - state.RxInitialKiB,
+		})
+	}
+	if quotaExhausted.Swap(exhausted) == exhausted {
+		return nil
+	}
+	if !exhausted {
+		log.Alert("Traffic quota is available again. Resume accepting sessions")
+		return nil
+	}
+	log.Warn("Traffic quota is exhausted (uplink: %v KiB, downlink: %v KiB in this cycle). Stop accepting sessions",
+		state.TxKiB-state.TxInitialKiB, state.RxKiB-state.RxInitialKiB)
+	Emit(EventQuotaExhausted, "the traffic quota is exhausted in this cycle", QuotaUsage{
+		UplinkKiB:   state.TxKiB - state.TxInitialKiB,
+		DownlinkKiB: state.RxKiB - state.RxInitialKiB,
+	})
+	if limit.TearDownOnExhausted {
+		n := CloseSessions(CloseReasonQuota, func(s *Session) bool {
+			return s.Passage.Use() != PassageUseManager
+		})
+		log.Warn("Closed %v existing sessions", n)
+	}
+	return nil
+}
+
+// quotaUsage returns the max ratio of the used traffic to the limits.
+func quotaUsage(l model.BandwidthLimit) (usage float64) {
+	ratio := func(usedKiB int64, limitGB int64) float64 {
+		if limitGB <= 0 {
+			return 0
+		}
+		return float64(usedKiB) / float64(1000*1000*limitGB)
+	}
+	up := l.UplinkKiB - l.UplinkInitialKiB
+	down := l.DownlinkKiB - l.DownlinkInitialKiB
+	for _, r := range []float64{
+		ratio(up, l.UplinkLimitGiB),
+		ratio(down, l.DownlinkLimitGiB),
+		ratio(up+down, l.TotalLimitGiB),
+	} {
+		if r > usage {
+			usage = r
+		}
+	}
+	return usage
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+type quotaStep struct {
+	now       string
+	txKiB     int64
+	rxKiB     int64
+	exhausted bool
+	// usedTx and usedRx are the usage of the cycle after the step
+	usedTx int64
+	usedRx int64
+}
+
+func resetQuota() {
+	quotaExhausted.Store(false)
+	quotaNear.Store(false)
+}
+
+func TestCheckQuota(t *testing.T) {
+	monthly := config.BandwidthLimit{
+		TotalLimitGiB: 1,
+		Cycle:         config.BillingCycle{Day: 1, Timezone: "UTC"},
+		Enforce:       true,
+	}
+	uplink := monthly
+	uplink.TotalLimitGiB, uplink.UplinkLimitGiB = 0, 1
+	days := monthly
+	days.Cycle = config.BillingCycle{Type: CycleDays, Days: 10, Anchor: "2023-01-01", Timezone: "UTC"}
+	tt := []struct {
+		name  string
+		limit config.BandwidthLimit
+		steps []quotaStep
+	}{
+		{
+			name:  "usage within a cycle",
+			limit: monthly,
+			steps: []quotaStep{
+				{now: "2023-01-15", txKiB: 100, rxKiB: 200},
+				{now: "2023-01-20", txKiB: 400100, rxKiB: 500200, usedTx: 400000, usedRx: 500000},
+				{now: "2023-01-21", txKiB: 500100, rxKiB: 500200, exhausted: true, usedTx: 500000, usedRx: 500000},
+			},
+		},
+		{
+			name:  "rollover",
+			limit: monthly,
+			steps: []quotaStep{
+				{now: "2023-01-15", txKiB: 100, rxKiB: 200},
+				{now: "2023-01-31", txKiB: 600100, rxKiB: 400200, exhausted: true, usedTx: 600000, usedRx: 400000},
+				// the counters at the reset are the initial ones of the new cycle
+				{now: "2023-02-01", txKiB: 600200, rxKiB: 400300},
+				{now: "2023-02-02", txKiB: 700200, rxKiB: 400300, usedTx: 100000},
+			},
+		},
+		{
+			name:  "rollover of days cycles",
+			limit: days,
+			steps: []quotaStep{
+				{now: "2023-01-09", txKiB: 0, rxKiB: 0},
+				{now: "2023-01-10", txKiB: 1000000, rxKiB: 0, exhausted: true, usedTx: 1000000},
+				{now: "2023-01-11", txKiB: 1000000, rxKiB: 0},
+			},
+		},
+		{
+			name:  "counters decrease",
+			limit: monthly,
+			steps: []quotaStep{
+				{now: "2023-01-15", txKiB: 100, rxKiB: 200},
+				{now: "2023-01-16", txKiB: 300100, rxKiB: 200200, usedTx: 300000, usedRx: 200000},
+				// the interface is reset, which keeps the usage before
+				{now: "2023-01-17", txKiB: 0, rxKiB: 0, usedTx: 300000, usedRx: 200000},
+				{now: "2023-01-18", txKiB: 500000, rxKiB: 0, exhausted: true, usedTx: 800000, usedRx: 200000},
+			},
+		},
+		{
+			name:  "uplink limit",
+			limit: uplink,
+			steps: []quotaStep{
+				{now: "2023-01-15", txKiB: 0, rxKiB: 0},
+				{now: "2023-01-16", txKiB: 999999, rxKiB: 5000000, usedTx: 999999, usedRx: 5000000},
+				{now: "2023-01-17", txKiB: 1000000, rxKiB: 5000000, exhausted: true, usedTx: 1000000, usedRx: 5000000},
+			},
+		},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			resetQuota()
+			defer resetQuota()
+			var state quotaState
+			for _, step := range test.steps {
+				now, err := time.Parse(time.DateOnly, step.now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				now = now.Add(time.Hour)
+				if err = checkQuota(&state, test.limit, step.txKiB, step.rxKiB, now); err != nil {
+					t.Fatal(err)
+				}
+				if QuotaExhausted() != step.exhausted {
+					t.Errorf("%v: exhausted: %v", step.now, QuotaExhausted())
+				}
+				if usedTx, usedRx := state.TxKiB-state.TxInitialKiB, state.RxKiB-state.RxInitialKiB; usedTx != step.usedTx || usedRx != step.usedRx {
+					t.Errorf("%v: used %v and %v, want %v and %v", step.now, usedTx, usedRx, step.usedTx, step.usedRx)
+				}
+			}
+		})
+	}
+}
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCheckQuotaTearDown(t *testing.T) {
+	for _, tearDown := range []bool{false, true} {
+		resetQuota()
+		user, manager := testPassage("user", false), testPassage("manager", true)
+		userConn, managerConn := &closeRecorder{}, &closeRecorder{}
+		userSess := NewSession(SessionInfo{Protocol: "shadowsocks", Network: "tcp", Passage: &user}, userConn)
+		managerSess := NewSession(SessionInfo{Protocol: "shadowsocks", Network: "tcp", Passage: &manager}, managerConn)
+
+		limit := config.BandwidthLimit{
+			TotalLimitGiB:       1,
+			Cycle:               config.BillingCycle{Day: 1, Timezone: "UTC"},
+			Enforce:             true,
+			TearDownOnExhausted: tearDown,
+		}
+		var state quotaState
+		now := time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)
+		if err := checkQuota(&state, limit, 0, 0, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkQuota(&state, limit, 1000000, 0, now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		// new sessions are refused either way, except for the manager
+		if err := CheckQuota(&user); err != ErrQuotaExhausted {
+			t.Errorf("tearDown %v: new session of a user: %v", tearDown, err)
+		}
+		if err := CheckQuota(&manager); err != nil {
+			t.Errorf("tearDown %v: new session of the manager: %v", tearDown, err)
+		}
+		if userConn.closed != tearDown {
+			t.Errorf("tearDown %v: existing session of a user closed: %v", tearDown, userConn.closed)
+		}
+		if tearDown && userSess.CloseReason() != CloseReasonQuota {
+			t.Errorf("close reason: %v", userSess.CloseReason())
+		}
+		if managerConn.closed {
+			t.Errorf("tearDown %v: the session of the manager is closed", tearDown)
+		}
+		userSess.Done()
+		managerSess.Done()
+	}
+	resetQuota()
+}
+
+func TestQuotaStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), QuotaStateFile)
+	if state := loadQuotaState(path); state != (quotaState{}) {
+		t.Errorf("state of a missing file: %+v", state)
+	}
+	limit := config.BandwidthLimit{
+		TotalLimitGiB: 1,
+		Cycle:         config.BillingCycle{Day: 1, Timezone: "UTC"},
+		Enforce:       true,
+	}
+	resetQuota()
+	defer resetQuota()
+	var state quotaState
+	now := time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)
+	if err := checkQuota(&state, limit, 100, 100, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkQuota(&state, limit, 300100, 100, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveQuotaState(path, state); err != nil {
+		t.Fatal(err)
+	}
+
+	// the usage of the cycle survives a restart, after which the counters start from zero
+	loaded := loadQuotaState(path)
+	if !loaded.CycleStart.Equal(state.CycleStart) || loaded.TxInitialKiB != state.TxInitialKiB ||
+		loaded.RxInitialKiB != state.RxInitialKiB || loaded.TxKiB != state.TxKiB || loaded.RxKiB != state.RxKiB {
+		t.Fatalf("loaded %+v, saved %+v", loaded, state)
+	}
+	if err := checkQuota(&loaded, limit, 200000, 0, now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if used := loaded.TxKiB - loaded.TxInitialKiB; used != 300000 || QuotaExhausted() {
+		t.Errorf("used %v right after the restart, exhausted: %v", used, QuotaExhausted())
+	}
+	if err := checkQuota(&loaded, limit, 900000, 0, now.Add(3*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if used := loaded.TxKiB - loaded.TxInitialKiB; used != 1000000 || !QuotaExhausted() {
+		t.Errorf("used %v after the restart, exhausted: %v", used, QuotaExhausted())
+	}
+
+	if err := saveQuotaState("", state); err != nil {
+		t.Errorf("saving without a path: %v", err)
+	}
+}
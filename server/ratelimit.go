@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+)
+
+const (
+	// rateActiveWindow is the time a passage keeps taking a share of the rate limit after its last traffic.
+	rateActiveWindow = time.Second
+	rateBucketExpiry = time.Minute
+	rateBurst        = 100 * time.Millisecond
+	rateMinBurst     = 64 * 1024
+)
+
+var (
+	upRateLimiter   *RateLimiter
+	downRateLimiter *RateLimiter
+)
+
+type rateProfile struct {
+	// from and to are the minutes of the day
+	from, to int
+	up, down float64
+}
+
+// InitRateLimiter parses the node-wide rate limit from the config.
+func InitRateLimiter() error {
+	conf := config.ParamsObj.John.RateLimit
+	loc := time.Local
+	if conf.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(conf.Timezone); err != nil {
+			return fmt.Errorf("bad timezone of rate limit: %w", err)
+		}
+	}
+	var profiles []rateProfile
+	for _, p := range conf.Profiles {
+		from, err := parseMinuteOfDay(p.From)
+		if err != nil {
+			return err
+		}
+		to, err := parseMinuteOfDay(p.To)
+		if err != nil {
+			return err
+		}
+		profiles = append(profiles, rateProfile{
+			from: from,
+			to:   to,
+			up:   mbpsToBytes(p.UpMbps),
+			down: mbpsToBytes(p.DownMbps),
+		})
+	}
+	if conf.UpMbps <= 0 && conf.DownMbps <= 0 && len(profiles) == 0 {
+		upRateLimiter, downRateLimiter = nil, nil
+		return nil
+	}
+	upRateLimiter = NewRateLimiter(func(now time.Time) float64 {
+		if p := profileAt(profiles, loc, now); p != nil {
+			return p.up
+		}
+		return mbpsToBytes(conf.UpMbps)
+	})
+	downRateLimiter = NewRateLimiter(func(now time.Time) float64 {
+		if p := profileAt(profiles, loc, now); p != nil {
+			return p.down
+		}
+		return mbpsToBytes(conf.DownMbps)
+	})
+	return nil
+}
+
+// profileAt returns the profile in effect at the time in loc, or nil if none. A profile whose from is later than its
+// to lasts across midnight.
+func profileAt(profiles []rateProfile, loc *time.Location, now time.Time) *rateProfile {
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	for i, p := range profiles {
+		if (p.from <= p.to && minute >= p.from && minute < p.to) ||
+			(p.from > p.to && (minute >= p.from || minute < p.to)) {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+func parseMinuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time of rate limit profile: %v", strconv.Quote(s))
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func mbpsToBytes(mbps float64) float64 {
+	return mbps * 1000 * 1000 / 8
+}
+
+type rateBucket struct {
+	mu      sync.Mutex
+	tokens  float64
+	lastUse time.Time
+	// active is whether the bucket is counted in RateLimiter.active
+	active bool
+	// removed is set once the bucket is dropped from the limiter, after which it should not be used
+	removed bool
+}
+
+// RateLimiter limits the total rate of all keys, and shares it fairly between the active keys.
+type RateLimiter struct {
+	mu      sync.RWMutex
+	buckets map[string]*rateBucket
+	// active is the number of buckets used within rateActiveWindow, which is updated by the buckets turning active
+	// and by sweep
+	active atomic.Int64
+	// lastSweep is the UnixNano of the last sweep
+	lastSweep atomic.Int64
+	// rateAt returns the rate in bytes per second at the given time. Zero means no limit.
+	rateAt func(now time.Time) float64
+}
+
+func NewRateLimiter(rateAt func(now time.Time) float64) *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*rateBucket),
+		rateAt:  rateAt,
+	}
+}
+
+// Wait consumes n bytes for the key and blocks until the rate is under the limit.
+func (l *RateLimiter) Wait(key string, n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	if wait := l.reserve(key, n, time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// reserve consumes n bytes for the key at now, and returns the time to wait for the rate to get under the limit.
+func (l *RateLimiter) reserve(key string, n int, now time.Time) time.Duration {
+	rate := l.rateAt(now)
+	if rate <= 0 {
+		return 0
+	}
+	if last := l.lastSweep.Load(); now.UnixNano()-last >= int64(rateActiveWindow) &&
+		l.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		l.sweep(now)
+	}
+	for {
+		b := l.bucket(key, now)
+		b.mu.Lock()
+		if b.removed {
+			b.mu.Unlock()
+			continue
+		}
+		if !b.active {
+			b.active = true
+			l.active.Add(1)
+		}
+		share := rate / float64(max(l.active.Load(), 1))
+		burst := max(share*rateBurst.Seconds(), rateMinBurst)
+		b.tokens = min(b.tokens+now.Sub(b.lastUse).Seconds()*share, burst) - float64(n)
+		b.lastUse = now
+		tokens := b.tokens
+		b.mu.Unlock()
+		if tokens >= 0 {
+			return 0
+		}
+		return time.Duration(-tokens / share * float64(time.Second))
+	}
+}
+
+func (l *RateLimiter) bucket(key string, now time.Time) *rateBucket {
+	l.mu.RLock()
+	b, ok := l.buckets[key]
+	l.mu.RUnlock()
+	if ok {
+		return b
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok = l.buckets[key]; !ok {
+		b = &rateBucket{lastUse: now}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// sweep stops counting the buckets idle for rateActiveWindow as active, and drops the ones idle for
+// rateBucketExpiry. It runs at most once per rateActiveWindow.
+func (l *RateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, b := range l.buckets {
+		b.mu.Lock()
+		idle := now.Sub(b.lastUse)
+		if b.active && idle >= rateActiveWindow {
+			b.active = false
+			l.active.Add(-1)
+		}
+		if idle > rateBucketExpiry {
+			b.removed = true
+			delete(l.buckets, k)
+		}
+		b.mu.Unlock()
+	}
+}
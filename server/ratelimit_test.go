@@ -0,0 +1,140 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func constantRate(rate float64) func(now time.Time) float64 {
+	return func(now time.Time) float64 { return rate }
+}
+
+func TestRateLimiterShare(t *testing.T) {
+	const rate = 1000 * 1000
+	l := NewRateLimiter(constantRate(rate))
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// a passage alone takes the whole rate
+	if wait := l.reserve("a", rate, t0); wait != time.Second {
+		t.Errorf("wait of a single passage: %v", wait)
+	}
+	// two active passages split the rate
+	if wait := l.reserve("b", rate, t0); wait != 2*time.Second {
+		t.Errorf("wait of two passages: %v", wait)
+	}
+	if n := l.active.Load(); n != 2 {
+		t.Errorf("active passages: %v", n)
+	}
+
+	// a stops sending and b takes the whole rate again
+	t1 := t0.Add(3 * time.Second)
+	if wait := l.reserve("b", rate, t1); wait != 900*time.Millisecond {
+		t.Errorf("wait after the other passage is idle: %v", wait)
+	}
+	if n := l.active.Load(); n != 1 {
+		t.Errorf("active passages after a is idle: %v", n)
+	}
+
+	// idle buckets are dropped
+	l.reserve("b", 1, t1.Add(rateBucketExpiry+time.Second))
+	l.mu.RLock()
+	_, ok := l.buckets["a"]
+	l.mu.RUnlock()
+	if ok {
+		t.Error("the bucket of an idle passage is kept")
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	const rate = 10 * 1000 * 1000
+	l := NewRateLimiter(constantRate(rate))
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.reserve("a", 1, t0)
+	// tokens saved while idle are capped by the burst
+	burst := rate * rateBurst.Seconds()
+	if wait := l.reserve("a", int(burst), t0.Add(time.Minute)); wait != 0 {
+		t.Errorf("wait within the burst: %v", wait)
+	}
+	if wait := l.reserve("a", rate/10, t0.Add(time.Minute)); wait != 100*time.Millisecond {
+		t.Errorf("wait beyond the burst: %v", wait)
+	}
+}
+
+func TestRateLimiterProfiles(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	profiles := []rateProfile{
+		{from: 9 * 60, to: 17 * 60, up: 1000 * 1000},
+		// across midnight
+		{from: 22 * 60, to: 2 * 60, up: 500 * 1000},
+	}
+	rateAt := func(now time.Time) float64 {
+		if p := profileAt(profiles, loc, now); p != nil {
+			return p.up
+		}
+		return 2000 * 1000
+	}
+	for _, c := range []struct {
+		clock string
+		rate  float64
+	}{
+		{"08:59", 2000 * 1000},
+		{"09:00", 1000 * 1000},
+		{"16:59", 1000 * 1000},
+		{"17:00", 2000 * 1000},
+		{"22:00", 500 * 1000},
+		{"00:30", 500 * 1000},
+		{"02:00", 2000 * 1000},
+	} {
+		clock, err := time.ParseInLocation("15:04", c.clock, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2024, 1, 1, clock.Hour(), clock.Minute(), 0, 0, loc)
+		if rate := rateAt(now); rate != c.rate {
+			t.Errorf("rate at %v: got %v, want %v", c.clock, rate, c.rate)
+		}
+		// the profile applies in its timezone
+		if rate := rateAt(now.UTC()); rate != c.rate {
+			t.Errorf("rate at %v in UTC: got %v, want %v", c.clock, rate, c.rate)
+		}
+	}
+
+	// the limiter follows the profile in effect
+	l := NewRateLimiter(rateAt)
+	t0 := time.Date(2024, 1, 1, 16, 0, 0, 0, loc)
+	if wait := l.reserve("a", 1000*1000, t0); wait != time.Second {
+		t.Errorf("wait in the day profile: %v", wait)
+	}
+	t1 := time.Date(2024, 1, 1, 23, 0, 0, 0, loc)
+	if wait := l.reserve("a", 1000*1000, t1); wait != 2*time.Second {
+		t.Errorf("wait in the night profile: %v", wait)
+	}
+}
+
+func TestRateLimiterNoLimit(t *testing.T) {
+	l := NewRateLimiter(constantRate(0))
+	if wait := l.reserve("a", 1<<30, time.Now()); wait != 0 {
+		t.Errorf("wait without limit: %v", wait)
+	}
+	var nilLimiter *RateLimiter
+	nilLimiter.Wait("a", 1)
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	l := NewRateLimiter(constantRate(1 << 40))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				l.Wait(key, 1024)
+			}
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+	if n := l.active.Load(); n < 1 || n > 8 {
+		t.Errorf("active keys: %v", n)
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// MetadataCmdRecentLogs asks for the recent log entries kept in memory. It follows the commands of softwind.
+const MetadataCmdRecentLogs = protocol.MetadataCmdResponse + 1
+
+// RecentLogsReq is the optional body of MetadataCmdRecentLogs.
+type RecentLogsReq struct {
+	// Limit is the max number of entries to return. Zero means all.
+	Limit int `json:",omitempty"`
+}
+
+type RecentLogsResp struct {
+	// Entries are from the oldest, each of which is a JSON object with time, level, caller, component and msg
+	Entries []json.RawMessage
+}
+
+// GenerateRecentLogsResp reads the request of MetadataCmdRecentLogs from the body and returns the response.
+func GenerateRecentLogsResp(reqBody io.Reader) ([]byte, error) {
+	var req RecentLogsReq
+	if err := jsoniter.NewDecoder(reqBody).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if req.Limit < 0 {
+		req.Limit = 0
+	}
+	return jsoniter.Marshal(RecentLogsResp{Entries: log.RecentEntries(req.Limit)})
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
 	"io"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -28,14 +29,24 @@ type Argument struct {
 	Port       int
 
 	NoRelay bool
+
+	// Groups are the SweetLisa instances to register at besides the one of Ticket.
+	Groups []Group
 }
 
 type Server interface {
 	Listen(addr string) (err error)
 	AddPassages(passages []Passage) (err error)
 	RemovePassages(passages []Passage, alsoManager bool) (err error)
+	// UpdatePassages adds and removes the passages at once. The passages to add are accepted before the ones to
+	// remove are dropped, so that a passage being replaced never fails the auth. Managers are not removed.
+	UpdatePassages(toRemove []Passage, toAdd []Passage) (err error)
 	SyncPassages(passages []Passage) (err error)
 	Passages() (passages []Passage)
+	// LastAlive returns the last time SweetLisa was seen. Zero means not registered.
+	LastAlive() time.Time
+	// Reregister registers at SweetLisa of the groups again, or of every group if none is given.
+	Reregister(groups ...string) (err error)
 	io.Closer
 }
 
@@ -43,6 +54,11 @@ type Creator func(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHos
 
 var Mapper = make(map[string]Creator)
 
+var (
+	servers   []Server
+	muServers sync.Mutex
+)
+
 func Register(name string, c Creator) {
 	Mapper[name] = c
 }
@@ -52,5 +68,19 @@ func NewServer(valueCtx context.Context, dialer netproxy.Dialer, protocol string
 	if !ok {
 		return nil, fmt.Errorf("no server creator registered for %v", strconv.Quote(protocol))
 	}
-	return creator(valueCtx, dialer, sweetLisaHost, arg)
+	s, err := creator(valueCtx, dialer, sweetLisaHost, arg)
+	if err != nil {
+		return nil, err
+	}
+	muServers.Lock()
+	servers = append(servers, s)
+	muServers.Unlock()
+	return s, nil
+}
+
+// Servers returns the servers created by NewServer.
+func Servers() []Server {
+	muServers.Lock()
+	defer muServers.Unlock()
+	return append([]Server(nil), servers...)
 }
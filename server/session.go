@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+// SessionInfo describes a relaying session.
+type SessionInfo struct {
+	// ID is allocated by NewConnID when the inbound connection is accepted
+	ID       uint64
+	Protocol string
+	Network  string
+	Passage  *Passage
+	// Source is the address of the client
+	Source string
+	// Target is the address the client asked to connect to
+	Target string
+}
+
+// Session is a relaying session that can be torn down from outside.
+type Session struct {
+	SessionInfo
+	Start time.Time
+
+	up   atomic.Int64
+	down atomic.Int64
+	// passageKey identifies the passage in rate limiters
+	passageKey string
+	closers    []io.Closer
+	closeOnce  sync.Once
+	closeErr   error
+
+	muReason sync.Mutex
+	// reason is why the session ended
+	reason string
+}
+
+const (
+	CloseReasonNormal = "normal"
+	CloseReasonKilled = "killed"
+	CloseReasonQuota  = "quota"
+	// CloseReasonWithdrawn is for sessions closed when the node withdraws from SweetLisa
+	CloseReasonWithdrawn = "withdrawn"
+	// CloseReasonUnknown is for sessions ended without a recorded reason
+	CloseReasonUnknown = "unknown"
+)
+
+var (
+	sessions   = make(map[*Session]struct{})
+	muSessions sync.Mutex
+)
+
+// NewSession tracks a relaying session. Closing the session closes the given closers.
+// Done should be called once the session ends.
+func NewSession(info SessionInfo, closers ...io.Closer) *Session {
+	if info.ID == 0 {
+		info.ID = NewConnID()
+	}
+	s := &Session{
+		SessionInfo: info,
+		Start:       time.Now(),
+		passageKey:  info.Passage.In.Argument.Hash(),
+		closers:     closers,
+	}
+	muSessions.Lock()
+	sessions[s] = struct{}{}
+	muSessions.Unlock()
+	return s
+}
+
+// Done stops tracking the session and writes it to the access log.
+func (s *Session) Done() {
+	muSessions.Lock()
+	delete(sessions, s)
+	muSessions.Unlock()
+	logAccess(s)
+}
+
+// End records the error the relaying ended with as the close reason, unless a reason has been recorded.
+// It returns err as it is.
+func (s *Session) End(err error) error {
+	reason := CloseReasonNormal
+	if err != nil {
+		reason = log.ErrorClass(err)
+	}
+	s.setReason(reason)
+	return err
+}
+
+func (s *Session) setReason(reason string) {
+	s.muReason.Lock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.muReason.Unlock()
+}
+
+// CloseReason returns why the session ended.
+func (s *Session) CloseReason() string {
+	s.muReason.Lock()
+	defer s.muReason.Unlock()
+	if s.reason == "" {
+		return CloseReasonUnknown
+	}
+	return s.reason
+}
+
+// AddUp counts the bytes relayed from the client to the target, and waits if the rate exceeds the limit.
+func (s *Session) AddUp(n int) {
+	s.up.Add(int64(n))
+	AddRelayedUp(n)
+	upRateLimiter.Wait(s.passageKey, n)
+}
+
+// AddDown counts the bytes relayed from the target to the client, and waits if the rate exceeds the limit.
+func (s *Session) AddDown(n int) {
+	s.down.Add(int64(n))
+	AddRelayedDown(n)
+	downRateLimiter.Wait(s.passageKey, n)
+}
+
+// Traffic returns the number of bytes relayed in the session.
+func (s *Session) Traffic() (up, down int64) {
+	return s.up.Load(), s.down.Load()
+}
+
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		var errs []error
+		for _, c := range s.closers {
+			errs = append(errs, c.Close())
+		}
+		s.closeErr = errors.Join(errs...)
+	})
+	return s.closeErr
+}
+
+// RangeSessions calls f for every tracked session.
+func RangeSessions(f func(s *Session)) {
+	muSessions.Lock()
+	defer muSessions.Unlock()
+	for s := range sessions {
+		f(s)
+	}
+}
+
+// CloseSessions closes the tracked sessions that f returns true for with the reason, and returns the number of them.
+func CloseSessions(reason string, f func(s *Session) bool) (n int) {
+	muSessions.Lock()
+	var toClose []*Session
+	for s := range sessions {
+		if f(s) {
+			toClose = append(toClose, s)
+		}
+	}
+	muSessions.Unlock()
+	for _, s := range toClose {
+		s.setReason(reason)
+		_ = s.Close()
+	}
+	return len(toClose)
+}
@@ -20,11 +20,11 @@ import (
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/infra/ip_mtu_trie"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/infra/lru"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/disk_bloom"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
 	gonanoid "github.com/matoous/go-nanoid"
-	disk_bloom "github.com/mzz2017/disk-bloom"
 )
 
 func init() {
@@ -33,11 +33,10 @@ func init() {
 }
 
 type Server struct {
-	closed    chan struct{}
-	sweetLisa config.Lisa
-	typ       string
-	arg       server.Argument
-	lastAlive time.Time
+	closed        chan struct{}
+	typ           string
+	arg           server.Argument
+	registrations []*server.Registration
 	// mutex protects passages
 	mutex           sync.Mutex
 	passages        []Passage
@@ -48,7 +47,7 @@ type Server struct {
 	// passageContentionCache log the last client IP of passages
 	passageContentionCache *server.ContentionCache
 
-	bloom  *disk_bloom.FilterGroup
+	bloom  *disk_bloom.Bloom
 	dialer netproxy.Dialer
 }
 
@@ -58,7 +57,7 @@ type Passage struct {
 }
 
 func New(valueCtx context.Context, dialer netproxy.Dialer) (server.Server, error) {
-	bloom := valueCtx.Value("bloom").(*disk_bloom.FilterGroup)
+	bloom := valueCtx.Value("bloom").(*disk_bloom.Bloom)
 	s := &Server{
 		userContextPool: (*UserContextPool)(lru.New(lru.FixedTimeout, int64(1*time.Hour))),
 		nm:              NewUDPConnMapping(),
@@ -75,23 +74,30 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisa config.
 		return nil, err
 	}
 	john := s.(*Server)
-	john.sweetLisa = sweetLisa
 	john.arg = arg
+	john.registrations = server.NewRegistrations(server.Groups(sweetLisa, arg))
 	john.passageContentionCache = server.NewContentionCache()
-	if err := s.AddPassages([]server.Passage{{Manager: true}}); err != nil {
+	var managers []server.Passage
+	for _, r := range john.registrations {
+		managers = append(managers, server.Passage{Manager: true, Group: r.Ticket})
+	}
+	if err := s.AddPassages(managers); err != nil {
 		return nil, err
 	}
 
 	// connect to SweetLisa and register
-	if err := john.register(); err != nil {
+	if err := server.RegisterFirst(john.registrations, john.register); err != nil {
 		return nil, err
 	}
-	go john.registerBackground()
+	for _, r := range john.registrations {
+		go john.registerBackground(r)
+	}
 	return john, nil
 }
 
-func (s *Server) registerBackground() {
+func (s *Server) registerBackground(r *server.Registration) {
 	var interval = 2 * time.Second
+	var lost server.LostTracker
 	ticker := time.NewTicker(interval)
 	for {
 		select {
@@ -100,12 +106,17 @@ func (s *Server) registerBackground() {
 			log.Debug("Server was closed")
 			return
 		case <-ticker.C:
-			if time.Since(s.lastAlive) < server.LostThreshold {
+			if server.Withdrawn(r.Ticket) {
+				// registering waits for the CDN validation to pass
+				continue
+			}
+			if time.Since(r.LastAlive()) < server.LostThreshold {
 				continue
 			} else {
-				log.Warn("Lost connection with SweetLisa more than 5 minutes. Try to register again")
+				lost.Lost(r.LastAlive())
+				log.Warn("Lost connection with SweetLisa %v more than 5 minutes. Try to register again", strconv.Quote(r.Lisa.Host))
 			}
-			if err := s.register(); err != nil {
+			if err := s.register(r); err != nil {
 				// binary exponential backoff algorithm
 				// to avoid DDoS
 				interval = interval * 2
@@ -115,6 +126,7 @@ func (s *Server) registerBackground() {
 				log.Warn("registerBackground: %v. retry in %v", err, interval.String())
 			} else {
 				log.Debug("Suc Reg")
+				lost.Registered()
 				interval = 2 * time.Second
 			}
 			ticker.Reset(interval)
@@ -122,28 +134,17 @@ func (s *Server) registerBackground() {
 	}
 }
 
-func (s *Server) register() error {
-	var manager server.Passage
-	users := s.Passages()
-	for _, u := range users {
-		if u.Manager {
-			manager = u
-			break
-		}
-	}
+func (s *Server) register(r *server.Registration) error {
+	manager := server.ManagerOf(s.Passages(), r.Ticket)
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
-	var validateToken string
-	if len(t) > 0 {
-		validateToken = t[0]
-	}
+	validateToken := api.DefaultClient().LookupValidateToken(ctx, r.Lisa.Host)
 	bandwidthLimit, err := server.GenerateBandwidthLimit()
 	if err != nil {
 		return err
 	}
-	cdnNames, users, err := api.Register(ctx, s.sweetLisa.Host, validateToken, model.Server{
-		Ticket: s.arg.Ticket,
+	cdnNames, users, err := api.Register(ctx, r.Lisa.Host, validateToken, model.Server{
+		Ticket: r.Ticket,
 		Name:   s.arg.ServerName,
 		Hosts:  s.arg.Hostnames,
 		Port:   s.arg.Port,
@@ -158,15 +159,32 @@ func (s *Server) register() error {
 	if err != nil {
 		return err
 	}
-	log.Alert("Succeed to register at %v (%v)", strconv.Quote(s.sweetLisa.Host), cdnNames)
-	s.lastAlive = time.Now()
+	log.Alert("Succeed to register at %v (%v)", strconv.Quote(r.Lisa.Host), cdnNames)
+	r.Alive()
 	// sweetLisa can replace the manager key here
-	if err := s.SyncPassages(users); err != nil {
+	if err := server.SyncGroupPassages(s, r.Ticket, users); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (s *Server) LastAlive() time.Time {
+	return server.OldestAlive(s.registrations)
+}
+
+// Registrations returns the registrations of the groups of the server.
+func (s *Server) Registrations() []*server.Registration {
+	return s.registrations
+}
+
+func (s *Server) UserContextPoolSize() int {
+	return s.userContextPool.Infra().Len()
+}
+
+func (s *Server) Reregister(groups ...string) error {
+	return server.RegisterAll(s.registrations, s.register, groups...)
+}
+
 func (s *Server) SyncPassages(passages []server.Passage) (err error) {
 	return server.SyncPassages(s, passages)
 }
@@ -183,13 +201,20 @@ func (s *Server) ListenTCP(addr string) (err error) {
 			log.Warn("%v", err)
 		}
 		go func() {
-			err := s.handleTCP(conn)
+			info := server.SessionInfo{
+				ID:       server.NewConnID(),
+				Protocol: string(protocol.ProtocolShadowsocks),
+				Network:  "tcp",
+				Source:   conn.RemoteAddr().String(),
+			}
+			err := s.handleTCP(conn, &info)
 			if err != nil {
+				logger := info.Logger().WithError(err)
 				if errors.Is(err, server.ErrPassageAbuse) ||
 					errors.Is(err, protocol.ErrReplayAttack) {
-					log.Warn("handleTCP: %v", err)
+					logger.Warn("handleTCP: %v", err)
 				} else {
-					log.Info("handleTCP: %v", err)
+					logger.Info("handleTCP: %v", err)
 				}
 			}
 		}()
@@ -226,7 +251,7 @@ func (s *Server) ListenUDP(addr string) (err error) {
 		go func() {
 			err := s.handleUDP(lAddr, data)
 			if err != nil {
-				log.Warn("handleUDP: %v", err)
+				log.With("protocol", string(protocol.ProtocolShadowsocks)).With("network", "udp").WithError(err).Warn("handleUDP: %v", err)
 			}
 			pool.Put(data)
 		}()
@@ -262,15 +287,16 @@ func (s *Server) Close() error {
 	return err
 }
 
-func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passage) {
+func LocalizePassages(passages []server.Passage) (psgs []Passage, managers map[string]*Passage) {
 	psgs = make([]Passage, len(passages))
+	managers = make(map[string]*Passage)
 	for i, psg := range passages {
-		if psg.Manager {
+		if psg.Manager && psg.RetireAt.IsZero() {
 			psg.In.Password, _ = gonanoid.Generate(common.Alphabet, 21)
 			psg.In.Method = "aes-256-gcm"
-			// allow only one manager
-			if manager == nil {
-				manager = &psgs[i]
+			// allow only one manager in a group
+			if managers[psg.Group] == nil {
+				managers[psg.Group] = &psgs[i]
 			} else {
 				psg.Manager = false
 				log.Warn("found more than one manager")
@@ -282,19 +308,19 @@ func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passa
 		}
 		psgs[i].inMasterKey = common2.EVPBytesToKey(psg.In.Password, ciphers.AeadCiphersConf[psg.In.Method].KeyLen)
 	}
-	return psgs, manager
+	return psgs, managers
 }
 
 func (s *Server) AddPassages(passages []server.Passage) (err error) {
 	log.Trace("AddPassages: %v", len(passages))
-	us, managerKey := LocalizePassages(passages)
+	us, managers := LocalizePassages(passages)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	// update manager key
-	if managerKey != nil {
-		// remove manager key in UserContext
+	// update manager keys
+	if len(managers) > 0 {
+		// remove manager keys of the groups in UserContext
 		s.removePassagesFunc(func(passage *Passage) (remove bool) {
-			return passage.Manager == true
+			return passage.Manager && passage.RetireAt.IsZero() && managers[passage.Group] != nil
 		})
 	}
 	s.addPassages(us)
@@ -311,10 +337,10 @@ func (s *Server) RemovePassages(passages []server.Passage, alsoManager bool) (er
 		if passage.Manager && !alsoManager {
 			continue
 		}
-		keySet[passage.In.Argument.Hash()] = struct{}{}
+		keySet[server.PassageKey(&passage.Passage)] = struct{}{}
 	}
 	s.removePassagesFunc(func(passage *Passage) (remove bool) {
-		_, ok := keySet[passage.In.Argument.Hash()]
+		_, ok := keySet[server.PassageKey(&passage.Passage)]
 		return ok
 	})
 	return nil
@@ -329,6 +355,54 @@ func (s *Server) Passages() (passages []server.Passage) {
 	return passages
 }
 
+func (s *Server) UpdatePassages(toRemove []server.Passage, toAdd []server.Passage) (err error) {
+	log.Trace("UpdatePassages: %v to remove, %v to add", len(toRemove), len(toAdd))
+	us, managers := LocalizePassages(toAdd)
+	var keySet = make(map[string]struct{})
+	for i := range toRemove {
+		if !toRemove[i].Manager {
+			keySet[server.PassageKey(&toRemove[i])] = struct{}{}
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.swapPassages(us, func(passage *Passage) (remove bool) {
+		if passage.Manager {
+			return passage.RetireAt.IsZero() && managers[passage.Group] != nil
+		}
+		_, ok := keySet[server.PassageKey(&passage.Passage)]
+		return ok
+	})
+	return nil
+}
+
+// swapPassages adds the passages and then removes the others that f returns true for.
+func (s *Server) swapPassages(passages []Passage, f func(passage *Passage) (remove bool)) {
+	added := make(map[*Passage]struct{}, len(passages))
+	for i := range passages {
+		added[&passages[i]] = struct{}{}
+	}
+	n := len(s.passages)
+	s.addPassages(passages)
+	for i := n - 1; i >= 0; i-- {
+		if f(&s.passages[i]) {
+			s.passages = append(s.passages[:i], s.passages[i+1:]...)
+		}
+	}
+	socketIdents := s.userContextPool.Infra().GetKeys()
+	for _, ident := range socketIdents {
+		userContext := s.userContextPool.Infra().Get(ident).(*UserContext).Infra()
+		listCopy := userContext.GetListCopy()
+		for _, node := range listCopy {
+			passage := node.Val.(*Passage)
+			if _, ok := added[passage]; !ok && f(passage) {
+				userContext.Remove(node)
+			}
+		}
+		userContext.DestroyListCopy(listCopy)
+	}
+}
+
 func (s *Server) addPassages(passages []Passage) {
 	s.passages = append(s.passages, passages...)
 
@@ -363,6 +437,14 @@ func (s *Server) removePassagesFunc(f func(passage *Passage) (remove bool)) {
 }
 
 func (s *Server) ContentionCheck(thisIP net.IP, passage *Passage) (err error) {
+	if passage.Manager {
+		if passage.Retired(time.Now()) {
+			return server.ErrRetiredManager
+		}
+		if err = server.CheckManagerSource(s, passage.Group, thisIP); err != nil {
+			return err
+		}
+	}
 	if s.passageContentionCache == nil {
 		return nil
 	}
@@ -371,7 +453,7 @@ func (s *Server) ContentionCheck(thisIP net.IP, passage *Passage) (err error) {
 		passageKey := passage.In.Argument.Hash()
 		accept, conflictIP := s.passageContentionCache.Check(passageKey, contentionDuration, thisIP)
 		if !accept {
-			return fmt.Errorf("%w: from %v and %v: contention detected", server.ErrPassageAbuse, thisIP.String(), conflictIP.String())
+			return fmt.Errorf("%w: from %v and %v: contention detected", server.ErrPassageAbuse, log.Host(thisIP.String()), log.Host(conflictIP.String()))
 		}
 	}
 	return nil
@@ -19,7 +19,6 @@ import (
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/bufferred_conn"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
 	jsoniter "github.com/json-iterator/go"
 )
 
@@ -39,10 +38,18 @@ func (s *Server) handleMsg(crw *shadowsocks.TCPConn, reqMetadata *shadowsocks.Me
 	log.Trace("handleMsg: cmd: %v", reqMetadata.Cmd)
 
 	var reqBody = io.LimitReader(crw, int64(reqMetadata.LenMsgBody))
+	reqBody, err := server.VerifyMsg(passage.Group, reqMetadata.Cmd, reqBody)
+	if err != nil {
+		return err
+	}
 
 	var resp []byte
 	switch reqMetadata.Cmd {
 	case protocol.MetadataCmdPing:
+		if server.Withdrawn(passage.Group) {
+			// SweetLisa should take the node as offline
+			return server.ErrWithdrawn
+		}
 		buf := pool.Get(4)
 		defer pool.Put(buf)
 		if _, err := io.ReadFull(reqBody, buf); err != nil {
@@ -52,13 +59,15 @@ func (s *Server) handleMsg(crw *shadowsocks.TCPConn, reqMetadata *shadowsocks.Me
 			log.Warn("the body of received ping message is %v instead of %v", strconv.Quote(string(buf)), strconv.Quote("ping"))
 		}
 		log.Trace("Received a ping message")
-		s.lastAlive = time.Now()
-		bandwidthLimit, err := server.GenerateBandwidthLimit()
+		if err := server.Pinged(s.registrations, passage.Group); err != nil {
+			return err
+		}
+		pingResp, err := server.GeneratePingResp(s, passage.Group)
 		if err != nil {
 			log.Warn("generatePingResp: %v", err)
 			return err
 		}
-		bPingResp, err := jsoniter.Marshal(model.PingResp{BandwidthLimit: bandwidthLimit})
+		bPingResp, err := jsoniter.Marshal(pingResp)
 		if err != nil {
 			log.Warn("Marshal: %v", err)
 			return err
@@ -66,37 +75,35 @@ func (s *Server) handleMsg(crw *shadowsocks.TCPConn, reqMetadata *shadowsocks.Me
 
 		resp = bPingResp
 	case protocol.MetadataCmdSyncPassages:
-		var passages []model.Passage
-		if err := jsoniter.NewDecoder(reqBody).Decode(&passages); err != nil {
+		if err := server.HandleSyncPassages(s, passage.Group, reqBody); err != nil {
 			return err
 		}
-		var serverPassages []server.Passage
-		for _, passage := range passages {
-			var user = server.Passage{
-				Passage: passage,
-				Manager: false,
-			}
-			serverPassages = append(serverPassages, user)
-		}
-		log.Info("Server asked to SyncPassages")
-		// sweetLisa can replace the manager passage here
-		if err := s.SyncPassages(serverPassages); err != nil {
+		resp = []byte("OK")
+	case server.MetadataCmdUpdatePassages:
+		if err := server.HandleUpdatePassages(s, passage.Group, reqBody); err != nil {
 			return err
 		}
-
 		resp = []byte("OK")
+	case server.MetadataCmdRecentLogs:
+		log.Info("Server asked for recent logs")
+		bResp, err := server.GenerateRecentLogsResp(reqBody)
+		if err != nil {
+			return err
+		}
+		resp = bResp
 	default:
 		return fmt.Errorf("%w: unexpected metadata cmd type: %v", protocol.ErrFailAuth, reqMetadata.Cmd)
 	}
 
-	_, err := crw.Write(resp)
+	_, err = crw.Write(resp)
 	return err
 }
 
-func (s *Server) handleTCP(conn net.Conn) error {
+func (s *Server) handleTCP(conn net.Conn, info *server.SessionInfo) error {
 	bConn := bufferred_conn.NewBufferedConnSize(conn.(*net.TCPConn), TCPBufferSize)
 	passage, err := s.authTCP(bConn)
 	if err != nil {
+		server.ObserveAuthError(string(protocol.ProtocolShadowsocks), err)
 		// Auth fail. Drain the conn
 		if config.ParamsObj.John.MaxDrainN == -1 {
 			io.Copy(io.Discard, bConn)
@@ -104,9 +111,11 @@ func (s *Server) handleTCP(conn net.Conn) error {
 			io.CopyN(io.Discard, bConn, config.ParamsObj.John.MaxDrainN)
 		}
 		bConn.Close()
-		return fmt.Errorf("auth fail: %w. Drained the conn from: %v", err, conn.RemoteAddr().String())
+		return fmt.Errorf("auth fail: %w. Drained the conn from: %v", err, log.Addr(conn.RemoteAddr().String()))
 	}
 
+	info.Passage = &passage.Passage
+
 	// detect passage contention
 	if err := s.ContentionCheck(conn.RemoteAddr().(*net.TCPAddr).IP, passage); err != nil {
 		if config.ParamsObj.John.MaxDrainN == -1 {
@@ -123,7 +132,7 @@ func (s *Server) handleTCP(conn net.Conn) error {
 	lConn, err := shadowsocks.NewTCPConn(bConn, protocol.Metadata{
 		Cipher:   passage.In.Method,
 		IsClient: false,
-	}, passage.inMasterKey, s.bloom)
+	}, passage.inMasterKey, s.bloom.FilterGroup)
 	if err != nil {
 		bConn.Close()
 		return err
@@ -139,16 +148,20 @@ func (s *Server) handleTCP(conn net.Conn) error {
 		return s.handleMsg(lConn, &targetMetadata, passage)
 	}
 	target = net.JoinHostPort(targetMetadata.Hostname, strconv.Itoa(int(targetMetadata.Port)))
+	info.Target = target
 
 	// manager should not come to this line
 	if passage.Manager {
 		return fmt.Errorf("%w: manager key is ubused for a non-cmd connection", server.ErrPassageAbuse)
 	}
+	if err := server.CheckServing(&passage.Passage); err != nil {
+		return err
+	}
 
 	// Dial and relay
 	dialer := s.dialer
 	if passage.Out != nil {
-		header, err := server.GetHeader(*passage.Out, &s.sweetLisa)
+		header, err := server.GetHeader(*passage.Out, server.LisaOf(s.registrations, passage.Group))
 		if err != nil {
 			return err
 		}
@@ -162,7 +175,10 @@ func (s *Server) handleTCP(conn net.Conn) error {
 	}
 	ctx, cancel := context.WithTimeout(context.TODO(), server.DialTimeout)
 	defer cancel()
+	dialStart := time.Now()
 	rConn, err := d.DialContext(ctx, "tcp", target)
+	server.ObserveDial(string(protocol.ProtocolShadowsocks), "tcp", dialStart, err)
+	info.Logger().Trace("dial: %v", time.Since(dialStart))
 	if err != nil {
 		var netErr net.Error
 		if errors.As(err, &netErr) && netErr.Timeout() {
@@ -171,7 +187,9 @@ func (s *Server) handleTCP(conn net.Conn) error {
 		return err
 	}
 	defer rConn.Close()
-	if err = server.RelayTCP(lConn, rConn); err != nil {
+	sess := server.NewSession(*info, lConn, rConn)
+	defer sess.Done()
+	if err = sess.End(server.RelayTCP(sess, lConn, rConn)); err != nil {
 		var netErr net.Error
 		if errors.As(err, &netErr) && netErr.Timeout() {
 			return nil // ignore i/o timeout
@@ -200,6 +218,8 @@ func (s *Server) authTCP(conn bufferred_conn.BufferedConn) (passage *Passage, er
 	if exist := s.bloom.Exist(data[:ciphers.AeadCiphersConf[passage.In.Method].SaltLen]); exist {
 		return nil, protocol.ErrReplayAttack
 	}
+	// the salts of the client and the server are added by the connection
+	s.bloom.Added(2)
 	return passage, nil
 }
 
@@ -20,9 +20,10 @@ import (
 
 func (s *Server) handleUDP(lAddr net.Addr, data []byte) (err error) {
 	// get conn or dial and relay
-	rc, passage, plainText, target, err := s.GetOrBuildUDPConn(lAddr, data)
+	conn, passage, plainText, target, err := s.GetOrBuildUDPConn(lAddr, data)
 	if err != nil {
-		return fmt.Errorf("auth fail from: %v: %w", lAddr.String(), err)
+		server.ObserveAuthError(string(protocol.ProtocolShadowsocks), err)
+		return fmt.Errorf("auth fail from: %v: %w", log.Addr(lAddr.String()), err)
 	}
 	defer pool.Put(plainText)
 
@@ -39,7 +40,9 @@ func (s *Server) handleUDP(lAddr net.Addr, data []byte) (err error) {
 	if err != nil {
 		return err
 	}
-	if _, err = rc.WriteTo(plainText[al:], targetAddr); err != nil {
+	n, err := conn.WriteTo(plainText[al:], targetAddr)
+	conn.Session.AddUp(n)
+	if err != nil {
 		return fmt.Errorf("write error: %w", err)
 	}
 	return nil
@@ -58,8 +61,7 @@ func selectTimeout(packet []byte) time.Duration {
 
 // GetOrBuildUDPConn get a UDP conn from the mapping.
 // plainText is from pool and starts with metadata. Please MUST put it back.
-func (s *Server) GetOrBuildUDPConn(lAddr net.Addr, data []byte) (rc net.PacketConn, passage *Passage, plainText []byte, target string, err error) {
-	var conn *UDPConn
+func (s *Server) GetOrBuildUDPConn(lAddr net.Addr, data []byte) (conn *UDPConn, passage *Passage, plainText []byte, target string, err error) {
 	var ok bool
 
 	// get user's context (preference)
@@ -85,14 +87,26 @@ func (s *Server) GetOrBuildUDPConn(lAddr net.Addr, data []byte) (rc net.PacketCo
 	connIdent := lAddr.String()
 	s.nm.Lock()
 	if conn, ok = s.nm.Get(connIdent); !ok {
+		if err = server.CheckServing(&passage.Passage); err != nil {
+			s.nm.Unlock()
+			return nil, nil, nil, "", err
+		}
 		// not exist such socket mapping, build one
 		s.nm.Insert(connIdent, nil)
 		s.nm.Unlock()
+		info := server.SessionInfo{
+			ID:       server.NewConnID(),
+			Protocol: string(protocol.ProtocolShadowsocks),
+			Network:  "udp",
+			Passage:  &passage.Passage,
+			Source:   lAddr.String(),
+			Target:   target,
+		}
 
 		// dial
 		dialer := s.dialer
 		if passage.Out != nil {
-			header, err := server.GetHeader(*passage.Out, &s.sweetLisa)
+			header, err := server.GetHeader(*passage.Out, server.LisaOf(s.registrations, passage.Group))
 			if err != nil {
 				return nil, nil, nil, "", err
 			}
@@ -106,23 +120,28 @@ func (s *Server) GetOrBuildUDPConn(lAddr net.Addr, data []byte) (rc net.PacketCo
 		}
 		ctx, cancel := context.WithTimeout(context.TODO(), server.DialTimeout)
 		defer cancel()
+		dialStart := time.Now()
 		c, err := d.DialContext(ctx, "udp", target)
+		server.ObserveDial(string(protocol.ProtocolShadowsocks), "udp", dialStart, err)
+		info.Logger().Trace("dial: %v", time.Since(dialStart))
 		if err != nil {
 			s.nm.Lock()
 			s.nm.Remove(connIdent) // close channel to inform that establishment ends
 			s.nm.Unlock()
 			return nil, nil, nil, "", fmt.Errorf("GetOrBuildUDPConn dial error: %w", err)
 		}
-		rc = c.(net.PacketConn)
+		rc := c.(net.PacketConn)
 		s.nm.Lock()
 		s.nm.Remove(connIdent) // close channel to inform that establishment ends
 		conn = s.nm.Insert(connIdent, rc)
 		conn.Timeout = selectTimeout(plainText)
+		conn.Session = server.NewSession(info, rc)
 		s.nm.Unlock()
 		// relay
 		go func() {
-			if e := s.relay(lAddr, rc, conn.Timeout, *passage); e != nil {
-				log.Trace("shadowsocks.udp.relay: %v", e)
+			defer conn.Session.Done()
+			if e := conn.Session.End(s.relay(conn.Session, lAddr, rc, conn.Timeout, *passage)); e != nil {
+				conn.Session.Logger().WithError(e).Trace("shadowsocks.udp.relay: %v", e)
 			}
 			s.nm.Lock()
 			s.nm.Remove(connIdent)
@@ -135,17 +154,15 @@ func (s *Server) GetOrBuildUDPConn(lAddr net.Addr, data []byte) (rc net.PacketCo
 		if conn.PacketConn == nil {
 			// establishment ended and retrieve the result
 			return s.GetOrBuildUDPConn(lAddr, data)
-		} else {
-			// establishment succeeded
-			rc = conn.PacketConn
 		}
+		// establishment succeeded
 	}
 	// countdown
 	_ = conn.PacketConn.SetReadDeadline(time.Now().Add(conn.Timeout))
-	return rc, passage, plainText, target, nil
+	return conn, passage, plainText, target, nil
 }
 
-func (s *Server) relay(laddr net.Addr, rConn net.PacketConn, timeout time.Duration, passage Passage) (err error) {
+func (s *Server) relay(sess *server.Session, laddr net.Addr, rConn net.PacketConn, timeout time.Duration, passage Passage) (err error) {
 	var (
 		n           int
 		shadowBytes []byte
@@ -179,7 +196,7 @@ func (s *Server) relay(laddr net.Addr, rConn net.PacketConn, timeout time.Durati
 			var sAddr *net.UDPAddr
 			if addr == nil {
 				//sAddr = rAddr
-				log.Warn("relay(shadowsocks.udp): addr == nil")
+				sess.Logger().Warn("relay(shadowsocks.udp): addr == nil")
 			} else {
 				sAddr = addr.(*net.UDPAddr)
 			}
@@ -201,7 +218,7 @@ func (s *Server) relay(laddr net.Addr, rConn net.PacketConn, timeout time.Durati
 
 			b, err := target.BytesFromPool()
 			if err != nil {
-				log.Warn("relay: target.BytesFromPool: %v", err)
+				sess.Logger().Warn("relay: target.BytesFromPool: %v", err)
 				return err
 			}
 			copy(buf[len(b):], buf[:n])
@@ -212,14 +229,14 @@ func (s *Server) relay(laddr net.Addr, rConn net.PacketConn, timeout time.Durati
 		// FIXME: here does not use shadowsocks.NewUDPConn but it is okay
 		sg, err = shadowsocks.GetSaltGenerator(inKey.MasterKey, inKey.CipherConf.SaltLen)
 		if err != nil {
-			log.Warn("relay: GetSaltGenerator: %v", err)
+			sess.Logger().Warn("relay: GetSaltGenerator: %v", err)
 			continue
 		}
 		salt := sg.Get()
 		shadowBytes, err = shadowsocks.EncryptUDPFromPool(inKey, buf[:n], salt)
 		pool.Put(salt)
 		if err != nil {
-			log.Warn("relay: EncryptUDPFromPool: %v", err)
+			sess.Logger().Warn("relay: EncryptUDPFromPool: %v", err)
 			continue
 		}
 		s.bloom.ExistOrAdd(shadowBytes[:inKey.CipherConf.SaltLen])
@@ -228,6 +245,7 @@ func (s *Server) relay(laddr net.Addr, rConn net.PacketConn, timeout time.Durati
 			pool.Put(shadowBytes)
 			return
 		}
+		sess.AddDown(n)
 		pool.Put(shadowBytes)
 	}
 }
@@ -1,6 +1,7 @@
 package shadowsocks
 
 import (
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
 	"net"
 	"sync"
 	"time"
@@ -9,6 +10,7 @@ import (
 type UDPConn struct {
 	Establishing chan struct{}
 	Timeout      time.Duration
+	Session      *server.Session
 	net.PacketConn
 }
 
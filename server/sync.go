@@ -1,61 +1,286 @@
 package server
 
 import (
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common"
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/common/procfs"
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
-	"time"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func init() {
+	log.SetFileModule("sync")
+}
+
+var (
+	// syncedPassages caches the passages last synced to servers
+	syncedPassages = make(map[Server][]Passage)
+	// muSyncedPassages is held across reading the passages of a server, diffing, applying and updating the
+	// version, so that full syncs and deltas apply one after another
+	muSyncedPassages sync.Mutex
 )
 
+// MetadataCmdUpdatePassages carries a PassagesDelta, which adds and removes passages of the group of the manager
+// without sending all of them. It follows MetadataCmdRecentLogs.
+const MetadataCmdUpdatePassages = MetadataCmdRecentLogs + 1
+
+// ErrPassagesVersion means the delta is not based on the current passages, and SweetLisa should sync all of them.
+var ErrPassagesVersion = fmt.Errorf("passages version mismatch")
+
+// FullPassages is the body of MetadataCmdSyncPassages with a version. A JSON array of passages is also accepted,
+// which makes the version unknown.
+type FullPassages struct {
+	Version  uint64
+	Passages []model.Passage
+}
+
+// PassagesDelta is the body of MetadataCmdUpdatePassages.
+type PassagesDelta struct {
+	// BaseVersion is the version the delta applies to.
+	BaseVersion uint64
+	// Version is the version after the delta is applied.
+	Version uint64
+	Add     []model.Passage `json:",omitempty"`
+	Remove  []model.Passage `json:",omitempty"`
+}
+
+type groupOf struct {
+	s     Server
+	group string
+}
+
+var (
+	// passagesVersions are the versions of the passages of groups, which are zero if unknown
+	passagesVersions   = make(map[groupOf]uint64)
+	muPassagesVersions sync.Mutex
+)
+
+// PassagesVersion returns the version of the passages of the group last synced to the server. Zero means unknown.
+func PassagesVersion(s Server, group string) uint64 {
+	muPassagesVersions.Lock()
+	defer muPassagesVersions.Unlock()
+	return passagesVersions[groupOf{s, group}]
+}
+
+func setPassagesVersion(s Server, group string, version uint64) {
+	muPassagesVersions.Lock()
+	passagesVersions[groupOf{s, group}] = version
+	muPassagesVersions.Unlock()
+}
+
+func syncKey(p *Passage) string {
+	h := PassageKey(p)
+	if p.Out != nil {
+		h += "|" + p.Out.Argument.Hash()
+	}
+	return h
+}
+
+// diffPassages returns the passages in from but not in to, and the ones in to but not in from. Managers are never
+// removed, and are replaced by adding new ones.
+func diffPassages(from []Passage, to []Passage) (toRemove []Passage, toAdd []Passage) {
+	keys := make(map[string]struct{}, len(to))
+	for i := range to {
+		keys[syncKey(&to[i])] = struct{}{}
+	}
+	existing := make(map[string]struct{}, len(from))
+	for i := range from {
+		k := syncKey(&from[i])
+		existing[k] = struct{}{}
+		if _, ok := keys[k]; !ok && !from[i].Manager {
+			toRemove = append(toRemove, from[i])
+		}
+	}
+	for i := range to {
+		if _, ok := existing[syncKey(&to[i])]; !ok {
+			toAdd = append(toAdd, to[i])
+		}
+	}
+	return toRemove, toAdd
+}
+
 func SyncPassages(s Server, passages []Passage) (err error) {
 	log.Trace("SyncPassages")
-	toRemove, toAdd := common.Change(s.Passages(), passages, func(x interface{}) string {
-		h := x.(Passage).In.Argument.Hash()
-		if x.(Passage).Out != nil {
-			h += "|" + x.(Passage).Out.Argument.Hash()
+	muSyncedPassages.Lock()
+	defer muSyncedPassages.Unlock()
+	return syncPassagesLocked(s, passages)
+}
+
+// resyncPassages syncs the current passages of the server again, which drops the users of withdrawn groups.
+func resyncPassages(s Server) (err error) {
+	muSyncedPassages.Lock()
+	defer muSyncedPassages.Unlock()
+	return syncPassagesLocked(s, s.Passages())
+}
+
+// syncPassagesLocked is SyncPassages with muSyncedPassages held.
+func syncPassagesLocked(s Server, passages []Passage) (err error) {
+	if len(WithdrawnGroups()) > 0 {
+		// keep only the manager of withdrawn groups until the node registers again
+		var serving []Passage
+		for _, p := range passages {
+			if p.Manager || !Withdrawn(p.Group) {
+				serving = append(serving, p)
+			}
 		}
-		return h
-	})
-	if err := s.RemovePassages(toRemove.([]Passage), false); err != nil {
+		passages = serving
+	}
+	toRemove, toAdd := diffPassages(s.Passages(), passages)
+	if err := s.UpdatePassages(toRemove, toAdd); err != nil {
 		return err
 	}
-	if err := s.AddPassages(toAdd.([]Passage)); err != nil {
+	syncedPassages[s] = append([]Passage(nil), passages...)
+	emitPassagesChanged(len(toAdd), len(toRemove), len(passages))
+	return nil
+}
+
+func emitPassagesChanged(added int, removed int, total int) {
+	if removed > 0 || added > 0 {
+		Emit(EventPassagesChanged, fmt.Sprintf("%v passages added and %v removed", added, removed), PassagesChange{
+			Added:   added,
+			Removed: removed,
+			Total:   total,
+		})
+	}
+}
+
+// SyncGroupPassages syncs the passages of the group to the server, keeping the passages of other groups. The
+// version of the passages of the group becomes unknown.
+func SyncGroupPassages(s Server, group string, passages []Passage) (err error) {
+	return syncGroupPassages(s, group, passages, 0)
+}
+
+func syncGroupPassages(s Server, group string, passages []Passage, version uint64) (err error) {
+	muSyncedPassages.Lock()
+	defer muSyncedPassages.Unlock()
+	all := InGroup(group, append([]Passage(nil), passages...))
+	for _, p := range s.Passages() {
+		if p.Group != group {
+			all = append(all, p)
+		}
+	}
+	if err = syncPassagesLocked(s, all); err != nil {
 		return err
 	}
+	setPassagesVersion(s, group, version)
 	return nil
 }
 
-func GenerateBandwidthLimit() (l model.BandwidthLimit, err error) {
-	limit := config.ParamsObj.John.BandwidthLimit
-	if !limit.Enable {
-		return model.BandwidthLimit{}, nil
+// HandleSyncPassages reads the body of MetadataCmdSyncPassages from the manager of the group and syncs the passages.
+func HandleSyncPassages(s Server, group string, body io.Reader) error {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	var full FullPassages
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = jsoniter.Unmarshal(b, &full.Passages)
+	} else {
+		err = jsoniter.Unmarshal(b, &full)
 	}
-	txRxes, err := procfs.InterfacesTxRx()
 	if err != nil {
-		return model.BandwidthLimit{}, err
-	}
-	var (
-		maxRxKiB int64
-		maxTxKib int64
-	)
-	for _, txRx := range txRxes {
-		if txRx.RxBytes/1024 > maxRxKiB {
-			maxRxKiB = txRx.RxBytes / 1024
+		return err
+	}
+	log.Info("Server asked to SyncPassages (version %v)", full.Version)
+	var passages []Passage
+	for _, passage := range full.Passages {
+		passages = append(passages, Passage{Passage: passage})
+	}
+	return syncGroupPassages(s, group, passages, full.Version)
+}
+
+// HandleUpdatePassages reads the body of MetadataCmdUpdatePassages from the manager of the group and applies the
+// delta. The passages to add and to remove are swapped at once, so that no user fails the auth in between.
+func HandleUpdatePassages(s Server, group string, body io.Reader) error {
+	var delta PassagesDelta
+	if err := jsoniter.NewDecoder(body).Decode(&delta); err != nil {
+		return err
+	}
+	if delta.Version <= delta.BaseVersion {
+		return fmt.Errorf("%w: the delta from %v goes to %v", ErrPassagesVersion, delta.BaseVersion, delta.Version)
+	}
+
+	muSyncedPassages.Lock()
+	defer muSyncedPassages.Unlock()
+	if version := PassagesVersion(s, group); version == 0 || delta.BaseVersion != version {
+		return fmt.Errorf("%w: have %v, got a delta based on %v", ErrPassagesVersion, version, delta.BaseVersion)
+	}
+	log.Info("Server asked to UpdatePassages from version %v to %v: %v to add and %v to remove", delta.BaseVersion, delta.Version, len(delta.Add), len(delta.Remove))
+	var toRemove, toAdd []Passage
+	for _, p := range delta.Remove {
+		toRemove = append(toRemove, Passage{Passage: p, Group: group})
+	}
+	for _, p := range delta.Add {
+		toAdd = append(toAdd, Passage{Passage: p, Group: group})
+	}
+
+	synced := applyDelta(syncedPassages[s], toRemove, toAdd)
+	if Withdrawn(group) {
+		// the passages are added when the node registers again
+		toAdd = nil
+	} else {
+		toAdd = uniqueAdds(s.Passages(), toRemove, toAdd)
+	}
+	if err := s.UpdatePassages(toRemove, toAdd); err != nil {
+		return err
+	}
+	syncedPassages[s] = synced
+	setPassagesVersion(s, group, delta.Version)
+	emitPassagesChanged(len(toAdd), len(toRemove), len(synced))
+	return nil
+}
+
+func applyDelta(passages []Passage, toRemove []Passage, toAdd []Passage) []Passage {
+	keys := make(map[string]struct{}, len(toRemove))
+	for i := range toRemove {
+		keys[PassageKey(&toRemove[i])] = struct{}{}
+	}
+	result := make([]Passage, 0, len(passages)+len(toAdd))
+	for i := range passages {
+		if _, ok := keys[PassageKey(&passages[i])]; !ok || passages[i].Manager {
+			result = append(result, passages[i])
 		}
-		if txRx.TxBytes/1024 > maxTxKib {
-			maxTxKib = txRx.TxBytes / 1024
+	}
+	return append(result, uniqueAdds(passages, toRemove, toAdd)...)
+}
+
+// uniqueAdds returns the passages to add without the ones repeated or kept in the passages after removing.
+func uniqueAdds(passages []Passage, toRemove []Passage, toAdd []Passage) (unique []Passage) {
+	removed := make(map[string]struct{}, len(toRemove))
+	for i := range toRemove {
+		removed[PassageKey(&toRemove[i])] = struct{}{}
+	}
+	seen := make(map[string]struct{}, len(passages)+len(toAdd))
+	for i := range passages {
+		if _, ok := removed[PassageKey(&passages[i])]; !ok || passages[i].Manager {
+			seen[PassageKey(&passages[i])] = struct{}{}
 		}
 	}
-	l = model.BandwidthLimit{
-		// 7th and 8th months have 31 days
-		ResetDay:         time.Date(2000, 7, int(limit.ResetDay), 0, 0, 0, 0, time.Local),
-		UplinkLimitGiB:   limit.UplinkLimitGiB,
-		DownlinkLimitGiB: limit.DownlinkLimitGiB,
-		TotalLimitGiB:    limit.TotalLimitGiB,
-		UplinkKiB:        maxTxKib,
-		DownlinkKiB:      maxRxKiB,
+	for i := range toAdd {
+		k := PassageKey(&toAdd[i])
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		unique = append(unique, toAdd[i])
 	}
-	return l, nil
+	return unique
+}
+
+// PassagesChange is the data of EventPassagesChanged.
+type PassagesChange struct {
+	Added   int
+	Removed int
+	Total   int
+}
+
+// SyncedPassages returns the passages last synced to the server.
+func SyncedPassages(s Server) (passages []Passage, ok bool) {
+	muSyncedPassages.Lock()
+	defer muSyncedPassages.Unlock()
+	passages, ok = syncedPassages[s]
+	return append([]Passage(nil), passages...), ok
 }
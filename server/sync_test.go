@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandleUpdatePassages(t *testing.T) {
+	s := &fakeServer{}
+	manager := testPassage("manager", true)
+	manager.Group = "ticket"
+	if err := s.AddPassages([]Passage{manager}); err != nil {
+		t.Fatal(err)
+	}
+	// an array of passages is the full sync without a version
+	if err := HandleSyncPassages(s, "ticket", strings.NewReader(`[{"In":{"Protocol":"shadowsocks","Password":"user1"}}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if v := PassagesVersion(s, "ticket"); v != 0 {
+		t.Errorf("unexpected version of the unversioned sync: %v", v)
+	}
+	if err := HandleUpdatePassages(s, "ticket", strings.NewReader(`{"BaseVersion":0,"Version":1}`)); !errors.Is(err, ErrPassagesVersion) {
+		t.Errorf("a delta is applied to the passages of an unknown version: %v", err)
+	}
+
+	if err := HandleSyncPassages(s, "ticket", strings.NewReader(`{"Version":3,"Passages":[
+		{"In":{"Protocol":"shadowsocks","Password":"user1"}},
+		{"In":{"Protocol":"shadowsocks","Password":"user2"}}
+	]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := GeneratePingResp(s, "ticket"); err != nil || resp.PassagesVersion != 3 {
+		t.Errorf("unexpected version in the ping response: %v, %v", resp.PassagesVersion, err)
+	}
+
+	// a stale delta is rejected so that SweetLisa syncs all passages again
+	if err := HandleUpdatePassages(s, "ticket", strings.NewReader(`{"BaseVersion":2,"Version":4}`)); !errors.Is(err, ErrPassagesVersion) {
+		t.Errorf("unexpected error of a stale delta: %v", err)
+	}
+	if err := HandleUpdatePassages(s, "ticket", strings.NewReader(`{"BaseVersion":3,"Version":4,
+		"Add":[{"In":{"Protocol":"shadowsocks","Password":"user3"}}],
+		"Remove":[{"In":{"Protocol":"shadowsocks","Password":"user1"}}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	for _, p := range s.Passages() {
+		if !p.Manager {
+			if p.Group != "ticket" {
+				t.Errorf("the passage added is not in the group: %v", p.Group)
+			}
+			users = append(users, p.In.Password)
+		}
+	}
+	if len(users) != 2 || users[0] != "user2" || users[1] != "user3" {
+		t.Errorf("unexpected users after the delta: %v", users)
+	}
+	if synced, _ := SyncedPassages(s); len(synced) != 2 {
+		t.Errorf("unexpected synced passages after the delta: %v", len(synced))
+	}
+	if v := PassagesVersion(s, "ticket"); v != 4 {
+		t.Errorf("unexpected version after the delta: %v", v)
+	}
+}
+
+func TestDiffPassages(t *testing.T) {
+	manager, user1, user2 := testPassage("manager", true), testPassage("user1", false), testPassage("user2", false)
+	other := testPassage("user1", false)
+	other.Group = "other"
+	toRemove, toAdd := diffPassages([]Passage{manager, user1, other}, []Passage{user1, user2})
+	if len(toRemove) != 1 || toRemove[0].Group != "other" {
+		t.Errorf("unexpected passages to remove: %v", toRemove)
+	}
+	if len(toAdd) != 1 || toAdd[0].In.Password != "user2" {
+		t.Errorf("unexpected passages to add: %v", toAdd)
+	}
+}
+
+func TestHandleUpdatePassagesInvalid(t *testing.T) {
+	s := &fakeServer{}
+	manager := testPassage("manager", true)
+	manager.Group = "ticket"
+	if err := s.AddPassages([]Passage{manager}); err != nil {
+		t.Fatal(err)
+	}
+	if err := HandleSyncPassages(s, "ticket", strings.NewReader(`{"Version":3,"Passages":[
+		{"In":{"Protocol":"shadowsocks","Password":"user1"}},
+		{"In":{"Protocol":"shadowsocks","Password":"user2"}}
+	]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the version never goes backwards
+	for _, delta := range []string{`{"BaseVersion":3,"Version":3}`, `{"BaseVersion":3,"Version":2}`} {
+		if err := HandleUpdatePassages(s, "ticket", strings.NewReader(delta)); !errors.Is(err, ErrPassagesVersion) {
+			t.Errorf("unexpected error of the delta %v: %v", delta, err)
+		}
+	}
+	if v := PassagesVersion(s, "ticket"); v != 3 {
+		t.Errorf("unexpected version after invalid deltas: %v", v)
+	}
+
+	// passages existing or repeated are added once
+	if err := HandleUpdatePassages(s, "ticket", strings.NewReader(`{"BaseVersion":3,"Version":4,"Add":[
+		{"In":{"Protocol":"shadowsocks","Password":"user2"}},
+		{"In":{"Protocol":"shadowsocks","Password":"user3"}},
+		{"In":{"Protocol":"shadowsocks","Password":"user3"}}
+	]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countUsers(s.Passages()); n != 3 {
+		t.Errorf("unexpected users after adding duplicates: %v", n)
+	}
+	if synced, _ := SyncedPassages(s); len(synced) != 3 {
+		t.Errorf("unexpected synced passages after adding duplicates: %v", len(synced))
+	}
+}
+
+// hookedServer runs onPassages once before the passages are read.
+type hookedServer struct {
+	fakeServer
+	onPassages sync.Once
+	hook       func()
+}
+
+func (s *hookedServer) Passages() []Passage {
+	if s.hook != nil {
+		s.onPassages.Do(s.hook)
+	}
+	return s.fakeServer.Passages()
+}
+
+func TestSyncPassagesConcurrent(t *testing.T) {
+	s := &hookedServer{}
+	if err := HandleSyncPassages(s, "ticket", strings.NewReader(`{"Version":1,"Passages":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	// a delta arrives while the passages of another group are being synced
+	s.hook = func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delta := `{"BaseVersion":1,"Version":2,"Add":[{"In":{"Protocol":"shadowsocks","Password":"user1"}}]}`
+			if err := HandleUpdatePassages(s, "ticket", strings.NewReader(delta)); err != nil {
+				t.Error(err)
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := SyncGroupPassages(s, "other", []Passage{testPassage("other", false)}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// the delta is not lost to the sync of the other group
+	groups := make(map[string]int)
+	for _, p := range s.Passages() {
+		groups[p.Group]++
+	}
+	if groups["ticket"] != 1 || groups["other"] != 1 {
+		t.Errorf("unexpected passages of the groups: %v", groups)
+	}
+	if synced, _ := SyncedPassages(s); len(synced) != 2 {
+		t.Errorf("unexpected synced passages: %v", len(synced))
+	}
+	if v := PassagesVersion(s, "ticket"); v != 2 {
+		t.Errorf("unexpected version: %v", v)
+	}
+}
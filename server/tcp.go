@@ -3,6 +3,7 @@ package server
 import (
 	"github.com/daeuniverse/softwind/netproxy"
 	io2 "github.com/daeuniverse/softwind/pkg/zeroalloc/io"
+	"io"
 	"time"
 )
 
@@ -10,17 +11,17 @@ type WriteCloser interface {
 	CloseWrite() error
 }
 
-func RelayTCP(lConn, rConn netproxy.Conn) (err error) {
+func RelayTCP(sess *Session, lConn, rConn netproxy.Conn) (err error) {
 	eCh := make(chan error, 1)
 	go func() {
-		_, e := io2.Copy(rConn, lConn)
+		_, e := copyCounted(rConn, lConn, upRateLimiter, sess.AddUp)
 		if rConn, ok := rConn.(WriteCloser); ok {
 			rConn.CloseWrite()
 		}
 		rConn.SetReadDeadline(time.Now().Add(10 * time.Second))
 		eCh <- e
 	}()
-	_, e := io2.Copy(lConn, rConn)
+	_, e := copyCounted(lConn, rConn, downRateLimiter, sess.AddDown)
 	if lConn, ok := lConn.(WriteCloser); ok {
 		lConn.CloseWrite()
 	}
@@ -31,3 +32,15 @@ func RelayTCP(lConn, rConn netproxy.Conn) (err error) {
 	}
 	return <-eCh
 }
+
+// copyCounted copies from src to dst and counts the bytes by count. The bytes are counted as they are written only
+// if the rate limiter or the proxy accounting needs them on the fly, because wrapping dst hides io.ReaderFrom and
+// disables the zero-copy path. Otherwise they are counted once the copying ends.
+func copyCounted(dst io.Writer, src io.Reader, limiter *RateLimiter, count func(n int)) (written int64, err error) {
+	if limiter != nil || proxyAccounting() {
+		return io2.Copy(&countWriter{Writer: dst, count: count}, src)
+	}
+	written, err = io2.Copy(dst, src)
+	count(int(written))
+	return written, err
+}
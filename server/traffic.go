@@ -0,0 +1,43 @@
+package server
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+var (
+	// relayedUp counts the bytes relayed from clients to targets.
+	relayedUp atomic.Int64
+	// relayedDown counts the bytes relayed from targets to clients.
+	relayedDown atomic.Int64
+)
+
+func AddRelayedUp(n int) {
+	if n > 0 {
+		relayedUp.Add(int64(n))
+	}
+}
+
+func AddRelayedDown(n int) {
+	if n > 0 {
+		relayedDown.Add(int64(n))
+	}
+}
+
+// RelayedTraffic returns the bytes relayed by BitterJohn since startup.
+// Up is from clients to targets and down is from targets to clients.
+func RelayedTraffic() (up int64, down int64) {
+	return relayedUp.Load(), relayedDown.Load()
+}
+
+// countWriter counts the bytes written into the wrapped writer.
+type countWriter struct {
+	io.Writer
+	count func(n int)
+}
+
+func (w *countWriter) Write(b []byte) (n int, err error) {
+	n, err = w.Writer.Write(b)
+	w.count(n)
+	return n, err
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readerFromBuffer records whether it is copied to by ReadFrom.
+type readerFromBuffer struct {
+	bytes.Buffer
+	readFrom bool
+}
+
+func (b *readerFromBuffer) ReadFrom(r io.Reader) (int64, error) {
+	b.readFrom = true
+	return b.Buffer.ReadFrom(r)
+}
+
+func TestCopyCounted(t *testing.T) {
+	var counted int
+	count := func(n int) { counted += n }
+
+	// the zero-copy path is kept without the rate limit
+	dst := &readerFromBuffer{}
+	if n, err := copyCounted(dst, struct{ io.Reader }{strings.NewReader("hello")}, nil, count); err != nil || n != 5 {
+		t.Fatalf("copied %v: %v", n, err)
+	}
+	if !dst.readFrom || counted != 5 {
+		t.Errorf("ReadFrom: %v, counted: %v", dst.readFrom, counted)
+	}
+
+	// the bytes are counted as written to be limited
+	counted = 0
+	dst = &readerFromBuffer{}
+	limiter := NewRateLimiter(constantRate(1 << 30))
+	if n, err := copyCounted(dst, struct{ io.Reader }{strings.NewReader("hello")}, limiter, count); err != nil || n != 5 {
+		t.Fatalf("copied %v: %v", n, err)
+	}
+	if dst.readFrom || counted != 5 || dst.String() != "hello" {
+		t.Errorf("ReadFrom: %v, counted: %v, written: %q", dst.readFrom, counted, dst.String())
+	}
+}
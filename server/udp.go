@@ -27,7 +27,7 @@ func SelectTimeout(packet []byte) time.Duration {
 	return DnsQueryTimeout
 }
 
-func RelayUDP(dst *net.UDPConn, laddr net.Addr, src net.PacketConn, timeout time.Duration) (err error) {
+func RelayUDP(sess *Session, dst *net.UDPConn, laddr net.Addr, src net.PacketConn, timeout time.Duration) (err error) {
 	var n int
 	var mtu int
 	if src.LocalAddr() != nil {
@@ -44,14 +44,15 @@ func RelayUDP(dst *net.UDPConn, laddr net.Addr, src net.PacketConn, timeout time
 			return
 		}
 		_ = dst.SetWriteDeadline(time.Now().Add(DefaultNatTimeout)) // should keep consistent
-		_, err = dst.WriteTo(buf[:n], laddr)
+		n, err = dst.WriteTo(buf[:n], laddr)
+		sess.AddDown(n)
 		if err != nil {
 			return
 		}
 	}
 }
 
-func RelayUDPToConn(dst netproxy.FullConn, src netproxy.PacketConn, timeout time.Duration, bufSize int) (err error) {
+func RelayUDPToConn(sess *Session, dst netproxy.FullConn, src netproxy.PacketConn, timeout time.Duration, bufSize int) (err error) {
 	var n int
 	var addr netip.AddrPort
 	buf := pool.Get(bufSize)
@@ -63,7 +64,8 @@ func RelayUDPToConn(dst netproxy.FullConn, src netproxy.PacketConn, timeout time
 			return
 		}
 		_ = dst.SetWriteDeadline(time.Now().Add(DefaultNatTimeout)) // should keep consistent
-		_, err = dst.WriteTo(buf[:n], addr.String())
+		n, err = dst.WriteTo(buf[:n], addr.String())
+		sess.AddDown(n)
 		if err != nil {
 			return
 		}
@@ -26,6 +26,15 @@ var (
 type Passage struct {
 	model.Passage
 	Manager bool
+	// Group is the ticket of the group the passage belongs to.
+	Group string
+	// RetireAt is when the retiring credential of a rotated manager becomes invalid. Zero means it is current.
+	RetireAt time.Time
+}
+
+// Retired reports whether the passage is a manager credential retired at the time.
+func (p *Passage) Retired(t time.Time) bool {
+	return !p.RetireAt.IsZero() && !t.Before(p.RetireAt)
 }
 
 func (p *Passage) Use() (use PassageUse) {
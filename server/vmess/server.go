@@ -27,6 +27,7 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,11 +37,10 @@ func init() {
 }
 
 type Server struct {
-	closed    chan struct{}
-	sweetLisa config.Lisa
-	arg       server.Argument
-	protocol  protocol.Protocol
-	lastAlive time.Time
+	closed        chan struct{}
+	arg           server.Argument
+	protocol      protocol.Protocol
+	registrations []*server.Registration
 
 	listener        net.Listener
 	mutex           sync.Mutex
@@ -77,19 +77,25 @@ func NewJohn(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaHost con
 		return nil, err
 	}
 	john := s.(*Server)
-	john.sweetLisa = sweetLisaHost
 	john.arg = arg
+	john.registrations = server.NewRegistrations(server.Groups(sweetLisaHost, arg))
 	john.passageContentionCache = server.NewContentionCache()
 	john.protocol = protocol
-	if err := s.AddPassages([]server.Passage{{Manager: true}}); err != nil {
+	var managers []server.Passage
+	for _, r := range john.registrations {
+		managers = append(managers, server.Passage{Manager: true, Group: r.Ticket})
+	}
+	if err := s.AddPassages(managers); err != nil {
 		return nil, err
 	}
 
 	// connect to SweetLisa and register
-	if err := john.register(); err != nil {
+	if err := server.RegisterFirst(john.registrations, john.register); err != nil {
 		return nil, err
 	}
-	go john.registerBackground()
+	for _, r := range john.registrations {
+		go john.registerBackground(r)
+	}
 	return john, nil
 }
 
@@ -110,7 +116,9 @@ func NewJohnTlsGrpc(valueCtx context.Context, dialer netproxy.Dialer, sweetLisaH
 }
 
 func (s *Server) reRegister() {
-	s.lastAlive = time.Time{}
+	for _, r := range s.registrations {
+		r.Forget()
+	}
 }
 
 func (s *Server) Listen(addr string) (err error) {
@@ -128,19 +136,11 @@ func (s *Server) Listen(addr string) (err error) {
 				log.Warn("%v", err)
 			}
 			go func() {
-				err := s.handleConn(conn)
-				if err != nil {
-					if errors.Is(err, server.ErrPassageAbuse) ||
-						errors.Is(err, protocol.ErrReplayAttack) {
-						log.Warn("handleConn: %v", err)
-					} else {
-						log.Info("handleConn: %v", err)
-					}
-				}
+				_ = s.handleConn(conn)
 			}()
 		}
 	case protocol.ProtocolVMessTlsGrpc:
-		sni, err := common.HostsToSNI(s.arg.Hostnames, s.sweetLisa.Host)
+		sni, err := common.HostsToSNI(s.arg.Hostnames, server.LisaOf(s.registrations, s.arg.Ticket).Host)
 		if err != nil {
 			return err
 		}
@@ -158,18 +158,24 @@ func (s *Server) Listen(addr string) (err error) {
 		}()
 		s.grpc = grpc2.Server{
 			Server: grpc.NewServer(
-				grpc.Creds(credentials.NewTLS(&tls.Config{GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-					isChallenge := false
+				grpc.Creds(credentials.NewTLS(&tls.Config{GetCertificate: func(info *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+					var isChallenge atomic.Bool
 					defer func() {
-						if isChallenge {
+						if isChallenge.Load() {
+							if err != nil {
+								log.Warn("Failed to renew the certificate for %v: %v", sni, err)
+								server.Emit(server.EventCertRenewalFailed, fmt.Sprintf("failed to renew the certificate for %v: %v", sni, err), nil)
+								return
+							}
 							log.Warn("The certificate for %v is renewed successfully.", sni)
+							server.Emit(server.EventCertRenewed, fmt.Sprintf("the certificate for %v is renewed", sni), nil)
 							// Actively request an attempt to re-register
 							s.reRegister()
 						}
 					}()
 					// If there is any cache, it couldn't be more than 5 seconds to retrieve a cert.
 					t := time.AfterFunc(5*time.Second, func() {
-						isChallenge = true
+						isChallenge.Store(true)
 						log.Warn("We are now renewing the certificate for %v.", sni)
 					})
 					defer t.Stop()
@@ -202,28 +208,29 @@ func (s *Server) Listen(addr string) (err error) {
 
 func (s *Server) AddPassages(passages []server.Passage) (err error) {
 	log.Trace("AddPassages: %v", len(passages))
-	us, managerKey := LocalizePassages(passages)
+	us, managers := LocalizePassages(passages)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	// update manager key
-	if managerKey != nil {
-		// remove manager key in UserContext
+	// update manager keys
+	if len(managers) > 0 {
+		// remove manager keys of the groups in UserContext
 		s.removePassagesFunc(func(passage *Passage) (remove bool) {
-			return passage.Manager == true
+			return passage.Manager && passage.RetireAt.IsZero() && managers[passage.Group] != nil
 		})
 	}
 	s.addPassages(us)
 	return nil
 }
 
-func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passage) {
+func LocalizePassages(passages []server.Passage) (psgs []Passage, managers map[string]*Passage) {
 	psgs = make([]Passage, len(passages))
+	managers = make(map[string]*Passage)
 	for i, psg := range passages {
-		if psg.Manager {
+		if psg.Manager && psg.RetireAt.IsZero() {
 			psg.In.Password = uuid.New().String()
-			// allow only one manager
-			if manager == nil {
-				manager = &psgs[i]
+			// allow only one manager in a group
+			if managers[psg.Group] == nil {
+				managers[psg.Group] = &psgs[i]
 			} else {
 				psg.Manager = false
 				log.Warn("found more than one manager")
@@ -232,7 +239,7 @@ func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passa
 		psgs[i].Passage = psg
 		id, err := uuid.Parse(psgs[i].In.Password)
 		if err != nil {
-			log.Warn("LocalizePassages: invalid uuid: %v", psgs[i].In.Password)
+			log.Warn("LocalizePassages: invalid uuid: %v", log.Opaque(psgs[i].In.Password))
 			id = uuid.New()
 		}
 		psgs[i].inCmdKey = vmess.NewID(id).CmdKey()
@@ -240,13 +247,13 @@ func LocalizePassages(passages []server.Passage) (psgs []Passage, manager *Passa
 		if psg.Out != nil && psg.Out.Protocol == protocol.ProtocolVMessTCP {
 			id, err := uuid.Parse(psgs[i].Out.Password)
 			if err != nil {
-				log.Warn("LocalizePassages: invalid uuid: %v", psgs[i].In.Password)
+				log.Warn("LocalizePassages: invalid uuid: %v", log.Opaque(psgs[i].In.Password))
 				id = uuid.New()
 			}
 			psgs[i].outCmdKey = vmess.NewID(id).CmdKey()
 		}
 	}
-	return psgs, manager
+	return psgs, managers
 }
 
 func (s *Server) RemovePassages(passages []server.Passage, alsoManager bool) (err error) {
@@ -259,15 +266,32 @@ func (s *Server) RemovePassages(passages []server.Passage, alsoManager bool) (er
 		if passage.Manager && !alsoManager {
 			continue
 		}
-		keySet[passage.In.Argument.Hash()] = struct{}{}
+		keySet[server.PassageKey(&passage.Passage)] = struct{}{}
 	}
 	s.removePassagesFunc(func(passage *Passage) (remove bool) {
-		_, ok := keySet[passage.In.Argument.Hash()]
+		_, ok := keySet[server.PassageKey(&passage.Passage)]
 		return ok
 	})
 	return nil
 }
 
+func (s *Server) LastAlive() time.Time {
+	return server.OldestAlive(s.registrations)
+}
+
+// Registrations returns the registrations of the groups of the server.
+func (s *Server) Registrations() []*server.Registration {
+	return s.registrations
+}
+
+func (s *Server) UserContextPoolSize() int {
+	return s.userContextPool.Infra().Len()
+}
+
+func (s *Server) Reregister(groups ...string) error {
+	return server.RegisterAll(s.registrations, s.register, groups...)
+}
+
 func (s *Server) SyncPassages(passages []server.Passage) (err error) {
 	return server.SyncPassages(s, passages)
 }
@@ -294,6 +318,54 @@ func (s *Server) Close() error {
 	return s.listener.Close()
 }
 
+func (s *Server) UpdatePassages(toRemove []server.Passage, toAdd []server.Passage) (err error) {
+	log.Trace("UpdatePassages: %v to remove, %v to add", len(toRemove), len(toAdd))
+	us, managers := LocalizePassages(toAdd)
+	var keySet = make(map[string]struct{})
+	for i := range toRemove {
+		if !toRemove[i].Manager {
+			keySet[server.PassageKey(&toRemove[i])] = struct{}{}
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.swapPassages(us, func(passage *Passage) (remove bool) {
+		if passage.Manager {
+			return passage.RetireAt.IsZero() && managers[passage.Group] != nil
+		}
+		_, ok := keySet[server.PassageKey(&passage.Passage)]
+		return ok
+	})
+	return nil
+}
+
+// swapPassages adds the passages and then removes the others that f returns true for.
+func (s *Server) swapPassages(passages []Passage, f func(passage *Passage) (remove bool)) {
+	added := make(map[*Passage]struct{}, len(passages))
+	for i := range passages {
+		added[&passages[i]] = struct{}{}
+	}
+	n := len(s.passages)
+	s.addPassages(passages)
+	for i := n - 1; i >= 0; i-- {
+		if f(&s.passages[i]) {
+			s.passages = append(s.passages[:i], s.passages[i+1:]...)
+		}
+	}
+	socketIdents := s.userContextPool.Infra().GetKeys()
+	for _, ident := range socketIdents {
+		userContext := s.userContextPool.Infra().Get(ident).(*UserContext).Infra()
+		listCopy := userContext.GetListCopy()
+		for _, node := range listCopy {
+			passage := node.Val.(*Passage)
+			if _, ok := added[passage]; !ok && f(passage) {
+				userContext.Remove(node)
+			}
+		}
+		userContext.DestroyListCopy(listCopy)
+	}
+}
+
 func (s *Server) addPassages(passages []Passage) {
 	s.passages = append(s.passages, passages...)
 
@@ -327,8 +399,9 @@ func (s *Server) removePassagesFunc(f func(passage *Passage) (remove bool)) {
 	}
 }
 
-func (s *Server) registerBackground() {
+func (s *Server) registerBackground(r *server.Registration) {
 	var interval = 2 * time.Second
+	var lost server.LostTracker
 	ticker := time.NewTicker(interval)
 	for {
 		select {
@@ -336,16 +409,21 @@ func (s *Server) registerBackground() {
 			ticker.Stop()
 			break
 		case <-ticker.C:
-			if time.Since(s.lastAlive) < server.LostThreshold {
+			if server.Withdrawn(r.Ticket) {
+				// registering waits for the CDN validation to pass
+				continue
+			}
+			if r.Registered() && time.Since(r.LastAlive()) < server.LostThreshold {
 				continue
 			} else {
-				if s.lastAlive.IsZero() {
+				lost.Lost(r.LastAlive())
+				if !r.Registered() {
 					log.Warn("Actively request an attempt to re-register")
 				} else {
-					log.Warn("Lost connection with SweetLisa more than 5 minutes. Try to register again")
+					log.Warn("Lost connection with SweetLisa %v more than 5 minutes. Try to register again", strconv.Quote(r.Lisa.Host))
 				}
 			}
-			if err := s.register(); err != nil {
+			if err := s.register(r); err != nil {
 				// binary exponential backoff algorithm
 				// to avoid DDoS
 				interval = interval * 2
@@ -354,6 +432,7 @@ func (s *Server) registerBackground() {
 				}
 				log.Warn("registerBackground: %v. retry in %v", err, interval.String())
 			} else {
+				lost.Registered()
 				interval = 2 * time.Second
 			}
 			ticker.Reset(interval)
@@ -361,28 +440,17 @@ func (s *Server) registerBackground() {
 	}
 }
 
-func (s *Server) register() error {
-	var manager server.Passage
-	users := s.Passages()
-	for _, u := range users {
-		if u.Manager {
-			manager = u
-			break
-		}
-	}
+func (s *Server) register(r *server.Registration) error {
+	manager := server.ManagerOf(s.Passages(), r.Ticket)
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	t, _ := net.LookupTXT("cdn-validate." + s.sweetLisa.Host)
-	var validateToken string
-	if len(t) > 0 {
-		validateToken = t[0]
-	}
+	validateToken := api.DefaultClient().LookupValidateToken(ctx, r.Lisa.Host)
 	bandwidthLimit, err := server.GenerateBandwidthLimit()
 	if err != nil {
 		return err
 	}
-	cdnNames, users, err := api.Register(ctx, s.sweetLisa.Host, validateToken, model.Server{
-		Ticket: s.arg.Ticket,
+	cdnNames, users, err := api.Register(ctx, r.Lisa.Host, validateToken, model.Server{
+		Ticket: r.Ticket,
 		Name:   s.arg.ServerName,
 		Hosts:  s.arg.Hostnames,
 		Port:   s.arg.Port,
@@ -397,16 +465,24 @@ func (s *Server) register() error {
 	if err != nil {
 		return err
 	}
-	log.Alert("Succeed to register at %v (%v)", strconv.Quote(s.sweetLisa.Host), cdnNames)
-	s.lastAlive = time.Now()
+	log.Alert("Succeed to register at %v (%v)", strconv.Quote(r.Lisa.Host), cdnNames)
+	r.Alive()
 	// sweetLisa can replace the manager key here
-	if err := s.SyncPassages(users); err != nil {
+	if err := server.SyncGroupPassages(s, r.Ticket, users); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (s *Server) ContentionCheck(thisIP net.IP, passage *Passage) (err error) {
+	if passage.Manager {
+		if passage.Retired(time.Now()) {
+			return server.ErrRetiredManager
+		}
+		if err = server.CheckManagerSource(s, passage.Group, thisIP); err != nil {
+			return err
+		}
+	}
 	if s.passageContentionCache == nil {
 		return nil
 	}
@@ -415,7 +491,7 @@ func (s *Server) ContentionCheck(thisIP net.IP, passage *Passage) (err error) {
 		passageKey := passage.In.Argument.Hash()
 		accept, conflictIP := s.passageContentionCache.Check(passageKey, contentionDuration, thisIP)
 		if !accept {
-			return fmt.Errorf("%w: from %v and %v: contention detected", server.ErrPassageAbuse, thisIP.String(), conflictIP.String())
+			return fmt.Errorf("%w: from %v and %v: contention detected", server.ErrPassageAbuse, log.Host(thisIP.String()), log.Host(conflictIP.String()))
 		}
 	}
 	return nil
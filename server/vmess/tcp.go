@@ -20,24 +20,47 @@ import (
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/config"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
 	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/server"
-	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
 	jsoniter "github.com/json-iterator/go"
 )
 
+// handleConn handles the inbound connection and logs the error with the information of the connection.
 func (s *Server) handleConn(conn net.Conn) error {
+	info := server.SessionInfo{
+		ID:       server.NewConnID(),
+		Protocol: string(s.protocol),
+		Network:  "tcp",
+		Source:   conn.RemoteAddr().String(),
+	}
+	err := s.serveConn(conn, &info)
+	if err != nil {
+		logger := info.Logger().WithError(err)
+		if errors.Is(err, server.ErrPassageAbuse) ||
+			errors.Is(err, protocol.ErrReplayAttack) {
+			logger.Warn("handleConn: %v", err)
+		} else {
+			logger.Info("handleConn: %v", err)
+		}
+	}
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn, info *server.SessionInfo) error {
 	defer conn.Close()
 	passage, eAuthID, err := s.authFromPool(conn)
 	if err != nil {
-		log.Trace("handleConn: auth fail")
+		info.Logger().Trace("handleConn: auth fail")
+		server.ObserveAuthError(string(s.protocol), err)
 		// Auth fail. Drain the conn
 		if config.ParamsObj.John.MaxDrainN == -1 {
 			io.Copy(io.Discard, conn)
 		} else {
 			io.CopyN(io.Discard, conn, config.ParamsObj.John.MaxDrainN)
 		}
-		return fmt.Errorf("auth fail: %w. Drained the conn from: %v", err, conn.RemoteAddr().String())
+		return fmt.Errorf("auth fail: %w. Drained the conn from: %v", err, log.Addr(conn.RemoteAddr().String()))
 	}
 
+	info.Passage = &passage.Passage
+
 	// detect passage contention
 	if err := s.ContentionCheck(conn.RemoteAddr().(*net.TCPAddr).IP, passage); err != nil {
 		if config.ParamsObj.John.MaxDrainN == -1 {
@@ -66,16 +89,20 @@ func (s *Server) handleConn(conn net.Conn) error {
 		return s.handleMsg(lConn, &targetMetadata, passage)
 	}
 	target = net.JoinHostPort(targetMetadata.Hostname, strconv.Itoa(int(targetMetadata.Port)))
+	info.Target = target
 
 	// manager should not come to this line
 	if passage.Manager {
 		return fmt.Errorf("%w: manager key is ubused for a non-cmd connection", server.ErrPassageAbuse)
 	}
+	if err := server.CheckServing(&passage.Passage); err != nil {
+		return err
+	}
 
 	// Dial and relay
 	dialer := s.dialer
 	if passage.Out != nil {
-		header, err := server.GetHeader(*passage.Out, &s.sweetLisa)
+		header, err := server.GetHeader(*passage.Out, server.LisaOf(s.registrations, passage.Group))
 		if err != nil {
 			return err
 		}
@@ -91,17 +118,22 @@ func (s *Server) handleConn(conn net.Conn) error {
 	defer cancel()
 	switch targetMetadata.Network {
 	case "tcp":
+		dialStart := time.Now()
 		rConn, err := d.DialContext(ctx, "tcp", target)
+		server.ObserveDial(string(s.protocol), "tcp", dialStart, err)
+		info.Logger().Trace("dial: %v", time.Since(dialStart))
 		if err != nil {
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
-				log.Debug("%v", err)
+				info.Logger().WithError(err).Debug("%v", err)
 				return nil // ignore i/o timeout
 			}
 			return err
 		}
 		defer rConn.Close()
-		if err = server.RelayTCP(lConn, rConn); err != nil {
+		sess := server.NewSession(*info, lConn, rConn)
+		defer sess.Done()
+		if err = sess.End(server.RelayTCP(sess, lConn, rConn)); err != nil {
 			var netErr net.Error
 			if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
 				return nil // ignore i/o timeout
@@ -109,7 +141,8 @@ func (s *Server) handleConn(conn net.Conn) error {
 			return fmt.Errorf("relay error: %w", err)
 		}
 	case "udp":
-		log.Debug("vmess received a udp request")
+		info.Network = "udp"
+		info.Logger().Debug("vmess received a udp request")
 		// can dial any target
 		buf := pool.GetFullCap(vmess.MaxUDPSize)
 		defer pool.Put(buf)
@@ -120,7 +153,11 @@ func (s *Server) handleConn(conn net.Conn) error {
 		}
 		// log.Debug("vmess dial udp to %v, write to %v", target, addr)
 
+		dialStart := time.Now()
 		c, err := d.DialContext(ctx, "udp", addr.String())
+		server.ObserveDial(string(s.protocol), "udp", dialStart, err)
+		info.Target = addr.String()
+		info.Logger().Trace("dial: %v", time.Since(dialStart))
 		if err != nil {
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
@@ -129,15 +166,19 @@ func (s *Server) handleConn(conn net.Conn) error {
 			return fmt.Errorf("Dial: %w", err)
 		}
 		rConn := c.(netproxy.PacketConn)
+		sess := server.NewSession(*info, lConn, rConn)
+		defer sess.Done()
 		_ = rConn.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout)) // should keep consistent
-		_, err = rConn.WriteTo(buf[:n], addr.String())
+		n, err = rConn.WriteTo(buf[:n], addr.String())
+		sess.AddUp(n)
 		if err != nil {
+			_ = sess.End(err)
 			if errors.Is(err, net.ErrWriteToConnected) {
-				log.Error("relayConnToUDP: %v", err)
+				sess.Logger().Error("relayConnToUDP: %v", err)
 			}
 			return fmt.Errorf("WriteTo: %w", err)
 		}
-		if err = relayUoT(rConn, lConn); err != nil {
+		if err = sess.End(relayUoT(sess, rConn, lConn)); err != nil {
 			var netErr net.Error
 			if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
 				return nil // ignore i/o timeout
@@ -192,10 +233,18 @@ func (s *Server) handleMsg(conn *vmess.Conn, reqMetadata *vmess.Metadata, passag
 	}
 
 	var reqBody = io.LimitReader(conn, int64(binary.BigEndian.Uint32(bufLen)))
+	reqBody, err := server.VerifyMsg(passage.Group, reqMetadata.Cmd, reqBody)
+	if err != nil {
+		return err
+	}
 
 	var resp []byte
 	switch reqMetadata.Cmd {
 	case protocol.MetadataCmdPing:
+		if server.Withdrawn(passage.Group) {
+			// SweetLisa should take the node as offline
+			return server.ErrWithdrawn
+		}
 		buf := pool.Get(4)
 		defer pool.Put(buf)
 		if _, err := io.ReadFull(reqBody, buf); err != nil {
@@ -205,40 +254,41 @@ func (s *Server) handleMsg(conn *vmess.Conn, reqMetadata *vmess.Metadata, passag
 			log.Warn("the body of received ping message is %v instead of %v", strconv.Quote(string(buf)), strconv.Quote("ping"))
 		}
 		log.Trace("Received a ping message")
-		s.lastAlive = time.Now()
-		bandwidthLimit, err := server.GenerateBandwidthLimit()
+		if err := server.Pinged(s.registrations, passage.Group); err != nil {
+			return err
+		}
+		pingResp, err := server.GeneratePingResp(s, passage.Group)
 		if err != nil {
 			log.Warn("generatePingResp: %v", err)
 			return err
 		}
-		bPingResp, err := jsoniter.Marshal(model.PingResp{BandwidthLimit: bandwidthLimit})
+		bPingResp, err := jsoniter.Marshal(pingResp)
 		if err != nil {
 			log.Warn("%v", err)
 			return err
 		}
 		resp = bPingResp
 	case protocol.MetadataCmdSyncPassages:
-		var passages []model.Passage
-		if err := jsoniter.NewDecoder(reqBody).Decode(&passages); err != nil {
+		if err := server.HandleSyncPassages(s, passage.Group, reqBody); err != nil {
 			return err
 		}
-		var serverPassages []server.Passage
-		for _, passage := range passages {
-			var user = server.Passage{
-				Passage: passage,
-				Manager: false,
-			}
-			serverPassages = append(serverPassages, user)
-		}
-		log.Info("Server asked to SyncPassages")
-		// sweetLisa can replace the manager passage here
-		if err := s.SyncPassages(serverPassages); err != nil {
+		resp = pool.Get(2)
+		defer pool.Put(resp)
+		copy(resp, "OK")
+	case server.MetadataCmdUpdatePassages:
+		if err := server.HandleUpdatePassages(s, passage.Group, reqBody); err != nil {
 			return err
 		}
-
 		resp = pool.Get(2)
 		defer pool.Put(resp)
 		copy(resp, "OK")
+	case server.MetadataCmdRecentLogs:
+		log.Info("Server asked for recent logs")
+		bResp, err := server.GenerateRecentLogsResp(reqBody)
+		if err != nil {
+			return err
+		}
+		resp = bResp
 	default:
 		return fmt.Errorf("%w: unexpected metadata cmd type: %v", protocol.ErrFailAuth, reqMetadata.Cmd)
 	}
@@ -246,11 +296,11 @@ func (s *Server) handleMsg(conn *vmess.Conn, reqMetadata *vmess.Metadata, passag
 	defer pool.Put(buf)
 	binary.BigEndian.PutUint32(buf, uint32(len(resp)))
 	copy(buf[4:], resp)
-	_, err := conn.Write(buf)
+	_, err = conn.Write(buf)
 	return err
 }
 
-func relayConnToUDP(dst netproxy.PacketConn, src *vmess.Conn, timeout time.Duration) (err error) {
+func relayConnToUDP(sess *server.Session, dst netproxy.PacketConn, src *vmess.Conn, timeout time.Duration) (err error) {
 	var n int
 	var addr netip.AddrPort
 	buf := pool.Get(vmess.MaxUDPSize)
@@ -262,10 +312,11 @@ func relayConnToUDP(dst netproxy.PacketConn, src *vmess.Conn, timeout time.Durat
 			return
 		}
 		_ = dst.SetWriteDeadline(time.Now().Add(server.DefaultNatTimeout)) // should keep consistent
-		_, err = dst.WriteTo(buf[:n], addr.String())
+		n, err = dst.WriteTo(buf[:n], addr.String())
+		sess.AddUp(n)
 		// WARNING: if the dst is an pre-connected conn, Write should be invoked here.
 		if errors.Is(err, net.ErrWriteToConnected) {
-			log.Error("relayConnToUDP: %v", err)
+			sess.Logger().Error("relayConnToUDP: %v", err)
 		}
 		if err != nil {
 			return
@@ -273,14 +324,14 @@ func relayConnToUDP(dst netproxy.PacketConn, src *vmess.Conn, timeout time.Durat
 	}
 }
 
-func relayUoT(rConn netproxy.PacketConn, lConn *vmess.Conn) (err error) {
+func relayUoT(sess *server.Session, rConn netproxy.PacketConn, lConn *vmess.Conn) (err error) {
 	eCh := make(chan error, 1)
 	go func() {
-		e := relayConnToUDP(rConn, lConn, server.DefaultNatTimeout)
+		e := relayConnToUDP(sess, rConn, lConn, server.DefaultNatTimeout)
 		rConn.SetReadDeadline(time.Now().Add(10 * time.Second))
 		eCh <- e
 	}()
-	e := server.RelayUDPToConn(lConn, rConn, server.DefaultNatTimeout, vmess.MaxUDPSize)
+	e := server.RelayUDPToConn(sess, lConn, rConn, server.DefaultNatTimeout, vmess.MaxUDPSize)
 	if lConn, ok := lConn.Conn.(server.WriteCloser); ok {
 		lConn.CloseWrite()
 	}
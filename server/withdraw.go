@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/log"
+)
+
+const (
+	// DefaultWithdrawThreshold is the number of consecutive failed validations to withdraw.
+	DefaultWithdrawThreshold = 3
+	// DefaultRecoverThreshold is the number of consecutive successful validations to register again.
+	DefaultRecoverThreshold = 2
+)
+
+var ErrWithdrawn = fmt.Errorf("withdrawn from SweetLisa")
+
+var (
+	// withdrawnGroups are the tickets of the groups withdrawn
+	withdrawnGroups   = make(map[string]struct{})
+	muWithdrawnGroups sync.Mutex
+)
+
+// Withdrawn returns if the node is withdrawn from the SweetLisa of the group because its CDN configuration is not
+// trustworthy.
+func Withdrawn(group string) bool {
+	muWithdrawnGroups.Lock()
+	defer muWithdrawnGroups.Unlock()
+	_, ok := withdrawnGroups[group]
+	return ok
+}
+
+// WithdrawnGroups returns the tickets of the groups withdrawn.
+func WithdrawnGroups() (groups []string) {
+	muWithdrawnGroups.Lock()
+	defer muWithdrawnGroups.Unlock()
+	for group := range withdrawnGroups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// setWithdrawn sets whether the group is withdrawn and returns whether it was.
+func setWithdrawn(group string, withdrawn bool) (was bool) {
+	muWithdrawnGroups.Lock()
+	defer muWithdrawnGroups.Unlock()
+	_, was = withdrawnGroups[group]
+	if withdrawn {
+		withdrawnGroups[group] = struct{}{}
+	} else {
+		delete(withdrawnGroups, group)
+	}
+	return was
+}
+
+// CheckServing returns an error if sessions of the passage should not be served now.
+func CheckServing(passage *Passage) error {
+	if passage.Use() != PassageUseManager && Withdrawn(passage.Group) {
+		return ErrWithdrawn
+	}
+	return CheckQuota(passage)
+}
+
+// Withdrawal is the state machine of a group driven by the results of CDN validation of its SweetLisa.
+//
+// After WithdrawThreshold consecutive failures, or at once if the CDN can steal IP, the node withdraws from the group:
+// user passages of the group are removed, their sessions are closed, and pings and registration of the group are
+// stopped so that SweetLisa takes the node as offline. After RecoverThreshold consecutive successes, the node
+// registers again to get the passages back. Other groups are not affected.
+type Withdrawal struct {
+	Servers []Server
+	// Group is the ticket of the group.
+	Group             string
+	WithdrawThreshold int
+	RecoverThreshold  int
+
+	mu        sync.Mutex
+	failures  int
+	successes int
+}
+
+func NewWithdrawal(servers []Server, group string) *Withdrawal {
+	return &Withdrawal{
+		Servers:           servers,
+		Group:             group,
+		WithdrawThreshold: DefaultWithdrawThreshold,
+		RecoverThreshold:  DefaultRecoverThreshold,
+	}
+}
+
+// Report feeds the result of a validation. Errors other than failed validation, such as timeouts, are ignored.
+func (w *Withdrawal) Report(cdnNames string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case err == nil:
+		w.failures = 0
+		if !Withdrawn(w.Group) {
+			return
+		}
+		w.successes++
+		if w.successes < w.RecoverThreshold {
+			log.Info("CDN validation passed (%v/%v). Keep waiting to register again", w.successes, w.RecoverThreshold)
+			return
+		}
+		if err := w.recover(); err != nil {
+			log.Warn("Failed to register again: %v", err)
+			return
+		}
+		w.successes = 0
+	case errors.Is(err, cdn_validator.ErrCanStealIP):
+		w.successes = 0
+		log.Error("%v: %v", cdnNames, err)
+		Emit(EventCDNCanStealIP, fmt.Sprintf("%v: %v", cdnNames, err), nil)
+		w.withdraw(err)
+	case errors.Is(err, cdn_validator.ErrFailedValidate):
+		w.successes = 0
+		w.failures++
+		if w.failures < w.WithdrawThreshold {
+			log.Warn("%v: %v", cdnNames, err)
+			return
+		}
+		log.Error("%v: %v", cdnNames, err)
+		w.withdraw(err)
+	default:
+		log.Warn("%v: %v", cdnNames, err)
+	}
+}
+
+func (w *Withdrawal) withdraw(reason error) {
+	if setWithdrawn(w.Group, true) {
+		return
+	}
+	log.Alert("Withdraw from SweetLisa %v and stop serving its users until the CDN validation passes", log.Opaque(w.Group))
+	for _, s := range w.Servers {
+		// resyncPassages keeps only the manager of the group now.
+		if err := resyncPassages(s); err != nil {
+			log.Warn("withdraw: %v", err)
+		}
+	}
+	n := CloseSessions(CloseReasonWithdrawn, func(s *Session) bool {
+		return s.Passage.Use() != PassageUseManager && s.Passage.Group == w.Group
+	})
+	log.Warn("Closed %v existing sessions", n)
+	Emit(EventWithdrawn, reason.Error(), nil)
+}
+
+func (w *Withdrawal) recover() error {
+	setWithdrawn(w.Group, false)
+	for _, s := range w.Servers {
+		// other groups are not registered, so that their failures do not keep this group withdrawn
+		if err := s.Reregister(w.Group); err != nil {
+			setWithdrawn(w.Group, true)
+			for _, s := range w.Servers {
+				_ = resyncPassages(s)
+			}
+			return err
+		}
+	}
+	log.Alert("CDN validation passed. Registered at SweetLisa %v again", log.Opaque(w.Group))
+	Emit(EventResumed, "registered at SweetLisa again after the CDN validation passed", nil)
+	return nil
+}
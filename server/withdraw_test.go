@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/BitterJohn/pkg/cdn_validator"
+	"github.com/e14914c0-6759-480d-be89-66b7b7676451/SweetLisa/model"
+)
+
+// fakeServer keeps passages in memory and gets users from registering.
+type fakeServer struct {
+	mu          sync.Mutex
+	passages    []Passage
+	users       []Passage
+	registerErr error
+	// groupErrs fail the registration at the groups
+	groupErrs  map[string]error
+	registered int
+	// generated is the number of manager passwords generated
+	generated int
+	// reregistered are the groups of every Reregister
+	reregistered [][]string
+}
+
+func (s *fakeServer) Listen(addr string) error { return nil }
+
+// AddPassages replaces the manager of the group as the servers do, and generates its password if empty.
+func (s *fakeServer) AddPassages(passages []Passage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	passages = append([]Passage(nil), passages...)
+	for i := range passages {
+		p := &passages[i]
+		if !p.Manager || !p.RetireAt.IsZero() {
+			continue
+		}
+		if p.In.Password == "" {
+			s.generated++
+			p.In = testPassage(fmt.Sprintf("manager%v", s.generated), true).In
+		}
+		var kept []Passage
+		for _, q := range s.passages {
+			if !q.Manager || !q.RetireAt.IsZero() || q.Group != p.Group {
+				kept = append(kept, q)
+			}
+		}
+		s.passages = kept
+	}
+	s.passages = append(s.passages, passages...)
+	return nil
+}
+
+func (s *fakeServer) RemovePassages(passages []Passage, alsoManager bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []Passage
+	for _, p := range s.passages {
+		remove := false
+		for _, r := range passages {
+			if PassageKey(&p) == PassageKey(&r) && (alsoManager || !p.Manager) {
+				remove = true
+			}
+		}
+		if !remove {
+			kept = append(kept, p)
+		}
+	}
+	s.passages = kept
+	return nil
+}
+
+func (s *fakeServer) UpdatePassages(toRemove []Passage, toAdd []Passage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []Passage
+	for _, p := range s.passages {
+		remove := false
+		for _, r := range toRemove {
+			if PassageKey(&p) == PassageKey(&r) && !p.Manager {
+				remove = true
+			}
+		}
+		for _, a := range toAdd {
+			if p.Manager && a.Manager && p.Group == a.Group {
+				remove = true
+			}
+		}
+		if !remove {
+			kept = append(kept, p)
+		}
+	}
+	s.passages = append(kept, toAdd...)
+	return nil
+}
+
+func (s *fakeServer) SyncPassages(passages []Passage) error { return SyncPassages(s, passages) }
+
+func (s *fakeServer) Passages() []Passage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Passage(nil), s.passages...)
+}
+
+func (s *fakeServer) LastAlive() time.Time { return time.Now() }
+
+func (s *fakeServer) Reregister(groups ...string) error {
+	s.mu.Lock()
+	err := s.registerErr
+	s.registered++
+	s.reregistered = append(s.reregistered, groups)
+	groupErrs := s.groupErrs
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		for _, err := range groupErrs {
+			if err != nil {
+				return err
+			}
+		}
+		return s.SyncPassages(s.users)
+	}
+	for _, group := range groups {
+		if err := groupErrs[group]; err != nil {
+			return err
+		}
+		var users []Passage
+		for _, u := range s.users {
+			if u.Group == group {
+				users = append(users, u)
+			}
+		}
+		if err := SyncGroupPassages(s, group, users); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) Close() error { return nil }
+
+func testPassage(password string, manager bool) Passage {
+	return Passage{Manager: manager, Passage: model.Passage{In: model.In{
+		Argument: model.Argument{Protocol: "shadowsocks", Password: password, Method: "chacha20-ietf-poly1305"},
+	}}}
+}
+
+func countUsers(passages []Passage) (n int) {
+	for _, p := range passages {
+		if !p.Manager {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWithdrawal(t *testing.T) {
+	defer setWithdrawn("ticket", false)
+	manager := testPassage("manager", true)
+	users := InGroup("ticket", []Passage{manager, testPassage("user1", false), testPassage("user2", false)})
+	manager = users[0]
+	// the other group is not withdrawn with the group
+	other := testPassage("other", false)
+	other.Group = "other"
+	users = append(users, other)
+	s := &fakeServer{users: users}
+	if err := s.Reregister(); err != nil {
+		t.Fatal(err)
+	}
+	userSess := NewSession(SessionInfo{Protocol: "shadowsocks", Network: "tcp", Passage: &users[1]})
+	defer userSess.Done()
+	managerSess := NewSession(SessionInfo{Protocol: "shadowsocks", Network: "tcp", Passage: &manager})
+	defer managerSess.Done()
+	otherSess := NewSession(SessionInfo{Protocol: "shadowsocks", Network: "tcp", Passage: &other})
+	defer otherSess.Done()
+
+	w := NewWithdrawal([]Server{s}, "ticket")
+	failed := fmt.Errorf("%w cdn: %w", cdn_validator.ErrFailedValidate, cdn_validator.ErrNotFound)
+
+	// timeouts are not failures
+	for i := 0; i < 5; i++ {
+		w.Report("cloudflare", context.DeadlineExceeded)
+	}
+	w.Report("cloudflare", failed)
+	w.Report("cloudflare", failed)
+	if Withdrawn("ticket") {
+		t.Fatal("withdrawn before the threshold")
+	}
+	w.Report("cloudflare", failed)
+	if !Withdrawn("ticket") || Withdrawn("other") {
+		t.Fatal("not withdrawn from the group after consecutive failures")
+	}
+	if n := countUsers(s.Passages()); n != 1 || len(s.Passages()) != 2 {
+		t.Errorf("unexpected passages after withdrawing: %v users of %v", n, len(s.Passages()))
+	}
+	if err := CheckServing(&other); err != nil {
+		t.Errorf("the user of the other group is not served: %v", err)
+	}
+	if otherSess.CloseReason() == CloseReasonWithdrawn {
+		t.Error("the session of the other group is closed")
+	}
+	if err := CheckServing(&users[1]); err != ErrWithdrawn {
+		t.Errorf("user passage is served: %v", err)
+	}
+	if err := CheckServing(&manager); err != nil {
+		t.Errorf("manager is not served: %v", err)
+	}
+	if userSess.CloseReason() != CloseReasonWithdrawn {
+		t.Errorf("unexpected reason of the user session: %v", userSess.CloseReason())
+	}
+	if managerSess.CloseReason() == CloseReasonWithdrawn {
+		t.Error("the manager session is closed")
+	}
+
+	// passages synced from SweetLisa are not served during the withdrawal
+	if err := s.SyncPassages(users); err != nil {
+		t.Fatal(err)
+	}
+	if n := countUsers(s.Passages()); n != 1 {
+		t.Errorf("%v users are added during the withdrawal", n-1)
+	}
+
+	// a failed registration keeps the node withdrawn
+	s.registerErr = io.ErrUnexpectedEOF
+	w.Report("cloudflare", nil)
+	w.Report("cloudflare", nil)
+	if !Withdrawn("ticket") || countUsers(s.Passages()) != 1 {
+		t.Fatal("recovered without registering")
+	}
+
+	// only the group is registered again, and the failure of the other group does not matter
+	s.registerErr = nil
+	s.groupErrs = map[string]error{"other": io.ErrUnexpectedEOF}
+	w.Report("cloudflare", nil)
+	if Withdrawn("ticket") {
+		t.Fatal("still withdrawn after the validation passed")
+	}
+	if groups := s.reregistered[len(s.reregistered)-1]; len(groups) != 1 || groups[0] != "ticket" {
+		t.Errorf("unexpected groups registered again: %v", groups)
+	}
+	if n := countUsers(s.Passages()); n != 3 {
+		t.Errorf("unexpected users after registering again: %v", n)
+	}
+
+	// stealing IP withdraws at once
+	w.Report("cloudflare", fmt.Errorf("failed to validate cdn: %w", cdn_validator.ErrCanStealIP))
+	if !Withdrawn("ticket") {
+		t.Error("not withdrawn when the CDN can steal IP")
+	}
+}